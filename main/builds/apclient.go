@@ -0,0 +1,86 @@
+package builds
+
+import (
+	e "XrayHelper/main/errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const tagApClient = "apClient"
+
+// ApClient a client of ap interfaces selected by apClients entry, the entry is a MAC address or a source IP/CIDR
+type ApClient struct {
+	// MAC the upper case MAC address, iptables shows it in upper case
+	MAC string
+	// CIDR the source address, a single IP is kept as it is
+	CIDR string
+	IPv6 bool
+	// Entry the original apClients entry
+	Entry string
+}
+
+// ParseApClient parse the apClients entry
+func ParseApClient(entry string) (ApClient, error) {
+	client := ApClient{Entry: entry}
+	entry = strings.TrimSpace(entry)
+	if mac, err := net.ParseMAC(entry); err == nil && len(mac) == 6 {
+		client.MAC = strings.ToUpper(mac.String())
+		return client, nil
+	}
+	if ip, _, err := net.ParseCIDR(entry); err == nil {
+		client.CIDR, client.IPv6 = entry, ip.To4() == nil
+		return client, nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		client.CIDR, client.IPv6 = entry, ip.To4() == nil
+		return client, nil
+	}
+	return client, e.New("invalid ap client " + strconv.Quote(entry) + ", should be a MAC address or an IP/CIDR").WithPrefix(tagApClient)
+}
+
+// Match whether the client with ip and mac address is selected by the entry
+func (this ApClient) Match(ip string, mac string) bool {
+	if len(this.MAC) > 0 {
+		return strings.EqualFold(this.MAC, mac)
+	}
+	address := net.ParseIP(ip)
+	if address == nil {
+		return false
+	}
+	if _, cidr, err := net.ParseCIDR(this.CIDR); err == nil {
+		return cidr.Contains(address)
+	}
+	return net.ParseIP(this.CIDR).Equal(address)
+}
+
+// GetApClients get the parsed apClients, the invalid entry is skipped
+func GetApClients() []ApClient {
+	var clients []ApClient
+	for _, entry := range Config.Proxy.ApClients {
+		if client, err := ParseApClient(entry); err == nil {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// ApClientAllowMode whether only the clients in apClients are proxied, otherwise they are bypassed,
+// apClientMode has no effect if apClients is empty
+func ApClientAllowMode() bool {
+	return Config.Proxy.ApClientMode == "allow" && len(GetApClients()) > 0
+}
+
+// ApClientProxied whether the traffic of the client on ap interfaces is proxied
+func ApClientProxied(ip string, mac string) bool {
+	clients := GetApClients()
+	if len(clients) == 0 {
+		return true
+	}
+	for _, client := range clients {
+		if client.Match(ip, mac) {
+			return Config.Proxy.ApClientMode == "allow"
+		}
+	}
+	return Config.Proxy.ApClientMode != "allow"
+}
@@ -0,0 +1,32 @@
+package builds
+
+import (
+	"XrayHelper/main/common"
+	"strconv"
+)
+
+// AppGroup an app group, the traffic of its apps is marked with its own mark and redirected to its own tproxy port
+type AppGroup struct {
+	Name       string
+	TproxyPort string
+	Mark       string
+	PkgList    []string
+}
+
+// GetAppGroups get app groups with default value, the default tproxy port is proxy.tproxyPort,
+// the default mark is the tproxy mark plus the group index
+func GetAppGroups() []AppGroup {
+	var groups []AppGroup
+	tproxyMark, _ := strconv.Atoi(common.TproxyMarkId)
+	for i, group := range Config.Proxy.AppGroups {
+		appGroup := AppGroup{Name: group.Name, TproxyPort: group.TproxyPort, Mark: group.Mark, PkgList: group.PkgList}
+		if len(appGroup.TproxyPort) == 0 {
+			appGroup.TproxyPort = Config.Proxy.TproxyPort
+		}
+		if len(appGroup.Mark) == 0 {
+			appGroup.Mark = strconv.Itoa(tproxyMark + i + 1)
+		}
+		groups = append(groups, appGroup)
+	}
+	return groups
+}
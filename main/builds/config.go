@@ -7,17 +7,29 @@ import (
 	"github.com/creasty/defaults"
 	"gopkg.in/yaml.v3"
 	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 )
 
-const packageListPath = "/data/system/packages.list"
+// PackageListPath the Android package list, which contains the package name and its app id
+const PackageListPath = "/data/system/packages.list"
+
+// userListPath each user on the device has a directory named by its user id here
+const userListPath = "/data/system/users"
 const tagConfig = "config"
 
 var ConfigFilePath *string
 var CoreStartTimeout *int
+var StopTimeout *int
 var BypassSelf *bool
 var PackageMap = make(map[string]string)
 
+// UserList the users on the device, the owner 0 is always included
+var UserList = []int{0}
+
 // Config the program configuration, yml
 var Config struct {
 	XrayHelper struct {
@@ -31,58 +43,137 @@ var Config struct {
 	} `yaml:"xrayHelper"`
 	Proxy struct {
 		Method          string   `default:"tproxy" yaml:"method"`
+		Firewall        string   `default:"iptables" yaml:"firewall"`
 		TproxyPort      string   `default:"65535" yaml:"tproxyPort"`
 		SocksPort       string   `default:"65534" yaml:"socksPort"`
+		RedirectPort    string   `default:"65532" yaml:"redirectPort"`
+		RedirectUDP     bool     `default:"false" yaml:"redirectUDP"`
 		TunDevice       string   `default:"xtun" yaml:"tunDevice"`
 		EnableIPv6      bool     `default:"false" yaml:"enableIPv6"`
 		AutoDNSStrategy bool     `default:"true" yaml:"autoDNSStrategy"`
 		Mode            string   `default:"blacklist" yaml:"mode"`
 		PkgList         []string `yaml:"pkgList"`
 		ApList          []string `yaml:"apList"`
+		ApClientMode    string   `default:"deny" yaml:"apClientMode"`
+		ApClients       []string `yaml:"apClients"`
 		IgnoreList      []string `yaml:"ignoreList"`
 		IntraList       []string `yaml:"intraList"`
+		BypassLists     []string `yaml:"bypassLists"`
+		BlockQuic       bool     `default:"false" yaml:"blockQuic"`
+		BlockQuicList   []string `yaml:"blockQuicList"`
+		AppGroups       []struct {
+			Name       string   `yaml:"name"`
+			TproxyPort string   `yaml:"tproxyPort"`
+			Mark       string   `yaml:"mark"`
+			PkgList    []string `yaml:"pkgList"`
+		} `yaml:"appGroups"`
+		Policies []struct {
+			When string `yaml:"when"`
+		} `yaml:"policies"`
 	} `yaml:"proxy"`
+	DNS struct {
+		Hijack  string `default:"auto" yaml:"hijack"`
+		Port    string `yaml:"port"`
+		DoT     string `default:"none" yaml:"dot"`
+		DoTPort string `yaml:"dotPort"`
+	} `yaml:"dns"`
 	Clash struct {
 		DNSPort  string `default:"65533" yaml:"dnsPort"`
 		Template string `yaml:"template"`
 	} `yaml:"clash"`
+	Log struct {
+		MaxSize int  `default:"2048" yaml:"maxSize"`
+		Keep    int  `default:"3" yaml:"keep"`
+		SelfLog bool `default:"false" yaml:"selfLog"`
+	} `yaml:"log"`
 }
 
-// LoadConfig load program configuration file, should be called before any command Execute
+// LoadConfig load program configuration file, should be called before any command Execute, if a profile is active, load the profile instead
 func LoadConfig() error {
-	configFile, err := os.ReadFile(*ConfigFilePath)
+	if err := loadConfigFile(*ConfigFilePath); err != nil {
+		return err
+	}
+	BaseRunDir = Config.XrayHelper.RunDir
+	if profile := ActiveProfile(); len(profile) > 0 {
+		log.HandleDebug("config: active profile is " + profile)
+		return LoadProfile(profile)
+	}
+	return nil
+}
+
+// loadConfigFile reset Config to default value, then load the configuration file
+func loadConfigFile(configFilePath string) error {
+	configFile, err := os.ReadFile(configFilePath)
 	if err != nil {
 		return e.New("load config failed, ", err).WithPrefix(tagConfig)
 	}
+	reflect.ValueOf(&Config).Elem().SetZero()
 	if err := defaults.Set(&Config); err != nil {
 		return e.New("set default config failed, ", err).WithPrefix(tagConfig)
 	}
 	if err := yaml.Unmarshal(configFile, &Config); err != nil {
 		return e.New("unmarshal config failed, ", err).WithPrefix(tagConfig)
 	}
+	configNode = yaml.Node{}
+	if err := yaml.Unmarshal(configFile, &configNode); err != nil {
+		return e.New("unmarshal config failed, ", err).WithPrefix(tagConfig)
+	}
+	loadedConfigPath = configFilePath
+	if Config.Log.SelfLog {
+		if err := log.SetLogFile(path.Join(Config.XrayHelper.RunDir, "xrayhelper.log"), LogMaxSize(), Config.Log.Keep); err != nil {
+			log.HandleError(err)
+		}
+	}
 	log.HandleDebug(Config.XrayHelper)
 	log.HandleDebug(Config.Proxy)
 	log.HandleDebug(Config.Clash)
+	log.HandleDebug(Config.Log)
 	return nil
 }
 
+// LogMaxSize get the max size of log file in bytes
+func LogMaxSize() int64 {
+	return int64(Config.Log.MaxSize) * 1024
+}
+
 // LoadPackage load and parse Android package with uid list into a map
 func LoadPackage() error {
-	packageListFile, err := os.Open(packageListPath)
+	packageListFile, err := os.Open(PackageListPath)
 	if err != nil {
 		return e.New("load package failed, ", err).WithPrefix(tagConfig)
 	}
+	// build a new map, so that the uninstalled packages are removed when reload
+	packageMap := make(map[string]string)
 	packageScanner := bufio.NewScanner(packageListFile)
 	packageScanner.Split(bufio.ScanLines)
 	for packageScanner.Scan() {
 		packageInfo := strings.Fields(packageScanner.Text())
 		if len(packageInfo) >= 2 {
-			PackageMap[packageInfo[0]] = packageInfo[1]
+			packageMap[packageInfo[0]] = packageInfo[1]
 		}
 	}
 	if err := packageListFile.Close(); err != nil {
 		return e.New("close package file failed, ", err).WithPrefix(tagConfig)
 	}
+	PackageMap = packageMap
+	loadUser()
 	log.HandleDebug(PackageMap)
 	return nil
 }
+
+// loadUser load the users on the device, only the owner is kept if the user list cannot be read
+func loadUser() {
+	userList := []int{0}
+	userDirs, err := os.ReadDir(userListPath)
+	if err != nil {
+		log.HandleDebug("load user failed, " + err.Error())
+	}
+	for _, userDir := range userDirs {
+		if user, err := strconv.Atoi(userDir.Name()); err == nil && userDir.IsDir() && user > 0 {
+			userList = append(userList, user)
+		}
+	}
+	sort.Ints(userList)
+	UserList = userList
+	log.HandleDebug(UserList)
+}
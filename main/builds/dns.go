@@ -0,0 +1,23 @@
+package builds
+
+// GetDNSHijack get the dns hijack mode, auto mode redirects dns request to the dns port of mihomo(clash.meta),
+// and sends dns request of other cores through proxy rules
+func GetDNSHijack() string {
+	if Config.DNS.Hijack != "auto" {
+		return Config.DNS.Hijack
+	}
+	switch Config.XrayHelper.CoreType {
+	case "clash.meta", "mihomo":
+		return "redirect"
+	default:
+		return "tproxy"
+	}
+}
+
+// GetDNSPort get the local port which dns request is redirected to, the default value is clash.dnsPort
+func GetDNSPort() string {
+	if len(Config.DNS.Port) > 0 {
+		return Config.DNS.Port
+	}
+	return Config.Clash.DNSPort
+}
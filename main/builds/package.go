@@ -0,0 +1,156 @@
+package builds
+
+import (
+	e "XrayHelper/main/errors"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const tagPackage = "package"
+
+// AllUsers the user value of pkgList entry which selects all users on the device
+const AllUsers = -1
+
+// PackageEntry an entry of pkgList, format is selector[?proto=tcp|udp&ports=80,443,1000-2000], the selector is one of
+// package[:user], the package may contain wildcard * and the user may be * (all users), eg: com.google.*, *:10, com.app:*
+// uid:uid[-uid], raw uid or uid range, eg: uid:10123
+// appid:appid[-appid][:user], app id or app id range of the user, eg: appid:10000-10999:10
+type PackageEntry struct {
+	// Package the package name or wildcard pattern, empty when the entry selects uid or app id
+	Package string
+	// User the user of package or app id, AllUsers means all users on the device
+	User int
+	// Uid raw uid or uid range like 10000-10999, it is not expanded by user
+	Uid string
+	// AppId app id or app id range like 10000-10999, it is expanded by user
+	AppId string
+	// Proto only the traffic of this protocol matches, empty means both tcp and udp
+	Proto string
+	// Ports only the traffic to these destination ports matches, a port range is like 1000-2000
+	Ports []string
+}
+
+// ParsePackageEntry parse the pkgList entry
+func ParsePackageEntry(entry string) (PackageEntry, error) {
+	var pkgEntry PackageEntry
+	pkgInfo, query, hasQuery := strings.Cut(entry, "?")
+	if uid, ok := strings.CutPrefix(pkgInfo, "uid:"); ok {
+		if !validIdRange(uid) {
+			return pkgEntry, e.New("invalid uid " + strconv.Quote(uid) + ", format is uid:uid[-uid]").WithPrefix(tagPackage)
+		}
+		pkgEntry.Uid = uid
+	} else if appInfo, ok := strings.CutPrefix(pkgInfo, "appid:"); ok {
+		info := strings.Split(appInfo, ":")
+		if len(info) > 2 || !validIdRange(info[0]) {
+			return pkgEntry, e.New("invalid app id " + strconv.Quote(appInfo) + ", format is appid:appid[-appid][:user]").WithPrefix(tagPackage)
+		}
+		pkgEntry.AppId = info[0]
+		if len(info) == 2 {
+			user, ok := parseUser(info[1])
+			if !ok {
+				return pkgEntry, e.New("invalid user " + strconv.Quote(info[1]) + " of app id " + pkgEntry.AppId).WithPrefix(tagPackage)
+			}
+			pkgEntry.User = user
+		}
+	} else {
+		info := strings.Split(pkgInfo, ":")
+		if len(info) > 2 || len(info[0]) == 0 {
+			return pkgEntry, e.New("invalid package " + strconv.Quote(entry) + ", format is package[:user][?proto=tcp|udp&ports=80,443]").WithPrefix(tagPackage)
+		}
+		if _, err := path.Match(info[0], ""); err != nil {
+			return pkgEntry, e.New("invalid package pattern " + strconv.Quote(info[0])).WithPrefix(tagPackage)
+		}
+		pkgEntry.Package = info[0]
+		if len(info) == 2 {
+			user, ok := parseUser(info[1])
+			if !ok {
+				return pkgEntry, e.New("invalid user " + strconv.Quote(info[1]) + " of package " + pkgEntry.Package).WithPrefix(tagPackage)
+			}
+			pkgEntry.User = user
+		}
+	}
+	if !hasQuery {
+		return pkgEntry, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return pkgEntry, e.New("invalid filter "+strconv.Quote(query)+" of package "+pkgInfo+", ", err).WithPrefix(tagPackage)
+	}
+	for key := range values {
+		switch key {
+		case "proto":
+			pkgEntry.Proto = values.Get(key)
+			if pkgEntry.Proto != "tcp" && pkgEntry.Proto != "udp" {
+				return pkgEntry, e.New("invalid proto " + strconv.Quote(pkgEntry.Proto) + " of package " + pkgInfo + ", available value [tcp|udp]").WithPrefix(tagPackage)
+			}
+		case "ports":
+			for _, port := range strings.Split(values.Get(key), ",") {
+				if !validPortRange(port) {
+					return pkgEntry, e.New("invalid port " + strconv.Quote(port) + " of package " + pkgInfo).WithPrefix(tagPackage)
+				}
+				pkgEntry.Ports = append(pkgEntry.Ports, port)
+			}
+		default:
+			return pkgEntry, e.New("unknown filter " + strconv.Quote(key) + " of package " + pkgInfo + ", available filter [proto|ports]").WithPrefix(tagPackage)
+		}
+	}
+	return pkgEntry, nil
+}
+
+// MatchPackages get the installed packages which match the package name or wildcard pattern, sorted by name
+func MatchPackages(pattern string) []string {
+	var packages []string
+	if !strings.Contains(pattern, "*") {
+		if _, ok := PackageMap[pattern]; ok {
+			packages = append(packages, pattern)
+		}
+		return packages
+	}
+	for pkg := range PackageMap {
+		if matched, _ := path.Match(pattern, pkg); matched {
+			packages = append(packages, pkg)
+		}
+	}
+	sort.Strings(packages)
+	return packages
+}
+
+// parseUser parse the user of pkgList entry, * means all users
+func parseUser(user string) (int, bool) {
+	if user == "*" {
+		return AllUsers, true
+	}
+	id, err := strconv.Atoi(user)
+	return id, err == nil && id >= 0
+}
+
+// validIdRange check the uid or app id, or the range like 10000-10999
+func validIdRange(idRange string) bool {
+	start, end, isRange := strings.Cut(idRange, "-")
+	startId, err := strconv.Atoi(start)
+	if err != nil || startId < 0 {
+		return false
+	}
+	if !isRange {
+		return true
+	}
+	endId, err := strconv.Atoi(end)
+	return err == nil && endId > startId
+}
+
+// validPortRange check the port or port range like 1000-2000
+func validPortRange(portRange string) bool {
+	start, end, isRange := strings.Cut(portRange, "-")
+	startPort, err := strconv.Atoi(start)
+	if err != nil || startPort <= 0 || startPort > 65535 {
+		return false
+	}
+	if !isRange {
+		return true
+	}
+	endPort, err := strconv.Atoi(end)
+	return err == nil && endPort > startPort && endPort <= 65535
+}
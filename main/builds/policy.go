@@ -0,0 +1,79 @@
+package builds
+
+import (
+	e "XrayHelper/main/errors"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const tagPolicy = "policy"
+
+// Policy a network policy which enables or disables proxy, format is "interface <name> up|down -> enable|disable"
+// or "default route via <name> -> enable|disable", the name supports wildcard * and iptables style suffix +
+type Policy struct {
+	// Route whether the condition is default route, otherwise it is interface state
+	Route bool
+	// Interface the interface name pattern
+	Interface string
+	// Up the interface state which matches, only for interface condition
+	Up bool
+	// Enable whether proxy should be enabled when the condition matches
+	Enable bool
+	// When the original policy text
+	When string
+}
+
+// ParsePolicy parse the policy text
+func ParsePolicy(when string) (Policy, error) {
+	policy := Policy{When: when}
+	condition, action, ok := strings.Cut(when, "->")
+	if !ok {
+		return policy, e.New("invalid policy " + strconv.Quote(when) + ", format is <condition> -> enable|disable").WithPrefix(tagPolicy)
+	}
+	switch strings.TrimSpace(action) {
+	case "enable":
+		policy.Enable = true
+	case "disable":
+	default:
+		return policy, e.New("invalid action " + strconv.Quote(strings.TrimSpace(action)) + ", available action [enable|disable]").WithPrefix(tagPolicy)
+	}
+	fields := strings.Fields(condition)
+	switch {
+	case len(fields) == 3 && fields[0] == "interface" && (fields[2] == "up" || fields[2] == "down"):
+		policy.Interface, policy.Up = fields[1], fields[2] == "up"
+	case len(fields) == 4 && fields[0] == "default" && fields[1] == "route" && fields[2] == "via":
+		policy.Route, policy.Interface = true, fields[3]
+	default:
+		return policy, e.New("invalid condition " + strconv.Quote(strings.TrimSpace(condition)) + ", available condition [interface <name> up|down, default route via <name>]").WithPrefix(tagPolicy)
+	}
+	if _, err := path.Match(policy.Interface, ""); err != nil {
+		return policy, e.New("invalid interface pattern " + strconv.Quote(policy.Interface)).WithPrefix(tagPolicy)
+	}
+	return policy, nil
+}
+
+// MatchInterface whether the interface name matches the pattern of policy
+func (this Policy) MatchInterface(name string) bool {
+	return MatchInterface(this.Interface, name)
+}
+
+// MatchInterface whether the interface name matches the pattern, the pattern supports wildcard * and iptables style suffix +
+func MatchInterface(pattern string, name string) bool {
+	if strings.HasSuffix(pattern, "+") {
+		pattern = strings.TrimSuffix(pattern, "+") + "*"
+	}
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+// GetPolicies get the parsed policies of proxy.policies, the invalid policy is skipped
+func GetPolicies() []Policy {
+	var policies []Policy
+	for _, policy := range Config.Proxy.Policies {
+		if parsed, err := ParsePolicy(policy.When); err == nil {
+			policies = append(policies, parsed)
+		}
+	}
+	return policies
+}
@@ -0,0 +1,69 @@
+package builds_test
+
+import (
+	"XrayHelper/main/builds"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		when     string
+		expected builds.Policy
+		invalid  bool
+	}{
+		{when: "interface wlan0 up -> disable", expected: builds.Policy{Interface: "wlan0", Up: true}},
+		{when: "  interface rmnet_data+   down->enable ", expected: builds.Policy{Interface: "rmnet_data+", Enable: true}},
+		{when: "default route via tun* -> disable", expected: builds.Policy{Route: true, Interface: "tun*"}},
+		{when: "interface wlan0 up", invalid: true},
+		{when: "interface wlan0 up -> restart", invalid: true},
+		{when: "interface wlan0 running -> enable", invalid: true},
+		{when: "interface wlan0 -> enable", invalid: true},
+		{when: "default route wlan0 -> enable", invalid: true},
+		{when: "interface wlan[0 up -> enable", invalid: true},
+		{when: "", invalid: true},
+	}
+	for _, test := range tests {
+		policy, err := builds.ParsePolicy(test.when)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("%q should be invalid, got %+v", test.when, policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q should be valid, got %v", test.when, err)
+			continue
+		}
+		test.expected.When = test.when
+		if policy != test.expected {
+			t.Errorf("%q expect %+v, got %+v", test.when, test.expected, policy)
+		}
+	}
+}
+
+func TestMatchInterface(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"wlan0", "wlan0", true},
+		{"wlan0", "wlan1", false},
+		{"wlan+", "wlan", true},
+		{"wlan+", "wlan1", true},
+		{"wlan+", "swlan0", false},
+		{"rmnet*", "rmnet_data0", true},
+		{"*data*", "rmnet_data0", true},
+		{"rmnet_data?", "rmnet_data10", false},
+		{"tun*", "wlan0", false},
+	}
+	for _, test := range tests {
+		if builds.MatchInterface(test.pattern, test.name) != test.matched {
+			t.Errorf("%q match %q should be %v", test.pattern, test.name, test.matched)
+		}
+	}
+	policy, _ := builds.ParsePolicy("interface rndis+ up -> enable")
+	if !policy.MatchInterface("rndis0") || policy.MatchInterface("wlan0") {
+		t.Error("policy should match interface by its pattern")
+	}
+}
@@ -0,0 +1,121 @@
+package builds
+
+import (
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultProfile the profile name of the base config file
+	DefaultProfile = "default"
+	profileDirName = "profiles"
+	// activeProfileFile the file in base runDir which records the active profile
+	activeProfileFile = "profile"
+)
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// BaseRunDir the runDir of the base config file, active profile is recorded here
+var BaseRunDir string
+
+// loadedConfigPath the path of the config file which is loaded currently
+var loadedConfigPath string
+
+// LoadedConfigPath get the path of the config file which is loaded currently, it may be a profile
+func LoadedConfigPath() string {
+	return loadedConfigPath
+}
+
+// ProfileDir get the profiles directory, it is placed next to the base config file
+func ProfileDir() string {
+	return path.Join(path.Dir(*ConfigFilePath), profileDirName)
+}
+
+// ProfilePath get the config file path of profile
+func ProfilePath(name string) (string, error) {
+	if name == DefaultProfile {
+		return *ConfigFilePath, nil
+	}
+	if !profileNameRegexp.MatchString(name) {
+		return "", e.New("invalid profile name " + name).WithPrefix(tagConfig)
+	}
+	for _, ext := range []string{".yml", ".yaml"} {
+		profilePath := path.Join(ProfileDir(), name+ext)
+		if _, err := os.Stat(profilePath); err == nil {
+			return profilePath, nil
+		}
+	}
+	return "", e.New("profile " + name + " not found in " + ProfileDir()).WithPrefix(tagConfig)
+}
+
+// ListProfiles list all profiles, the default profile is always the first one
+func ListProfiles() ([]string, error) {
+	profiles := []string{DefaultProfile}
+	entries, err := os.ReadDir(ProfileDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return profiles, nil
+		}
+		return nil, e.New("read profile dir failed, ", err).WithPrefix(tagConfig)
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		for _, ext := range []string{".yml", ".yaml"} {
+			if strings.HasSuffix(name, ext) && strings.TrimSuffix(name, ext) != DefaultProfile {
+				names = append(names, strings.TrimSuffix(name, ext))
+			}
+		}
+	}
+	sort.Strings(names)
+	return append(profiles, names...), nil
+}
+
+// ActiveProfile get the active profile name, return empty if the default profile is active
+func ActiveProfile() string {
+	profileByte, err := os.ReadFile(path.Join(BaseRunDir, activeProfileFile))
+	if err != nil {
+		return ""
+	}
+	profile := strings.TrimSpace(string(profileByte))
+	if profile == DefaultProfile {
+		return ""
+	}
+	return profile
+}
+
+// SetActiveProfile record the active profile in base runDir
+func SetActiveProfile(name string) error {
+	activeProfilePath := path.Join(BaseRunDir, activeProfileFile)
+	if name == DefaultProfile {
+		if err := os.Remove(activeProfilePath); err != nil && !os.IsNotExist(err) {
+			return e.New("remove active profile failed, ", err).WithPrefix(tagConfig)
+		}
+		return nil
+	}
+	if err := os.WriteFile(activeProfilePath, []byte(name), 0644); err != nil {
+		return e.New("write active profile failed, ", err).WithPrefix(tagConfig)
+	}
+	return nil
+}
+
+// LoadProfile load the config file of profile, a profile is a complete xrayhelper config
+func LoadProfile(name string) error {
+	profilePath, err := ProfilePath(name)
+	if err != nil {
+		return err
+	}
+	if err := loadConfigFile(profilePath); err != nil {
+		return err
+	}
+	log.HandleDebug("config: loaded profile " + name + " from " + profilePath)
+	return nil
+}
@@ -0,0 +1,368 @@
+package builds
+
+import (
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const tagValidate = "validate"
+
+// configNode the yaml node tree of config file, used to locate line number of config key
+var configNode yaml.Node
+
+// ConfigProblem a problem found in the configuration
+type ConfigProblem struct {
+	Key     string
+	Line    int
+	Message string
+	Fatal   bool
+}
+
+func (this ConfigProblem) String() string {
+	builder := strings.Builder{}
+	if this.Line > 0 {
+		builder.WriteString("line " + strconv.Itoa(this.Line) + ", ")
+	}
+	if len(this.Key) > 0 {
+		builder.WriteString(this.Key + ": ")
+	}
+	builder.WriteString(this.Message)
+	return builder.String()
+}
+
+// configValidator collect the problems of configuration
+type configValidator struct {
+	problems []ConfigProblem
+}
+
+func (this *configValidator) fatal(message string, keys ...string) {
+	this.problems = append(this.problems, ConfigProblem{Key: configKey(keys...), Line: configLine(keys...), Message: message, Fatal: true})
+}
+
+func (this *configValidator) warn(message string, keys ...string) {
+	this.problems = append(this.problems, ConfigProblem{Key: configKey(keys...), Line: configLine(keys...), Message: message})
+}
+
+// enum check value is one of the available values
+func (this *configValidator) enum(value string, available []string, keys ...string) {
+	for _, v := range available {
+		if value == v {
+			return
+		}
+	}
+	this.fatal("invalid value "+strconv.Quote(value)+", available value ["+strings.Join(available, "|")+"]", keys...)
+}
+
+// port check value is a valid port number
+func (this *configValidator) port(value string, keys ...string) {
+	if port, err := strconv.Atoi(value); err != nil || port <= 0 || port > 65535 {
+		this.fatal("invalid port "+strconv.Quote(value), keys...)
+	}
+}
+
+// path check the path exists, and whether it should be a directory
+func (this *configValidator) path(value string, dir bool, fatal bool, keys ...string) os.FileInfo {
+	report := this.warn
+	if fatal {
+		report = this.fatal
+	}
+	if len(value) == 0 {
+		report("should not be empty", keys...)
+		return nil
+	}
+	info, err := os.Stat(value)
+	if err != nil {
+		report("cannot access "+value+", "+err.Error(), keys...)
+		return nil
+	}
+	if dir && !info.IsDir() {
+		report(value+" should be a directory", keys...)
+	}
+	return info
+}
+
+// configKey join keys to a readable config key, eg: proxy.pkgList[1]
+func configKey(keys ...string) string {
+	builder := strings.Builder{}
+	for _, key := range keys {
+		if _, err := strconv.Atoi(key); err == nil {
+			builder.WriteString("[" + key + "]")
+			continue
+		}
+		if builder.Len() > 0 {
+			builder.WriteByte('.')
+		}
+		builder.WriteString(key)
+	}
+	return builder.String()
+}
+
+// configLine find the line number of config key in config file, numeric key means sequence index
+func configLine(keys ...string) int {
+	node := &configNode
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	line := 0
+	for _, key := range keys {
+		found := false
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					line = node.Content[i].Line
+					node = node.Content[i+1]
+					found = true
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(node.Content) {
+				node = node.Content[index]
+				line = node.Line
+				found = true
+			}
+		}
+		if !found {
+			return line
+		}
+	}
+	return line
+}
+
+// ValidateConfig validate the loaded configuration, return all problems found
+func ValidateConfig() []ConfigProblem {
+	validator := new(configValidator)
+	validateUnknownFields(validator)
+	// xrayHelper
+	validator.enum(Config.XrayHelper.CoreType, []string{"xray", "v2ray", "sing-box", "clash.meta", "mihomo"}, "xrayHelper", "coreType")
+	if info := validator.path(Config.XrayHelper.CorePath, false, true, "xrayHelper", "corePath"); info != nil {
+		if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+			validator.fatal(Config.XrayHelper.CorePath+" is not executable", "xrayHelper", "corePath")
+		}
+	}
+	if info := validator.path(Config.XrayHelper.CoreConfig, false, true, "xrayHelper", "coreConfig"); info != nil {
+		switch Config.XrayHelper.CoreType {
+		case "clash.meta", "mihomo":
+			if !info.IsDir() {
+				validator.fatal("mihomo coreConfig should be a directory", "xrayHelper", "coreConfig")
+			}
+		}
+	}
+	validator.path(Config.XrayHelper.DataDir, true, false, "xrayHelper", "dataDir")
+	validator.path(Config.XrayHelper.RunDir, true, true, "xrayHelper", "runDir")
+	switch Config.XrayHelper.CoreType {
+	case "xray", "v2ray", "sing-box":
+		if len(Config.XrayHelper.ProxyTag) == 0 {
+			validator.warn("should not be empty, switch proxy node will not work", "xrayHelper", "proxyTag")
+		}
+	}
+	// proxy
+	validator.enum(Config.Proxy.Method, []string{"tproxy", "redirect", "tun", "tun2socks"}, "proxy", "method")
+	validator.enum(Config.Proxy.Firewall, []string{"iptables", "nftables", "auto"}, "proxy", "firewall")
+	validator.port(Config.Proxy.TproxyPort, "proxy", "tproxyPort")
+	validator.port(Config.Proxy.SocksPort, "proxy", "socksPort")
+	validator.port(Config.Proxy.RedirectPort, "proxy", "redirectPort")
+	if len(Config.Proxy.TunDevice) == 0 {
+		validator.fatal("should not be empty", "proxy", "tunDevice")
+	}
+	validator.enum(Config.Proxy.Mode, []string{"blacklist", "whitelist"}, "proxy", "mode")
+	for i, pkg := range Config.Proxy.PkgList {
+		validatePackage(validator, pkg, "proxy", "pkgList", strconv.Itoa(i))
+	}
+	for i, ap := range Config.Proxy.ApList {
+		if len(strings.TrimSpace(ap)) == 0 {
+			validator.fatal("interface name should not be empty", "proxy", "apList", strconv.Itoa(i))
+		}
+	}
+	validator.enum(Config.Proxy.ApClientMode, []string{"allow", "deny"}, "proxy", "apClientMode")
+	for i, client := range Config.Proxy.ApClients {
+		if _, err := ParseApClient(client); err != nil {
+			validator.fatal(strings.TrimPrefix(err.Error(), "["+tagApClient+"] "), "proxy", "apClients", strconv.Itoa(i))
+		}
+	}
+	if len(Config.Proxy.ApClients) > 0 && len(Config.Proxy.ApList) == 0 {
+		validator.warn("apList is empty, ap clients have no effect", "proxy", "apClients")
+	}
+	for i, ignore := range Config.Proxy.IgnoreList {
+		if len(strings.TrimSpace(ignore)) == 0 {
+			validator.fatal("interface name should not be empty", "proxy", "ignoreList", strconv.Itoa(i))
+		}
+	}
+	for i, intra := range Config.Proxy.IntraList {
+		if _, _, err := net.ParseCIDR(intra); err != nil {
+			validator.fatal("invalid CIDR "+strconv.Quote(intra), "proxy", "intraList", strconv.Itoa(i))
+		}
+	}
+	validateBypassLists(validator)
+	if (Config.Proxy.BlockQuic || len(Config.Proxy.BlockQuicList) > 0) && (Config.Proxy.Method == "tun" || Config.Proxy.Method == "redirect" && !Config.Proxy.RedirectUDP) {
+		validator.warn("udp traffic is not marked by "+Config.Proxy.Method+" method, quic is not blocked", "proxy", "blockQuic")
+	}
+	for i, pkg := range Config.Proxy.BlockQuicList {
+		validatePackage(validator, pkg, "proxy", "blockQuicList", strconv.Itoa(i))
+	}
+	validateAppGroups(validator)
+	for i, policy := range Config.Proxy.Policies {
+		if _, err := ParsePolicy(policy.When); err != nil {
+			validator.fatal(strings.TrimPrefix(err.Error(), "["+tagPolicy+"] "), "proxy", "policies", strconv.Itoa(i), "when")
+		}
+	}
+	// dns
+	validator.enum(Config.DNS.Hijack, []string{"auto", "tproxy", "redirect", "none"}, "dns", "hijack")
+	if len(Config.DNS.Port) > 0 {
+		validator.port(Config.DNS.Port, "dns", "port")
+	}
+	validator.enum(Config.DNS.DoT, []string{"none", "block", "redirect"}, "dns", "dot")
+	if Config.DNS.DoT == "redirect" {
+		if len(Config.DNS.DoTPort) == 0 {
+			validator.fatal("should not be empty when dot is redirect", "dns", "dotPort")
+		} else {
+			validator.port(Config.DNS.DoTPort, "dns", "dotPort")
+		}
+	}
+	if Config.Proxy.Method == "tun" && (Config.DNS.Hijack != "auto" || Config.DNS.DoT != "none") {
+		validator.warn("tun method has no proxy rules, dns is handled by core", "dns")
+	}
+	// clash
+	validator.port(Config.Clash.DNSPort, "clash", "dnsPort")
+	if len(Config.Clash.Template) > 0 {
+		validator.path(Config.Clash.Template, false, false, "clash", "template")
+	}
+	// log
+	if Config.Log.MaxSize < 0 {
+		validator.fatal("should not be negative", "log", "maxSize")
+	}
+	if Config.Log.Keep < 0 {
+		validator.fatal("should not be negative", "log", "keep")
+	}
+	return validator.problems
+}
+
+// validateUnknownFields report unknown config keys, they are usually typos
+func validateUnknownFields(validator *configValidator) {
+	configFile, err := os.ReadFile(loadedConfigPath)
+	if err != nil {
+		return
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(configFile))
+	decoder.KnownFields(true)
+	var config = Config
+	var typeError *yaml.TypeError
+	if err := decoder.Decode(&config); errors.As(err, &typeError) {
+		for _, message := range typeError.Errors {
+			// message format: line 7: field typoKey not found in type struct {...}
+			message, _, _ = strings.Cut(message, " in type ")
+			lineStr, detail, ok := strings.Cut(strings.TrimPrefix(message, "line "), ": ")
+			line, err := strconv.Atoi(lineStr)
+			if !ok || err != nil {
+				validator.warn(message)
+				continue
+			}
+			validator.problems = append(validator.problems, ConfigProblem{Line: line, Message: "unknown " + strings.TrimSuffix(detail, " not found")})
+		}
+	}
+}
+
+// validateBypassLists check the bypass list is a readable file or geoip:category
+func validateBypassLists(validator *configValidator) {
+	if len(Config.Proxy.BypassLists) > 0 && Config.Proxy.Method == "tun" {
+		validator.warn("bypass lists do not work with tun method, they are ignored", "proxy", "bypassLists")
+	} else if len(Config.Proxy.BypassLists) > 0 && Config.Proxy.Firewall != "nftables" {
+		// iptables matches bypass lists by ipset, nftables has its own sets
+		if _, err := exec.LookPath("ipset"); err != nil {
+			if Config.Proxy.Firewall == "iptables" {
+				validator.fatal("ipset not found, bypass lists need ipset with iptables firewall", "proxy", "bypassLists")
+			} else {
+				validator.warn("ipset not found, bypass lists only work when nftables is available", "proxy", "bypassLists")
+			}
+		}
+	}
+	for i, bypassList := range Config.Proxy.BypassLists {
+		index := strconv.Itoa(i)
+		if category, ok := strings.CutPrefix(bypassList, "geoip:"); ok {
+			if len(category) == 0 {
+				validator.fatal("geoip category should not be empty", "proxy", "bypassLists", index)
+			} else if _, err := os.Stat(path.Join(Config.XrayHelper.DataDir, "geoip.dat")); err != nil {
+				validator.warn("geoip.dat not found in dataDir, run update geodata first", "proxy", "bypassLists", index)
+			}
+			continue
+		}
+		validator.path(bypassList, false, false, "proxy", "bypassLists", index)
+	}
+}
+
+// validateAppGroups check app groups have unique name and mark, and the mark does not conflict with XrayHelper marks
+func validateAppGroups(validator *configValidator) {
+	if len(Config.Proxy.AppGroups) > 0 && Config.Proxy.Method != "tproxy" {
+		validator.warn("app groups only work with tproxy method, they are ignored", "proxy", "appGroups")
+	}
+	names := make(map[string]bool)
+	marks := map[string]string{common.TproxyMarkId: "tproxy", common.TunMarkId: "tun2socks", common.DummyMarkId: "dummy device"}
+	for i, group := range GetAppGroups() {
+		index := strconv.Itoa(i)
+		if len(group.Name) == 0 {
+			validator.fatal("should not be empty", "proxy", "appGroups", index, "name")
+		} else if names[group.Name] {
+			validator.fatal("duplicate app group name "+group.Name, "proxy", "appGroups", index, "name")
+		}
+		names[group.Name] = true
+		if len(Config.Proxy.AppGroups[i].TproxyPort) > 0 {
+			validator.port(group.TproxyPort, "proxy", "appGroups", index, "tproxyPort")
+		}
+		if mark, err := strconv.ParseUint(group.Mark, 10, 32); err != nil || mark == 0 {
+			validator.fatal("invalid mark "+strconv.Quote(group.Mark), "proxy", "appGroups", index, "mark")
+		} else if owner, ok := marks[group.Mark]; ok {
+			validator.fatal("mark "+group.Mark+" conflicts with "+owner, "proxy", "appGroups", index, "mark")
+		}
+		marks[group.Mark] = "app group " + group.Name
+		if len(group.PkgList) == 0 {
+			validator.warn("app group has no package", "proxy", "appGroups", index, "pkgList")
+		}
+		for j, pkg := range group.PkgList {
+			validatePackage(validator, pkg, "proxy", "appGroups", index, "pkgList", strconv.Itoa(j))
+		}
+	}
+}
+
+// validatePackage check the package entry format, and the package can be resolved through PackageMap
+func validatePackage(validator *configValidator, pkg string, keys ...string) {
+	entry, err := ParsePackageEntry(pkg)
+	if err != nil {
+		validator.fatal(strings.TrimPrefix(err.Error(), "["+tagPackage+"] "), keys...)
+		return
+	}
+	if len(PackageMap) > 0 && len(entry.Package) > 0 && len(MatchPackages(entry.Package)) == 0 {
+		if strings.Contains(entry.Package, "*") {
+			validator.warn("no installed package matches "+entry.Package, keys...)
+		} else {
+			validator.warn("package "+entry.Package+" is not installed", keys...)
+		}
+	}
+}
+
+// CheckConfig validate the loaded configuration, return error if there are fatal problems
+func CheckConfig() error {
+	fatalCount := 0
+	for _, problem := range ValidateConfig() {
+		if problem.Fatal {
+			fatalCount++
+			log.HandleError("config: " + problem.String())
+		} else {
+			log.HandleDebug("config: " + problem.String())
+		}
+	}
+	if fatalCount > 0 {
+		return e.New("found " + strconv.Itoa(fatalCount) + " fatal problems in config, please fix them first").WithPrefix(tagValidate)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package builds_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig write the base config with extra lines to a temporary directory and load it,
+// the base config takes line 1 to 6, so the extra lines start from line 7
+func loadTestConfig(t *testing.T, extra string) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "core"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dir, "config.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := strings.ReplaceAll(`xrayHelper:
+    coreType: xray
+    corePath: {dir}/core
+    coreConfig: {dir}/config.json
+    dataDir: {dir}
+    runDir: {dir}
+`, "{dir}", dir) + extra
+	configPath := path.Join(dir, "config.yml")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	builds.ConfigFilePath = &configPath
+	if err := builds.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	verbose := false
+	log.Verbose = &verbose
+	tests := []struct {
+		name     string
+		extra    string
+		problems []builds.ConfigProblem
+	}{
+		{name: "valid", extra: "proxy:\n    method: tun2socks\n    apList:\n        - wlan+\n"},
+		{name: "enum", extra: "proxy:\n    method: tproxy2\n", problems: []builds.ConfigProblem{
+			{Key: "proxy.method", Line: 8, Fatal: true},
+		}},
+		{name: "port", extra: "proxy:\n    tproxyPort: 70000\nclash:\n    dnsPort: dns\n", problems: []builds.ConfigProblem{
+			{Key: "proxy.tproxyPort", Line: 8, Fatal: true},
+			{Key: "clash.dnsPort", Line: 10, Fatal: true},
+		}},
+		{name: "unknown key", extra: "proxy:\n    metohd: tun\n", problems: []builds.ConfigProblem{
+			{Line: 8},
+		}},
+		{name: "sequence item", extra: "proxy:\n    intraList:\n        - 10.0.0.0/8\n        - intra\n", problems: []builds.ConfigProblem{
+			{Key: "proxy.intraList[1]", Line: 10, Fatal: true},
+		}},
+		{name: "warn", extra: "proxy:\n    apClients:\n        - 192.168.43.2\n", problems: []builds.ConfigProblem{
+			{Key: "proxy.apClients", Line: 8},
+		}},
+		{name: "missing key uses parent line", extra: "dns:\n    dot: redirect\n", problems: []builds.ConfigProblem{
+			{Key: "dns.dotPort", Line: 7, Fatal: true},
+		}},
+		{name: "negative", extra: "log:\n    maxSize: 1024\n    keep: -1\n", problems: []builds.ConfigProblem{
+			{Key: "log.keep", Line: 9, Fatal: true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loadTestConfig(t, test.extra)
+			problems := builds.ValidateConfig()
+			if len(problems) != len(test.problems) {
+				t.Fatalf("expected %d problems, got %v", len(test.problems), problems)
+			}
+			for i, problem := range problems {
+				expected := test.problems[i]
+				if problem.Key != expected.Key || problem.Line != expected.Line || problem.Fatal != expected.Fatal {
+					t.Errorf("expected %s at line %d (fatal %v), got %q (fatal %v)", expected.Key, expected.Line, expected.Fatal, problem.String(), problem.Fatal)
+				}
+			}
+			if err := builds.CheckConfig(); (err != nil) != (len(test.problems) > 0 && test.problems[0].Fatal) {
+				t.Errorf("CheckConfig returned %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateBypassListsWithoutIpset(t *testing.T) {
+	if _, err := exec.LookPath("ipset"); err == nil {
+		t.Skip("ipset is installed")
+	}
+	verbose := false
+	log.Verbose = &verbose
+	loadTestConfig(t, "proxy:\n    firewall: iptables\n    bypassLists:\n        - /\n")
+	problems := builds.ValidateConfig()
+	if len(problems) == 0 || problems[0].Key != "proxy.bypassLists" || problems[0].Line != 9 || !problems[0].Fatal {
+		t.Errorf("expect fatal problem of missing ipset at line 9, got %v", problems)
+	}
+	loadTestConfig(t, "proxy:\n    firewall: nftables\n    bypassLists:\n        - /\n")
+	for _, problem := range builds.ValidateConfig() {
+		if problem.Key == "proxy.bypassLists" {
+			t.Errorf("nftables firewall does not need ipset, got %s", problem.String())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"strconv"
+)
+
+const tagCheck = "check"
+
+type CheckCommand struct{}
+
+func (this *CheckCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return e.New("too many arguments").WithPrefix(tagCheck).WithPathObj(*this)
+	}
+	if err := builds.LoadConfig(); err != nil {
+		return err
+	}
+	if err := builds.LoadPackage(); err != nil {
+		log.HandleInfo("check: " + err.Error() + ", skip package check")
+	}
+	fatalCount := 0
+	problems := builds.ValidateConfig()
+	for _, problem := range problems {
+		if problem.Fatal {
+			fatalCount++
+			log.HandleError("check: " + problem.String())
+		} else {
+			log.HandleInfo("check: warning, " + problem.String())
+		}
+	}
+	if fatalCount > 0 {
+		return e.New("found " + strconv.Itoa(fatalCount) + " fatal problems and " + strconv.Itoa(len(problems)-fatalCount) + " warnings in " + builds.LoadedConfigPath()).WithPrefix(tagCheck)
+	}
+	log.HandleInfo("check: found " + strconv.Itoa(len(problems)) + " warnings, config is usable")
+	return nil
+}
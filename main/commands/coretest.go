@@ -0,0 +1,165 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	coreTestTimeout = 30 * time.Second
+	// coreTestOutputLines the max lines of core test output which will be shown
+	coreTestOutputLines = 20
+)
+
+// getCoreArgs get the arguments to run core, if test is true, get the arguments to test core config
+func getCoreArgs(test bool) ([]string, error) {
+	confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
+		return nil, e.New("open core config file failed, ", err).WithPrefix(tagService)
+	}
+	var args []string
+	switch builds.Config.XrayHelper.CoreType {
+	case "xray":
+		args = []string{"run"}
+		if test {
+			args = append(args, "-test")
+		}
+		if confInfo.IsDir() {
+			args = append(args, "-confdir", builds.Config.XrayHelper.CoreConfig)
+		} else {
+			args = append(args, "-c", builds.Config.XrayHelper.CoreConfig)
+		}
+	case "v2ray":
+		args = []string{"run"}
+		if test {
+			args = []string{"test"}
+		}
+		if confInfo.IsDir() {
+			args = append(args, "-confdir", builds.Config.XrayHelper.CoreConfig)
+		} else {
+			args = append(args, "-c", builds.Config.XrayHelper.CoreConfig)
+		}
+		args = append(args, "-format", "jsonv5")
+	case "sing-box":
+		args = []string{"run"}
+		if test {
+			args = []string{"check"}
+		}
+		if confInfo.IsDir() {
+			args = append(args, "-C", builds.Config.XrayHelper.CoreConfig)
+		} else {
+			args = append(args, "-c", builds.Config.XrayHelper.CoreConfig)
+		}
+		args = append(args, "-D", builds.Config.XrayHelper.DataDir, "--disable-color")
+	case "clash.meta", "mihomo":
+		if !confInfo.IsDir() {
+			return nil, e.New("mihomo CoreConfig should be a directory").WithPrefix(tagService)
+		}
+		if test {
+			args = append(args, "-t")
+		}
+		args = append(args, "-d", builds.Config.XrayHelper.CoreConfig)
+	default:
+		return nil, e.New("unsupported core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagService)
+	}
+	return args, nil
+}
+
+// prepareCoreConfig modify core config before core start, such as dns strategy and mihomo template
+func prepareCoreConfig() error {
+	switch builds.Config.XrayHelper.CoreType {
+	case "xray", "v2ray", "sing-box":
+		// if enable AutoDNSStrategy
+		if builds.Config.Proxy.AutoDNSStrategy {
+			if err := handleRayDNS(builds.Config.Proxy.EnableIPv6); err != nil {
+				return err
+			}
+		}
+	case "clash.meta", "mihomo":
+		if err := overrideClashConfig(builds.Config.Clash.Template, path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testCoreConfig test core config with the core binary corePath, the output of core is contained in the error if test failed
+func testCoreConfig(corePath string) error {
+	args, err := getCoreArgs(true)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	coreTest := common.NewExternal(coreTestTimeout, &out, &out, corePath, args...)
+	switch builds.Config.XrayHelper.CoreType {
+	case "xray", "v2ray", "sing-box":
+		coreTest.AppendEnv("XRAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
+		coreTest.AppendEnv("V2RAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
+	}
+	coreTest.Run()
+	if coreTest.Err() != nil {
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) > coreTestOutputLines {
+			lines = lines[len(lines)-coreTestOutputLines:]
+		}
+		return e.New("core config test failed, " + coreTest.Err().Error() + "\n" + strings.Join(lines, "\n")).WithPrefix(tagService)
+	}
+	log.HandleDebug("core config test passed")
+	return nil
+}
+
+// backupCoreConfig read the core config files which may be modified by switch or prepareCoreConfig
+func backupCoreConfig() (map[string][]byte, error) {
+	backup := make(map[string][]byte)
+	confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
+		return nil, e.New("open core config file failed, ", err).WithPrefix(tagService)
+	}
+	var confFiles []string
+	if !confInfo.IsDir() {
+		confFiles = append(confFiles, builds.Config.XrayHelper.CoreConfig)
+	} else {
+		switch builds.Config.XrayHelper.CoreType {
+		case "clash.meta", "mihomo":
+			confFiles = append(confFiles, path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml"))
+		default:
+			confDir, err := os.ReadDir(builds.Config.XrayHelper.CoreConfig)
+			if err != nil {
+				return nil, e.New("open config dir failed, ", err).WithPrefix(tagService)
+			}
+			for _, conf := range confDir {
+				if conf.Type().IsRegular() {
+					confFiles = append(confFiles, path.Join(builds.Config.XrayHelper.CoreConfig, conf.Name()))
+				}
+			}
+		}
+	}
+	for _, confFile := range confFiles {
+		confByte, err := os.ReadFile(confFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, e.New("backup core config "+confFile+" failed, ", err).WithPrefix(tagService)
+		}
+		backup[confFile] = confByte
+	}
+	return backup, nil
+}
+
+// restoreCoreConfig write back the core config files from backup
+func restoreCoreConfig(backup map[string][]byte) error {
+	for confFile, confByte := range backup {
+		if err := os.WriteFile(confFile, confByte, 0644); err != nil {
+			return e.New("restore core config "+confFile+" failed, ", err).WithPrefix(tagService)
+		}
+	}
+	return nil
+}
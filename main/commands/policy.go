@@ -0,0 +1,264 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tagPolicy = "policy"
+	// policyDebounce network changes usually come in bursts, wait for them to settle before evaluating policies
+	policyDebounce = 2 * time.Second
+	// routeProbeAddress the address used to find the interface of default route
+	routeProbeAddress = "1.1.1.1"
+)
+
+type PolicyCommand struct{}
+
+func (this *PolicyCommand) Execute(args []string) error {
+	if err := builds.LoadConfig(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return e.New("not specify operation, available operation [monitor|status]").WithPrefix(tagPolicy).WithPathObj(*this)
+	}
+	if len(args) > 1 {
+		return e.New("too many arguments").WithPrefix(tagPolicy).WithPathObj(*this)
+	}
+	switch args[0] {
+	case "monitor":
+		if err := builds.CheckConfig(); err != nil {
+			return err
+		}
+		if len(builds.Config.Proxy.Policies) == 0 {
+			return e.New("no policy configured in proxy.policies").WithPrefix(tagPolicy)
+		}
+		return monitorPolicy()
+	case "status":
+		return policyStatus()
+	default:
+		return e.New("unknown operation " + args[0] + ", available operation [monitor|status]").WithPrefix(tagPolicy).WithPathObj(*this)
+	}
+}
+
+// policyState the state of policy monitor, it is saved to policy.json after each transition
+type policyState struct {
+	// When the matched policy, empty if no policy matches
+	When string `json:"when"`
+	// Action the action of last transition, enable, disable or none
+	Action       string `json:"action"`
+	ProxyEnabled bool   `json:"proxyEnabled"`
+	Time         string `json:"time"`
+}
+
+// networkState the network state which policies are evaluated against
+type networkState struct {
+	UpInterfaces []string
+	RouteDevice  string
+}
+
+// getNetworkState get the interfaces which are up and running, and the interface of default route
+func getNetworkState() networkState {
+	var state networkState
+	if interfaces, err := net.Interfaces(); err == nil {
+		for _, iface := range interfaces {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagRunning != 0 {
+				state.UpInterfaces = append(state.UpInterfaces, iface.Name)
+			}
+		}
+	} else {
+		log.HandleDebug(err)
+	}
+	// android keeps default routes in per network tables, ask the kernel which interface it chooses
+	if device, err := common.GetRouteDevice(routeProbeAddress); err == nil {
+		state.RouteDevice = device
+	} else {
+		log.HandleDebug(err)
+	}
+	return state
+}
+
+// match whether the network state matches the policy condition
+func (this networkState) match(policy builds.Policy) bool {
+	if policy.Route {
+		return len(this.RouteDevice) > 0 && policy.MatchInterface(this.RouteDevice)
+	}
+	up := false
+	for _, name := range this.UpInterfaces {
+		if policy.MatchInterface(name) {
+			up = true
+			break
+		}
+	}
+	return up == policy.Up
+}
+
+// matchPolicy get the first policy which matches the network state
+func matchPolicy(state networkState) (builds.Policy, bool) {
+	for _, policy := range builds.GetPolicies() {
+		if state.match(policy) {
+			return policy, true
+		}
+	}
+	return builds.Policy{}, false
+}
+
+// applyPolicy evaluate policies, enable or disable proxy when the matched policy asks for a different state
+func applyPolicy(last policyState) policyState {
+	state := policyState{Action: "none", Time: time.Now().Format(time.DateTime)}
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		log.HandleError(err)
+		return last
+	}
+	state.ProxyEnabled = proxy.Enabled()
+	policy, matched := matchPolicy(getNetworkState())
+	if matched {
+		state.When = policy.When
+		if policy.Enable && !state.ProxyEnabled {
+			log.HandleInfo("policy: " + policy.When + ", enable proxy")
+			if err := enableProxy(proxy); err != nil {
+				log.HandleError(err)
+			} else {
+				state.Action = "enable"
+			}
+		} else if !policy.Enable && state.ProxyEnabled {
+			log.HandleInfo("policy: " + policy.When + ", disable proxy")
+			proxy.Disable()
+			state.Action = "disable"
+		}
+		state.ProxyEnabled = proxy.Enabled()
+	}
+	if state.When == last.When && state.Action == "none" {
+		// nothing changed, keep the time of last transition
+		state.Time = last.Time
+		return state
+	}
+	if !matched {
+		log.HandleInfo("policy: no policy matches, keep proxy " + map[bool]string{true: "enabled", false: "disabled"}[state.ProxyEnabled])
+	}
+	if stateByte, err := json.Marshal(state); err == nil {
+		if err := os.WriteFile(path.Join(builds.Config.XrayHelper.RunDir, "policy.json"), stateByte, 0644); err != nil {
+			log.HandleDebug(err)
+		}
+	}
+	return state
+}
+
+// monitorPolicy evaluate policies on every link, address and route change until receive SIGINT or SIGTERM
+func monitorPolicy() error {
+	monitor, err := common.NewNetlinkMonitor()
+	if err != nil {
+		return err
+	}
+	defer monitor.Close()
+	pidPath := path.Join(builds.Config.XrayHelper.RunDir, "policy.pid")
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return e.New("write policy monitor pid failed, ", err).WithPrefix(tagPolicy)
+	}
+	defer os.Remove(pidPath)
+	events := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			received, err := monitor.Read()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if received == nil {
+				// some events are lost, evaluate policies anyway
+				log.HandleDebug("policy: netlink socket buffer overrun")
+			}
+			events <- struct{}{}
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	log.HandleInfo("policy: monitoring network changes with " + strconv.Itoa(len(builds.GetPolicies())) + " policies")
+	state := applyPolicy(policyState{})
+	var debounce <-chan time.Time
+	rotateTicker := time.NewTicker(logRotateInterval)
+	defer rotateTicker.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			log.HandleInfo("policy: received " + sig.String() + ", exit")
+			return nil
+		case err := <-readErr:
+			return e.New("stop monitoring network changes, ", err).WithPrefix(tagPolicy)
+		case <-rotateTicker.C:
+			rotateOversizeLogs()
+		case <-events:
+			debounce = time.After(policyDebounce)
+		case <-debounce:
+			debounce = nil
+			state = applyPolicy(state)
+		}
+	}
+}
+
+// getPolicyMonitorPid get the pid of policy monitor, return 0 if it is not running
+func getPolicyMonitorPid() int {
+	pid, err := common.ReadPidFile(path.Join(builds.Config.XrayHelper.RunDir, "policy.pid"))
+	if err != nil {
+		log.HandleDebug(err)
+		return 0
+	}
+	self, err := os.Executable()
+	if err != nil || !common.CheckProcess(pid, self) {
+		return 0
+	}
+	return pid
+}
+
+// policyStatus print the network state, whether each policy matches, and the last transition of policy monitor
+func policyStatus() error {
+	if pid := getPolicyMonitorPid(); pid > 0 {
+		fmt.Println("monitor: running, pid " + strconv.Itoa(pid))
+	} else {
+		fmt.Println("monitor: stopped")
+	}
+	network := getNetworkState()
+	fmt.Println("up interfaces: " + strings.Join(network.UpInterfaces, ", "))
+	fmt.Println("default route: " + network.RouteDevice)
+	matched := false
+	for i, policy := range builds.Config.Proxy.Policies {
+		parsed, err := builds.ParsePolicy(policy.When)
+		switch {
+		case err != nil:
+			fmt.Println("policy " + strconv.Itoa(i) + ": " + policy.When + " [invalid]")
+		case !matched && network.match(parsed):
+			matched = true
+			fmt.Println("policy " + strconv.Itoa(i) + ": " + policy.When + " [active]")
+		case network.match(parsed):
+			fmt.Println("policy " + strconv.Itoa(i) + ": " + policy.When + " [matched, shadowed]")
+		default:
+			fmt.Println("policy " + strconv.Itoa(i) + ": " + policy.When)
+		}
+	}
+	if stateByte, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "policy.json")); err == nil {
+		var state policyState
+		if err := json.Unmarshal(stateByte, &state); err == nil {
+			fmt.Println("last transition: " + state.Time + ", action " + state.Action + ", policy " + strconv.Quote(state.When))
+		}
+	}
+	if proxy, err := proxies.NewProxy(builds.Config.Proxy.Method); err == nil {
+		fmt.Println("proxy: " + builds.Config.Proxy.Method + ", enabled " + strconv.FormatBool(proxy.Enabled()))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"fmt"
+)
+
+const tagProfile = "profile"
+
+type ProfileCommand struct{}
+
+func (this *ProfileCommand) Execute(args []string) error {
+	if err := builds.LoadConfig(); err != nil {
+		// the active profile may be broken, still allow to list or switch profile
+		if len(builds.BaseRunDir) == 0 {
+			return err
+		}
+		log.HandleError(err)
+	}
+	if len(args) == 0 {
+		return e.New("not specify operation, available operation [list|use|current]").WithPrefix(tagProfile).WithPathObj(*this)
+	}
+	switch args[0] {
+	case "list":
+		if len(args) > 1 {
+			return e.New("too many arguments").WithPrefix(tagProfile).WithPathObj(*this)
+		}
+		profiles, err := builds.ListProfiles()
+		if err != nil {
+			return err
+		}
+		current := currentProfile()
+		for _, profile := range profiles {
+			if profile == current {
+				fmt.Println("* " + profile)
+			} else {
+				fmt.Println("  " + profile)
+			}
+		}
+	case "current":
+		if len(args) > 1 {
+			return e.New("too many arguments").WithPrefix(tagProfile).WithPathObj(*this)
+		}
+		fmt.Println(currentProfile())
+	case "use":
+		if len(args) != 2 {
+			return e.New("should specify one profile name").WithPrefix(tagProfile).WithPathObj(*this)
+		}
+		return useProfile(args[1])
+	default:
+		return e.New("unknown operation " + args[0] + ", available operation [list|use|current]").WithPrefix(tagProfile).WithPathObj(*this)
+	}
+	return nil
+}
+
+// currentProfile get the name of active profile
+func currentProfile() string {
+	if profile := builds.ActiveProfile(); len(profile) > 0 {
+		return profile
+	}
+	return builds.DefaultProfile
+}
+
+// useProfile stop core and disable proxy under the old profile, then start core and enable proxy under the new one
+func useProfile(name string) error {
+	oldProfile := currentProfile()
+	if name == oldProfile {
+		log.HandleInfo("profile: profile " + name + " is already active")
+		return nil
+	}
+	// make sure the new profile is usable before tear down the old one
+	if err := builds.LoadProfile(name); err != nil {
+		return err
+	}
+	if err := builds.CheckConfig(); err != nil {
+		return e.New("profile "+name+" has problems, ", err).WithPrefix(tagProfile)
+	}
+	if err := builds.LoadProfile(oldProfile); err != nil {
+		log.HandleError(err)
+	} else {
+		superviseFlag := len(getSupervisorPid()) > 0
+		stopProfile(oldProfile)
+		if err := builds.SetActiveProfile(name); err != nil {
+			return err
+		}
+		if err := startProfile(name, superviseFlag); err != nil {
+			log.HandleError(err)
+			log.HandleInfo("profile: rollback to profile " + oldProfile)
+			stopProfile(name)
+			if err := builds.SetActiveProfile(oldProfile); err != nil {
+				return err
+			}
+			if err := startProfile(oldProfile, superviseFlag); err != nil {
+				log.HandleError(err)
+			}
+			return e.New("use profile " + name + " failed").WithPrefix(tagProfile)
+		}
+		log.HandleInfo("profile: profile " + name + " is active")
+		return nil
+	}
+	// the old profile is broken, nothing can be stopped
+	if err := builds.SetActiveProfile(name); err != nil {
+		return err
+	}
+	if err := startProfile(name, false); err != nil {
+		return err
+	}
+	log.HandleInfo("profile: profile " + name + " is active")
+	return nil
+}
+
+// stopProfile disable proxy and stop core under the loaded profile
+func stopProfile(name string) {
+	log.HandleInfo("profile: disable proxy and stop core of profile " + name)
+	if proxy, err := proxies.NewProxy(builds.Config.Proxy.Method); err != nil {
+		log.HandleError(err)
+	} else {
+		if err := builds.LoadPackage(); err != nil {
+			log.HandleDebug(err)
+		}
+		proxy.Disable()
+	}
+	stopService()
+}
+
+// startProfile load the profile, then start core and enable proxy under it
+func startProfile(name string, superviseFlag bool) error {
+	if err := builds.LoadProfile(name); err != nil {
+		return err
+	}
+	log.HandleInfo("profile: start core and enable proxy of profile " + name + ", core type is " + builds.Config.XrayHelper.CoreType + ", proxy method is " + builds.Config.Proxy.Method)
+	if superviseFlag {
+		if err := startSupervisor(); err != nil {
+			return err
+		}
+	} else {
+		if err := startService(); err != nil {
+			return err
+		}
+	}
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		return err
+	}
+	return enableProxy(proxy)
+}
@@ -2,29 +2,54 @@ package commands
 
 import (
 	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
 	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/tools"
+	"fmt"
+	"strconv"
+	"strings"
 )
 
 const tagProxy = "proxy"
 
-type ProxyCommand struct{}
+type ProxyCommand struct {
+	Force  bool `long:"force" description:"remove every XrayHelper rule, chain, route and device in proxy cleanup"`
+	Legacy bool `long:"legacy" description:"also find the un-prefixed chains and untagged dns rules of old XrayHelper versions in proxy cleanup, other proxy modules may use the same names"`
+}
 
 func (this *ProxyCommand) Execute(args []string) error {
 	if err := builds.LoadConfig(); err != nil {
 		return err
 	}
-	if err := builds.LoadPackage(); err != nil {
-		return err
-	}
 	if len(args) == 0 {
-		return e.New("not specify operation, available operation [enable|disable|refresh]").WithPrefix(tagProxy).WithPathObj(*this)
+		return e.New("not specify operation, available operation [enable|disable|refresh|status|repair|clients|cleanup]").WithPrefix(tagProxy).WithPathObj(*this)
 	}
 	if len(args) > 1 {
 		return e.New("too many arguments").WithPrefix(tagService).WithPathObj(*this)
 	}
-	log.HandleInfo("proxy: current proxy method is " + builds.Config.Proxy.Method)
+	// clients and cleanup do not depend on package list
+	switch args[0] {
+	case "clients":
+		return proxyClients()
+	case "cleanup":
+		return proxyCleanup(this.Force, this.Legacy)
+	}
+	if err := builds.LoadPackage(); err != nil {
+		return err
+	}
+	switch args[0] {
+	case "enable", "refresh", "repair":
+		if err := builds.CheckConfig(); err != nil {
+			return err
+		}
+		// the core log is also checked here, in case no long-running command is checking it
+		rotateOversizeLogs()
+	}
+	if args[0] != "status" {
+		log.HandleInfo("proxy: current proxy method is " + builds.Config.Proxy.Method)
+	}
 	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
 	if err != nil {
 		return err
@@ -44,8 +69,135 @@ func (this *ProxyCommand) Execute(args []string) error {
 		if err := proxy.Enable(); err != nil {
 			return err
 		}
+	case "status":
+		return proxyStatus(proxy)
+	case "repair":
+		return proxyRepair(proxy)
 	default:
-		return e.New("unknown operation " + args[0] + ", available operation [enable|disable|refresh]").WithPrefix(tagProxy).WithPathObj(*this)
+		return e.New("unknown operation " + args[0] + ", available operation [enable|disable|refresh|status|repair|clients|cleanup]").WithPrefix(tagProxy).WithPathObj(*this)
+	}
+	return nil
+}
+
+// checkProxyDrift compare the rules and routes which current config would produce with the live ones
+func checkProxyDrift(proxy proxies.ProxyMethod) (tools.Ruleset, tools.Drift, error) {
+	ruleset, err := proxy.Ruleset()
+	if err != nil {
+		return nil, tools.Drift{}, err
+	}
+	drift, err := tools.CheckDrift(ruleset, proxy.Routes())
+	return ruleset, drift, err
+}
+
+// proxyStatus print the missing and extra rules, return error if rules drift
+func proxyStatus(proxy proxies.ProxyMethod) error {
+	ruleset, drift, err := checkProxyDrift(proxy)
+	if err != nil {
+		return err
+	}
+	firewall := "iptables"
+	if tools.UseNftables() {
+		firewall = "nftables"
+	}
+	fmt.Println("method: " + builds.Config.Proxy.Method + ", firewall: " + firewall + ", expected rules: " + strconv.Itoa(len(ruleset)) + ", expected routes: " + strconv.Itoa(len(proxy.Routes())))
+	for _, rule := range drift.MissingRules {
+		fmt.Println("missing rule: " + rule.Key())
+	}
+	for _, rule := range drift.ExtraRules {
+		fmt.Println("extra rule: " + rule.Key())
+	}
+	for _, route := range drift.MissingRoutes {
+		fmt.Println("missing route: " + route.String())
+	}
+	for _, route := range drift.ExtraRoutes {
+		fmt.Println("extra route: " + route.String())
+	}
+	if !drift.Empty() {
+		return e.New("proxy rules drift, " + strconv.Itoa(len(drift.MissingRules)) + " rules missing, " + strconv.Itoa(len(drift.ExtraRules)) + " rules extra, " + strconv.Itoa(len(drift.MissingRoutes)) + " routes missing, " + strconv.Itoa(len(drift.ExtraRoutes)) + " routes extra, run proxy repair to fix them").WithPrefix(tagProxy)
+	}
+	fmt.Println("all rules and routes are in place")
+	return nil
+}
+
+// proxyRepair reapply only the missing rules and routes, and delete the extra rules in XrayHelper chains and the extra routes in XrayHelper tables
+func proxyRepair(proxy proxies.ProxyMethod) error {
+	ruleset, drift, err := checkProxyDrift(proxy)
+	if err != nil {
+		return err
+	}
+	if drift.Empty() {
+		log.HandleInfo("proxy: all rules and routes are in place, nothing to repair")
+		return nil
+	}
+	log.HandleInfo("proxy: repairing " + strconv.Itoa(len(drift.MissingRules)) + " missing rules, " + strconv.Itoa(len(drift.ExtraRules)) + " extra rules, " + strconv.Itoa(len(drift.MissingRoutes)) + " missing routes and " + strconv.Itoa(len(drift.ExtraRoutes)) + " extra routes")
+	if err := tools.RepairDrift(ruleset, drift); err != nil {
+		return err
+	}
+	if _, drift, err := checkProxyDrift(proxy); err != nil {
+		return err
+	} else if !drift.Empty() {
+		return e.New("proxy rules still drift after repair, please run proxy refresh").WithPrefix(tagProxy)
+	}
+	log.HandleInfo("proxy: repair success")
+	return nil
+}
+
+// proxyClients print the clients connected to ap interfaces from the neighbor table, and whether their traffic is proxied
+func proxyClients() error {
+	if len(builds.Config.Proxy.ApList) == 0 {
+		return e.New("apList is empty, no ap interface to list").WithPrefix(tagProxy)
+	}
+	neighbors, err := common.ListNeighbors()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, neighbor := range neighbors {
+		for _, ap := range builds.Config.Proxy.ApList {
+			if !builds.MatchInterface(ap, neighbor.Dev) {
+				continue
+			}
+			status := "proxied"
+			if !builds.ApClientProxied(neighbor.IP, neighbor.MAC) {
+				status = "bypassed"
+			} else if strings.Contains(neighbor.IP, ":") && !builds.Config.Proxy.EnableIPv6 {
+				status = "bypassed, ipv6 disabled"
+			}
+			fmt.Println(neighbor.Dev + " " + neighbor.IP + " " + neighbor.MAC + " " + neighbor.State + " [" + status + "]")
+			count++
+			break
+		}
+	}
+	fmt.Println(strconv.Itoa(count) + " clients on " + strings.Join(builds.Config.Proxy.ApList, ", "))
+	return nil
+}
+
+// proxyCleanup list every XrayHelper artifact whatever config creates it, remove them only if force is set,
+// the artifacts of old versions are included only if legacy is set
+func proxyCleanup(force bool, legacy bool) error {
+	artifacts := tools.ScanArtifacts(legacy)
+	if len(artifacts) == 0 {
+		log.HandleInfo("proxy: no XrayHelper rule, chain, route or device is found")
+		return nil
+	}
+	if !force {
+		for _, artifact := range artifacts {
+			fmt.Println(artifact.Desc)
+		}
+		return e.New("found " + strconv.Itoa(len(artifacts)) + " XrayHelper artifacts, add --force to remove them").WithPrefix(tagProxy)
+	}
+	failed := 0
+	for _, artifact := range artifacts {
+		if err := artifact.Remove(); err != nil {
+			log.HandleError("proxy: remove " + artifact.Desc + " failed, " + err.Error())
+			failed++
+			continue
+		}
+		log.HandleDebug("proxy: removed " + artifact.Desc)
+	}
+	if failed > 0 {
+		return e.New(strconv.Itoa(failed) + " of " + strconv.Itoa(len(artifacts)) + " XrayHelper artifacts cannot be removed").WithPrefix(tagProxy)
 	}
+	log.HandleInfo("proxy: removed " + strconv.Itoa(len(artifacts)) + " XrayHelper artifacts")
 	return nil
 }
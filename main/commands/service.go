@@ -8,6 +8,7 @@ import (
 	"XrayHelper/main/serial"
 	"encoding/json"
 	"gopkg.in/yaml.v3"
+	"io"
 	"os"
 	"path"
 	"strconv"
@@ -17,21 +18,35 @@ import (
 
 const tagService = "service"
 
+// logRotateInterval the interval of checking the log size in long-running commands
+const logRotateInterval = 1 * time.Minute
+
 var service common.External
+var serviceLog io.WriteCloser
 
-type ServiceCommand struct{}
+type ServiceCommand struct {
+	Json bool `long:"json" description:"print service status in json format"`
+}
 
 func (this *ServiceCommand) Execute(args []string) error {
 	if err := builds.LoadConfig(); err != nil {
 		return err
 	}
 	if len(args) == 0 {
-		return e.New("not specify operation, available operation [start|stop|restart|status]").WithPrefix(tagService).WithPathObj(*this)
+		return e.New("not specify operation, available operation [start|stop|restart|status|supervise]").WithPrefix(tagService).WithPathObj(*this)
 	}
 	if len(args) > 1 {
 		return e.New("too many arguments").WithPrefix(tagService).WithPathObj(*this)
 	}
-	log.HandleInfo("service: current core type is " + builds.Config.XrayHelper.CoreType)
+	switch args[0] {
+	case "start", "restart", "supervise":
+		if err := builds.CheckConfig(); err != nil {
+			return err
+		}
+	}
+	if args[0] != "status" {
+		log.HandleInfo("service: current core type is " + builds.Config.XrayHelper.CoreType)
+	}
 	switch args[0] {
 	case "start":
 		log.HandleInfo("service: starting core")
@@ -45,20 +60,22 @@ func (this *ServiceCommand) Execute(args []string) error {
 		log.HandleInfo("service: core is stopped")
 	case "restart":
 		log.HandleInfo("service: restarting core")
-		stopService()
-		if err := startService(); err != nil {
+		if err := restartService(); err != nil {
 			return err
 		}
 		log.HandleInfo("service: core is running, pid is " + getServicePid())
 	case "status":
-		pidStr := getServicePid()
-		if len(pidStr) > 0 {
-			log.HandleInfo("service: core is running, pid is " + pidStr)
-		} else {
-			log.HandleInfo("service: core is stopped")
+		if err := printServiceStatus(this.Json); err != nil {
+			return err
 		}
+	case "supervise":
+		log.HandleInfo("service: supervising core")
+		if err := superviseService(); err != nil {
+			return err
+		}
+		log.HandleInfo("service: supervisor exited")
 	default:
-		return e.New("unknown operation " + args[0] + ", available operation [start|stop|restart|status]").WithPrefix(tagService).WithPathObj(*this)
+		return e.New("unknown operation " + args[0] + ", available operation [start|stop|restart|status|supervise]").WithPrefix(tagService).WithPathObj(*this)
 	}
 	return nil
 }
@@ -70,55 +87,31 @@ func startService() error {
 	if len(servicePid) > 0 {
 		return e.New("core is running, pid is " + servicePid).WithPrefix(tagService)
 	}
-	serviceLogFile, err := os.OpenFile(path.Join(builds.Config.XrayHelper.RunDir, "error.log"), os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0644)
+	serviceLogFile, err := openServiceLog()
 	if err != nil {
-		return e.New("open core log file failed, ", err).WithPrefix(tagService)
+		return err
 	}
-	if confInfo, err := os.Stat(builds.Config.XrayHelper.CoreConfig); err != nil {
-		return e.New("open core config file failed, ", err).WithPrefix(tagService)
-	} else {
-		if confInfo.IsDir() {
-			switch builds.Config.XrayHelper.CoreType {
-			case "xray":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-confdir", builds.Config.XrayHelper.CoreConfig)
-			case "v2ray":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-confdir", builds.Config.XrayHelper.CoreConfig, "-format", "jsonv5")
-			case "sing-box":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-C", builds.Config.XrayHelper.CoreConfig, "-D", builds.Config.XrayHelper.DataDir, "--disable-color")
-			case "clash.meta", "mihomo":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "-d", builds.Config.XrayHelper.CoreConfig)
-			default:
-				return e.New("unsupported core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagService)
-			}
-		} else {
-			switch builds.Config.XrayHelper.CoreType {
-			case "xray":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig)
-			case "v2ray":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig, "-format", "jsonv5")
-			case "sing-box":
-				service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, "run", "-c", builds.Config.XrayHelper.CoreConfig, "-D", builds.Config.XrayHelper.DataDir, "--disable-color")
-			case "clash.meta", "mihomo":
-				return e.New("mihomo CoreConfig should be a directory").WithPrefix(tagService)
-			default:
-				return e.New("unsupported core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagService)
-			}
-		}
+	rotateOversizeLogs()
+	coreArgs, err := getCoreArgs(false)
+	if err != nil {
+		return err
 	}
+	service = common.NewExternal(0, serviceLogFile, serviceLogFile, builds.Config.XrayHelper.CorePath, coreArgs...)
 	switch builds.Config.XrayHelper.CoreType {
 	case "xray", "v2ray", "sing-box":
 		service.AppendEnv("XRAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
 		service.AppendEnv("V2RAY_LOCATION_ASSET=" + builds.Config.XrayHelper.DataDir)
-		// if enable AutoDNSStrategy
-		if builds.Config.Proxy.AutoDNSStrategy {
-			if err := handleRayDNS(builds.Config.Proxy.EnableIPv6); err != nil {
-				return err
-			}
-		}
-	case "clash.meta", "mihomo":
-		if err := overrideClashConfig(builds.Config.Clash.Template, path.Join(builds.Config.XrayHelper.CoreConfig, "config.yaml")); err != nil {
-			return err
-		}
+	}
+	if err := prepareCoreConfig(); err != nil {
+		return err
+	}
+	if err := testCoreConfig(builds.Config.XrayHelper.CorePath); err != nil {
+		return err
+	}
+	switch builds.Config.Proxy.Method {
+	case "tproxy", "redirect", "tun", "tun2socks":
+	default:
+		return e.New("unsupported proxy method " + builds.Config.Proxy.Method).WithPrefix(tagService)
 	}
 	if err := service.SetUidGid("0", common.CoreGid); err != nil {
 		return err
@@ -129,23 +122,9 @@ func startService() error {
 	}
 	for i := 0; i < *builds.CoreStartTimeout; i++ {
 		time.Sleep(1 * time.Second)
-		if builds.Config.Proxy.Method == "tproxy" {
-			if common.CheckLocalPort(builds.Config.Proxy.TproxyPort) {
-				listenFlag = true
-				break
-			}
-		} else if builds.Config.Proxy.Method == "tun" {
-			// tun don't need check any local port
+		if checkServiceListen(service.Pid()) {
 			listenFlag = true
 			break
-		} else if builds.Config.Proxy.Method == "tun2socks" {
-			if common.CheckLocalPort(builds.Config.Proxy.SocksPort) {
-				listenFlag = true
-				break
-			}
-		} else {
-			listenFlag = false
-			break
 		}
 	}
 	if listenFlag {
@@ -160,37 +139,117 @@ func startService() error {
 	return nil
 }
 
-// stopService stop core service
-func stopService() {
-	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "core.pid")); err == nil {
-		pidFile, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
+// openServiceLog open core log file, the log of previous run will be rotated, and the log size is limited when core is supervised
+func openServiceLog() (io.WriteCloser, error) {
+	if serviceLog != nil {
+		_ = serviceLog.Close()
+		serviceLog = nil
+	}
+	logPath := path.Join(builds.Config.XrayHelper.RunDir, "error.log")
+	if supervised {
+		writer, err := log.NewRotateWriter(logPath, builds.LogMaxSize(), builds.Config.Log.Keep, true)
 		if err != nil {
-			log.HandleDebug(err)
+			return nil, err
 		}
-		pid, _ := strconv.Atoi(string(pidFile))
-		if serviceProcess, err := os.FindProcess(pid); err == nil {
-			_ = serviceProcess.Kill()
-			_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
-		} else {
+		serviceLog = writer
+		return serviceLog, nil
+	}
+	// core outlives xrayhelper without supervisor, its log is rotated when it starts, and by rotateOversizeLogs when it grows
+	if err := log.Rotate(logPath, builds.Config.Log.Keep); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, e.New("open core log file failed, ", err).WithPrefix(tagService)
+	}
+	serviceLog = file
+	return serviceLog, nil
+}
+
+// rotateOversizeLogs rotate the logs which core and tun2socks write directly once they exceed log.maxSize,
+// it is called periodically by long-running commands, and when core starts or proxy rules are applied,
+// so without a long-running command the logs only shrink on those commands, the core log written by supervisor rotates itself
+func rotateOversizeLogs() {
+	logPaths := []string{path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.log")}
+	if serviceLog == nil && len(getSupervisorPid()) == 0 {
+		logPaths = append(logPaths, path.Join(builds.Config.XrayHelper.RunDir, "error.log"))
+	}
+	for _, logPath := range logPaths {
+		if err := log.RotateOversize(logPath, builds.LogMaxSize(), builds.Config.Log.Keep); err != nil {
 			log.HandleDebug(err)
 		}
-	} else {
-		log.HandleDebug(err)
 	}
 }
 
-// getServicePid get core pid from pid file
-func getServicePid() string {
-	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "core.pid")); err == nil {
-		pidFile, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
-		if err != nil {
-			log.HandleDebug(err)
+// checkServiceListen check whether core listen the ports which current proxy method and core type need
+func checkServiceListen(pid int) bool {
+	switch builds.Config.Proxy.Method {
+	case "tproxy":
+		if !common.CheckLocalPort("tcp", builds.Config.Proxy.TproxyPort, pid) {
+			return false
+		}
+	case "redirect":
+		if !common.CheckLocalPort("tcp", builds.Config.Proxy.RedirectPort, pid) {
+			return false
+		}
+		if builds.Config.Proxy.RedirectUDP && !common.CheckLocalPort("tcp", builds.Config.Proxy.SocksPort, pid) {
+			return false
+		}
+	case "tun2socks":
+		if !common.CheckLocalPort("tcp", builds.Config.Proxy.SocksPort, pid) {
+			return false
+		}
+	}
+	// core need listen dns port if dns request is redirected to it
+	if builds.GetDNSHijack() == "redirect" && !common.CheckLocalPort("udp", builds.GetDNSPort(), pid) {
+		return false
+	}
+	if builds.Config.DNS.DoT == "redirect" && !common.CheckLocalPort("tcp", builds.Config.DNS.DoTPort, pid) {
+		return false
+	}
+	return true
+}
+
+// stopService stop core service, also stop the supervisor if it is running
+func stopService() {
+	stopSupervisor()
+	pidPath := path.Join(builds.Config.XrayHelper.RunDir, "core.pid")
+	pid, err := common.ReadPidFile(pidPath)
+	if err != nil {
+		log.HandleDebug(err)
+		return
+	}
+	if common.CheckProcess(pid, builds.Config.XrayHelper.CorePath) {
+		if err := common.StopProcess(pid, time.Duration(*builds.StopTimeout)*time.Second); err != nil {
+			log.HandleError(err)
+			return
 		}
-		return string(pidFile)
 	} else {
+		log.HandleInfo("service: core.pid is stale, pid " + strconv.Itoa(pid) + " does not belong to core, remove it")
+	}
+	_ = os.Remove(pidPath)
+}
+
+// getServicePid get core pid from pid file, return empty if the pid does not belong to core
+func getServicePid() string {
+	pid, err := common.ReadPidFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
+	if err != nil {
 		log.HandleDebug(err)
+		return ""
+	}
+	if !common.CheckProcess(pid, builds.Config.XrayHelper.CorePath) {
+		log.HandleDebug("core.pid is stale, pid " + strconv.Itoa(pid) + " does not belong to core")
+		return ""
 	}
-	return ""
+	return strconv.Itoa(pid)
+}
+
+// isServicePidStale check whether core pid file exists but the pid does not belong to core
+func isServicePidStale() bool {
+	if _, err := common.ReadPidFile(path.Join(builds.Config.XrayHelper.RunDir, "core.pid")); err != nil {
+		return false
+	}
+	return len(getServicePid()) == 0
 }
 
 func handleRayDNS(ipv6 bool) error {
@@ -259,10 +318,26 @@ func replaceRayDNSStrategy(conf []byte, ipv6 bool) (replacedConf []byte, err err
 			dnsMap.Set("queryStrategy", "UseIPv4")
 		}
 	case "v2ray":
+		queryStrategy := "USE_IP4"
 		if ipv6 {
-			dnsMap.Set("queryStrategy", "USE_IP")
-		} else {
-			dnsMap.Set("queryStrategy", "USE_IP4")
+			queryStrategy = "USE_IP"
+		}
+		dnsMap.Set("queryStrategy", queryStrategy)
+		// v5 name server can override the global query strategy
+		if nameServer, ok := dnsMap.Get("nameServer"); ok {
+			if nameServerArray, ok := nameServer.Value.(serial.OrderedArray); ok {
+				for i, server := range nameServerArray {
+					serverMap, ok := server.(serial.OrderedMap)
+					if !ok {
+						continue
+					}
+					if _, ok := serverMap.Get("queryStrategy"); ok {
+						serverMap.Set("queryStrategy", queryStrategy)
+						nameServerArray[i] = serverMap
+					}
+				}
+				dnsMap.Set("nameServer", nameServerArray)
+			}
 		}
 	case "sing-box":
 		if ipv6 {
@@ -331,7 +406,7 @@ func overrideClashConfig(template string, target string) error {
 			// assert dns
 			dnsMap, ok := dns.Value.(serial.OrderedMap)
 			if ok {
-				dnsMap.Set("listen", "127.0.0.1:"+builds.Config.Clash.DNSPort)
+				dnsMap.Set("listen", "127.0.0.1:"+builds.GetDNSPort())
 			}
 			templateYamlMap.Set("dns", dnsMap)
 		}
@@ -0,0 +1,195 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/tun"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type portStatus struct {
+	Name      string `json:"name"`
+	Protocol  string `json:"protocol"`
+	Port      string `json:"port"`
+	Listening bool   `json:"listening"`
+}
+
+type serviceStatus struct {
+	CoreType      string       `json:"coreType"`
+	CoreVersion   string       `json:"coreVersion,omitempty"`
+	Running       bool         `json:"running"`
+	Pid           int          `json:"pid,omitempty"`
+	PidStale      bool         `json:"pidStale"`
+	SupervisorPid int          `json:"supervisorPid,omitempty"`
+	Uptime        int64        `json:"uptime"`
+	CpuTime       float64      `json:"cpuTime"`
+	Rss           uint64       `json:"rss"`
+	Vms           uint64       `json:"vms"`
+	Threads       int          `json:"threads"`
+	Fds           int          `json:"fds"`
+	Ports         []portStatus `json:"ports"`
+	ProxyMethod   string       `json:"proxyMethod"`
+	ProxyEnabled  bool         `json:"proxyEnabled"`
+	Tun2socksPid  int          `json:"tun2socksPid,omitempty"`
+}
+
+// getServiceStatus collect core service status
+func getServiceStatus() *serviceStatus {
+	status := &serviceStatus{
+		CoreType:    builds.Config.XrayHelper.CoreType,
+		CoreVersion: getCoreVersion(),
+		ProxyMethod: builds.Config.Proxy.Method,
+	}
+	if pidStr := getServicePid(); len(pidStr) > 0 {
+		status.Running = true
+		status.Pid, _ = strconv.Atoi(pidStr)
+		if stat, err := common.GetProcessStat(status.Pid); err == nil {
+			status.Uptime = int64(stat.Uptime.Seconds())
+			status.CpuTime = stat.CpuTime.Seconds()
+			status.Rss = stat.Rss
+			status.Vms = stat.Vms
+			status.Threads = stat.Threads
+			status.Fds = stat.Fds
+		} else {
+			log.HandleDebug(err)
+		}
+	} else {
+		status.PidStale = isServicePidStale()
+	}
+	if supervisorPid := getSupervisorPid(); len(supervisorPid) > 0 {
+		status.SupervisorPid, _ = strconv.Atoi(supervisorPid)
+	}
+	status.Ports = servicePorts()
+	for i := range status.Ports {
+		if status.Running {
+			status.Ports[i].Listening = common.CheckLocalPort(status.Ports[i].Protocol, status.Ports[i].Port, status.Pid)
+		}
+	}
+	if proxy, err := proxies.NewProxy(builds.Config.Proxy.Method); err == nil {
+		status.ProxyEnabled = proxy.Enabled()
+	} else {
+		log.HandleDebug(err)
+	}
+	if usesTun2socks() {
+		status.Tun2socksPid = tun.GetTun2socksPid()
+	}
+	return status
+}
+
+// servicePorts get the ports which core should listen for current proxy method and dns hijack mode
+func servicePorts() []portStatus {
+	ports := []portStatus{}
+	switch builds.Config.Proxy.Method {
+	case "tproxy":
+		tproxyPorts := []string{builds.Config.Proxy.TproxyPort}
+		for _, group := range builds.GetAppGroups() {
+			if !slices.Contains(tproxyPorts, group.TproxyPort) {
+				tproxyPorts = append(tproxyPorts, group.TproxyPort)
+			}
+		}
+		for _, port := range tproxyPorts {
+			ports = append(ports, portStatus{Name: "tproxy", Protocol: "tcp", Port: port}, portStatus{Name: "tproxy", Protocol: "udp", Port: port})
+		}
+	case "redirect":
+		ports = append(ports, portStatus{Name: "redirect", Protocol: "tcp", Port: builds.Config.Proxy.RedirectPort})
+		if builds.Config.Proxy.RedirectUDP {
+			ports = append(ports, portStatus{Name: "socks", Protocol: "tcp", Port: builds.Config.Proxy.SocksPort})
+		}
+	case "tun2socks":
+		ports = append(ports, portStatus{Name: "socks", Protocol: "tcp", Port: builds.Config.Proxy.SocksPort})
+	}
+	if builds.GetDNSHijack() == "redirect" {
+		ports = append(ports, portStatus{Name: "dns", Protocol: "udp", Port: builds.GetDNSPort()})
+	}
+	if builds.Config.DNS.DoT == "redirect" {
+		ports = append(ports, portStatus{Name: "dot", Protocol: "tcp", Port: builds.Config.DNS.DoTPort})
+	}
+	return ports
+}
+
+// getCoreVersion get the version of core
+func getCoreVersion() string {
+	var out bytes.Buffer
+	var versionArg string
+	switch builds.Config.XrayHelper.CoreType {
+	case "xray", "v2ray", "sing-box":
+		versionArg = "version"
+	case "clash.meta", "mihomo":
+		versionArg = "-v"
+	default:
+		return ""
+	}
+	version := common.NewExternal(5*time.Second, &out, &out, builds.Config.XrayHelper.CorePath, versionArg)
+	version.Run()
+	if version.Err() != nil {
+		log.HandleDebug(version.Err())
+		return ""
+	}
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(out.String()), "\n")
+	return strings.TrimSpace(firstLine)
+}
+
+// printServiceStatus print core service status, or marshal it to json
+func printServiceStatus(jsonFormat bool) error {
+	status := getServiceStatus()
+	if jsonFormat {
+		marshal, err := json.MarshalIndent(status, "", "    ")
+		if err != nil {
+			return e.New("marshal service status failed, ", err).WithPrefix(tagService)
+		}
+		fmt.Println(string(marshal))
+		return nil
+	}
+	log.HandleInfo("service: current core type is " + status.CoreType)
+	if len(status.CoreVersion) > 0 {
+		log.HandleInfo("service: core version is " + status.CoreVersion)
+	}
+	if status.Running {
+		log.HandleInfo("service: core is running, pid is " + strconv.Itoa(status.Pid))
+		log.HandleInfo(fmt.Sprintf("service: uptime %v, cpu time %.2fs, rss %.2fMiB, vms %.2fMiB, threads %d, fds %d",
+			time.Duration(status.Uptime)*time.Second, status.CpuTime, float64(status.Rss)/1024/1024, float64(status.Vms)/1024/1024, status.Threads, status.Fds))
+	} else if status.PidStale {
+		log.HandleInfo("service: core is stopped, core.pid is stale")
+	} else {
+		log.HandleInfo("service: core is stopped")
+	}
+	if status.SupervisorPid > 0 {
+		log.HandleInfo("service: supervisor is running, pid is " + strconv.Itoa(status.SupervisorPid))
+	}
+	if status.Running {
+		for _, port := range status.Ports {
+			if port.Listening {
+				log.HandleInfo("service: " + port.Name + " port " + port.Port + "/" + port.Protocol + " is listening")
+			} else {
+				log.HandleInfo("service: " + port.Name + " port " + port.Port + "/" + port.Protocol + " is not listening")
+			}
+		}
+	}
+	if status.ProxyEnabled {
+		log.HandleInfo("service: proxy method " + status.ProxyMethod + " is enabled")
+	} else {
+		log.HandleInfo("service: proxy method " + status.ProxyMethod + " is disabled")
+	}
+	if usesTun2socks() {
+		if status.Tun2socksPid > 0 {
+			log.HandleInfo("service: tun2socks is running, pid is " + strconv.Itoa(status.Tun2socksPid))
+		} else {
+			log.HandleInfo("service: tun2socks is stopped")
+		}
+	}
+	return nil
+}
+
+// usesTun2socks whether current proxy method runs tun2socks
+func usesTun2socks() bool {
+	return builds.Config.Proxy.Method == "tun2socks" || builds.Config.Proxy.Method == "redirect" && builds.Config.Proxy.RedirectUDP
+}
@@ -0,0 +1,229 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"os"
+	"os/signal"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	superviseMinBackoff = 1 * time.Second
+	superviseMaxBackoff = 64 * time.Second
+	superviseStableTime = 60 * time.Second
+	superviseCrashLimit = 5
+	// superviseCheckInterval the interval of sampling proxy state while core is running
+	superviseCheckInterval = 5 * time.Second
+)
+
+// supervised whether current process is the supervisor
+var supervised bool
+
+// superviseService keep core service running, restart it with exponential backoff when it exits unexpectedly
+func superviseService() error {
+	if supervisorPid := getSupervisorPid(); len(supervisorPid) > 0 {
+		return e.New("supervisor is running, pid is " + supervisorPid).WithPrefix(tagService)
+	}
+	if err := os.WriteFile(path.Join(builds.Config.XrayHelper.RunDir, "supervisor.pid"), []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return e.New("write supervisor pid failed, ", err).WithPrefix(tagService)
+	}
+	defer func() {
+		_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "supervisor.pid"))
+	}()
+	supervised = true
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		return err
+	}
+	// record the proxy state while core is alive, core tun device disappears with core
+	proxyEnabled := proxy.Enabled()
+	// supervisor can only wait its own child, restart the core which started by others
+	if len(getServicePid()) > 0 {
+		log.HandleInfo("service: core is running without supervisor, restart it")
+		stopService()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	backoff := superviseMinBackoff
+	crashCount := 0
+	for {
+		startTime := time.Now()
+		if err := startService(); err != nil {
+			log.HandleError(err)
+		} else {
+			log.HandleInfo("service: core is running under supervisor, pid is " + getServicePid())
+			if proxyEnabled && !proxy.Enabled() {
+				log.HandleInfo("service: proxy rules are missing, enable them again")
+				if err := enableProxy(proxy); err != nil {
+					log.HandleError(err)
+				}
+			}
+			exited := make(chan error, 1)
+			go func(core common.External) {
+				exited <- core.Wait()
+			}(service)
+			sig, err := watchService(proxy, &proxyEnabled, signals, exited)
+			if sig == syscall.SIGHUP {
+				log.HandleInfo("service: supervisor received " + sig.String() + ", restart core")
+				stopService()
+				<-exited
+				backoff = superviseMinBackoff
+				crashCount = 0
+				continue
+			}
+			if sig != nil {
+				log.HandleInfo("service: supervisor received " + sig.String() + ", stop core")
+				stopService()
+				return nil
+			}
+			if err != nil {
+				log.HandleError("service: core exited unexpectedly, " + err.Error())
+			} else {
+				log.HandleError("service: core exited unexpectedly")
+			}
+			_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "core.pid"))
+		}
+		if time.Since(startTime) >= superviseStableTime {
+			backoff = superviseMinBackoff
+			crashCount = 0
+		}
+		crashCount++
+		if crashCount >= superviseCrashLimit {
+			// avoid black-holing traffic when core cannot keep running
+			if proxyEnabled {
+				log.HandleInfo("service: disable proxy rules because of core crash loop")
+				proxy.Disable()
+			}
+			return e.New("core crashed " + strconv.Itoa(crashCount) + " times in a row, give up, please check error.log").WithPrefix(tagService)
+		}
+		log.HandleInfo("service: restart core after " + backoff.String())
+		select {
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				log.HandleInfo("service: supervisor received " + sig.String() + ", exit")
+				return nil
+			}
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > superviseMaxBackoff {
+			backoff = superviseMaxBackoff
+		}
+	}
+}
+
+// watchService wait until core exits or supervisor receives a signal, the proxy state is sampled periodically before core exits,
+// because the rules of some proxy method cannot be detected after core is gone, oversize logs are rotated at the same time
+func watchService(proxy proxies.ProxyMethod, proxyEnabled *bool, signals chan os.Signal, exited chan error) (os.Signal, error) {
+	ticker := time.NewTicker(superviseCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			*proxyEnabled = proxy.Enabled()
+			rotateOversizeLogs()
+		case sig := <-signals:
+			return sig, nil
+		case err := <-exited:
+			return nil, err
+		}
+	}
+}
+
+// enableProxy load package list and enable proxy rules
+func enableProxy(proxy proxies.ProxyMethod) error {
+	if err := builds.LoadPackage(); err != nil {
+		return err
+	}
+	proxy.Disable()
+	return proxy.Enable()
+}
+
+// startSupervisor start a new xrayhelper process to supervise core service in background
+func startSupervisor() error {
+	self, err := os.Executable()
+	if err != nil {
+		return e.New("get xrayhelper path failed, ", err).WithPrefix(tagService)
+	}
+	supervisor := common.NewExternal(0, nil, nil, self, "-c", *builds.ConfigFilePath, "-t", strconv.Itoa(*builds.CoreStartTimeout), "-s", strconv.Itoa(*builds.StopTimeout), "service", "supervise")
+	supervisor.Start()
+	if supervisor.Err() != nil {
+		return e.New("start supervisor failed, ", supervisor.Err()).WithPrefix(tagService)
+	}
+	for i := 0; i < *builds.CoreStartTimeout; i++ {
+		time.Sleep(1 * time.Second)
+		if len(getServicePid()) > 0 {
+			return nil
+		}
+	}
+	return e.New("supervisor cannot start core, please check error.log").WithPrefix(tagService)
+}
+
+// stopSupervisor stop the supervisor process, supervisor will stop core service before exit
+func stopSupervisor() {
+	supervisorPid := getSupervisorPid()
+	if len(supervisorPid) == 0 {
+		return
+	}
+	pid, _ := strconv.Atoi(supervisorPid)
+	if pid == os.Getpid() {
+		return
+	}
+	// supervisor need time to stop core gracefully
+	if err := common.StopProcess(pid, time.Duration(*builds.StopTimeout+1)*time.Second); err != nil {
+		log.HandleError(err)
+	}
+	_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "supervisor.pid"))
+}
+
+// restartService restart core service, let supervisor do it if supervisor is running
+func restartService() error {
+	supervisorPid := getSupervisorPid()
+	if len(supervisorPid) == 0 {
+		stopService()
+		return startService()
+	}
+	pid, _ := strconv.Atoi(supervisorPid)
+	supervisorProcess, err := os.FindProcess(pid)
+	if err != nil {
+		return e.New("find supervisor process failed, ", err).WithPrefix(tagService)
+	}
+	oldPid := getServicePid()
+	if err := supervisorProcess.Signal(syscall.SIGHUP); err != nil {
+		return e.New("notify supervisor failed, ", err).WithPrefix(tagService)
+	}
+	for i := 0; i < *builds.CoreStartTimeout*2; i++ {
+		time.Sleep(1 * time.Second)
+		if servicePid := getServicePid(); len(servicePid) > 0 && servicePid != oldPid {
+			return nil
+		}
+	}
+	return e.New("supervisor cannot restart core, please check error.log").WithPrefix(tagService)
+}
+
+// getSupervisorPid get supervisor pid from pid file, return empty if the pid does not belong to xrayhelper
+func getSupervisorPid() string {
+	pid, err := common.ReadPidFile(path.Join(builds.Config.XrayHelper.RunDir, "supervisor.pid"))
+	if err != nil {
+		log.HandleDebug(err)
+		return ""
+	}
+	self, err := os.Executable()
+	if err != nil {
+		log.HandleDebug(err)
+		return ""
+	}
+	if !common.CheckProcess(pid, self) {
+		log.HandleDebug("supervisor.pid is stale, pid " + strconv.Itoa(pid) + " does not belong to xrayhelper")
+		return ""
+	}
+	return strconv.Itoa(pid)
+}
@@ -16,19 +16,36 @@ func (this *SwitchCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	backup, err := backupCoreConfig()
+	if err != nil {
+		return err
+	}
 	success, err := switcher.Execute(args)
 	if err != nil {
 		return err
 	}
 	if success {
-		log.HandleInfo("switch: switch success")
 		// if core is running, restart it
 		if len(getServicePid()) > 0 {
-			log.HandleInfo("switch: detect core is running, restart it")
-			stopService()
-			if err := startService(); err != nil {
+			log.HandleInfo("switch: detect core is running, test new config")
+			err = prepareCoreConfig()
+			if err == nil {
+				err = testCoreConfig(builds.Config.XrayHelper.CorePath)
+			}
+			if err != nil {
+				log.HandleError("switch: new config is invalid, restore old config and keep core running")
+				if err := restoreCoreConfig(backup); err != nil {
+					log.HandleError(err)
+				}
+				return err
+			}
+			log.HandleInfo("switch: switch success")
+			log.HandleInfo("switch: restart core")
+			if err := restartService(); err != nil {
 				log.HandleError("restart service failed, " + err.Error())
 			}
+		} else {
+			log.HandleInfo("switch: switch success")
 		}
 	} else {
 		log.HandleError("switch: switch failed")
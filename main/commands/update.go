@@ -6,6 +6,7 @@ import (
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
 	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/tools"
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
@@ -103,6 +104,12 @@ func updateCore() error {
 		return e.New("this feature only support arm64 device").WithPrefix(tagUpdate)
 	}
 	serviceRunFlag := false
+	superviseFlag := len(getSupervisorPid()) > 0
+	// new core is saved to a temporary path, it will replace the old one after config test passed
+	newCorePath := builds.Config.XrayHelper.CorePath + ".new"
+	defer func() {
+		_ = os.Remove(newCorePath)
+	}()
 	if err := os.MkdirAll(builds.Config.XrayHelper.DataDir, 0644); err != nil {
 		return e.New("create run dir failed, ", err).WithPrefix(tagUpdate)
 	}
@@ -115,13 +122,6 @@ func updateCore() error {
 		if err := common.DownloadFile(xrayZipPath, xrayCoreDownloadUrl); err != nil {
 			return err
 		}
-		// update core need stop core service first
-		if len(getServicePid()) > 0 {
-			log.HandleInfo("update: detect core is running, stop it")
-			stopService()
-			serviceRunFlag = true
-			_ = os.Remove(builds.Config.XrayHelper.CorePath)
-		}
 		zipReader, err := zip.OpenReader(xrayZipPath)
 		if err != nil {
 			return e.New("open xray.zip failed, ", err).WithPrefix(tagUpdate)
@@ -136,13 +136,13 @@ func updateCore() error {
 				if err != nil {
 					return e.New("cannot get file reader "+file.Name+", ", err).WithPrefix(tagUpdate)
 				}
-				saveFile, err := os.OpenFile(builds.Config.XrayHelper.CorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
+				saveFile, err := os.OpenFile(newCorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
 				if err != nil {
-					return e.New("cannot open file "+builds.Config.XrayHelper.CorePath+", ", err).WithPrefix(tagUpdate)
+					return e.New("cannot open file "+newCorePath+", ", err).WithPrefix(tagUpdate)
 				}
 				_, err = io.Copy(saveFile, fileReader)
 				if err != nil {
-					return e.New("save file "+builds.Config.XrayHelper.CorePath+" failed, ", err).WithPrefix(tagUpdate)
+					return e.New("save file "+newCorePath+" failed, ", err).WithPrefix(tagUpdate)
 				}
 				_ = saveFile.Close()
 				_ = fileReader.Close()
@@ -154,13 +154,6 @@ func updateCore() error {
 		if err := common.DownloadFile(v2rayZipPath, v2rayCoreDownloadUrl); err != nil {
 			return err
 		}
-		// update core need stop core service first
-		if len(getServicePid()) > 0 {
-			log.HandleInfo("update: detect core is running, stop it")
-			stopService()
-			serviceRunFlag = true
-			_ = os.Remove(builds.Config.XrayHelper.CorePath)
-		}
 		zipReader, err := zip.OpenReader(v2rayZipPath)
 		if err != nil {
 			return e.New("open v2ray.zip failed, ", err).WithPrefix(tagUpdate)
@@ -175,13 +168,13 @@ func updateCore() error {
 				if err != nil {
 					return e.New("cannot get file reader "+file.Name+", ", err).WithPrefix(tagUpdate)
 				}
-				saveFile, err := os.OpenFile(builds.Config.XrayHelper.CorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
+				saveFile, err := os.OpenFile(newCorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
 				if err != nil {
-					return e.New("cannot open file "+builds.Config.XrayHelper.CorePath+", ", err).WithPrefix(tagUpdate)
+					return e.New("cannot open file "+newCorePath+", ", err).WithPrefix(tagUpdate)
 				}
 				_, err = io.Copy(saveFile, fileReader)
 				if err != nil {
-					return e.New("save file "+builds.Config.XrayHelper.CorePath+" failed, ", err).WithPrefix(tagUpdate)
+					return e.New("save file "+newCorePath+" failed, ", err).WithPrefix(tagUpdate)
 				}
 				_ = saveFile.Close()
 				_ = fileReader.Close()
@@ -197,13 +190,6 @@ func updateCore() error {
 		if err := common.DownloadFile(singboxGzipPath, singboxDownloadUrl); err != nil {
 			return err
 		}
-		// update core need stop core service first
-		if len(getServicePid()) > 0 {
-			log.HandleInfo("update: detect core is running, stop it")
-			stopService()
-			serviceRunFlag = true
-			_ = os.Remove(builds.Config.XrayHelper.CorePath)
-		}
 		singboxGzip, err := os.Open(singboxGzipPath)
 		if err != nil {
 			return e.New("open gzip file failed, ", err).WithPrefix(tagUpdate)
@@ -229,10 +215,10 @@ func updateCore() error {
 				continue
 			}
 			if filepath.Base(fileHeader.Name) == "sing-box" {
-				saveFile, err := os.OpenFile(builds.Config.XrayHelper.CorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
+				saveFile, err := os.OpenFile(newCorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
 				_, err = io.Copy(saveFile, tarReader)
 				if err != nil {
-					return e.New("save file "+builds.Config.XrayHelper.CorePath+" failed, ", err).WithPrefix(tagUpdate)
+					return e.New("save file "+newCorePath+" failed, ", err).WithPrefix(tagUpdate)
 				}
 				_ = saveFile.Close()
 				break
@@ -247,13 +233,6 @@ func updateCore() error {
 		if err := common.DownloadFile(mihomoGzipPath, mihomoDownloadUrl); err != nil {
 			return err
 		}
-		// update core need stop core service first
-		if len(getServicePid()) > 0 {
-			log.HandleInfo("update: detect core is running, stop it")
-			stopService()
-			serviceRunFlag = true
-			_ = os.Remove(builds.Config.XrayHelper.CorePath)
-		}
 		mihomoGzip, err := os.Open(mihomoGzipPath)
 		if err != nil {
 			return e.New("open gzip file failed, ", err).WithPrefix(tagUpdate)
@@ -269,18 +248,41 @@ func updateCore() error {
 		defer func(gzipReader *gzip.Reader) {
 			_ = gzipReader.Close()
 		}(gzipReader)
-		saveFile, err := os.OpenFile(builds.Config.XrayHelper.CorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
+		saveFile, err := os.OpenFile(newCorePath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
 		_, err = io.Copy(saveFile, gzipReader)
 		if err != nil {
-			return e.New("save file "+builds.Config.XrayHelper.CorePath+" failed, ", err).WithPrefix(tagUpdate)
+			return e.New("save file "+newCorePath+" failed, ", err).WithPrefix(tagUpdate)
 		}
 		_ = saveFile.Close()
 	default:
 		return e.New("unknown core type " + builds.Config.XrayHelper.CoreType).WithPrefix(tagUpdate)
 	}
+	if _, err := os.Stat(builds.Config.XrayHelper.CoreConfig); err == nil {
+		if err := testCoreConfig(newCorePath); err != nil {
+			log.HandleError("update: new core cannot pass config test, keep the old one")
+			return err
+		}
+	} else {
+		log.HandleInfo("update: core config not found, skip config test")
+	}
+	// update core need stop core service first
+	if len(getServicePid()) > 0 {
+		log.HandleInfo("update: detect core is running, stop it")
+		stopService()
+		serviceRunFlag = true
+	}
+	if err := os.Rename(newCorePath, builds.Config.XrayHelper.CorePath); err != nil {
+		return e.New("replace core failed, ", err).WithPrefix(tagUpdate)
+	}
 	if serviceRunFlag {
 		log.HandleInfo("update: starting core with new version")
-		_ = startService()
+		if superviseFlag {
+			if err := startSupervisor(); err != nil {
+				log.HandleError("update: start supervisor failed, " + err.Error())
+			}
+		} else {
+			_ = startService()
+		}
 		if err := builds.LoadPackage(); err != nil {
 			log.HandleError("update: load package failed, " + err.Error())
 		} else {
@@ -319,6 +321,20 @@ func updateGeodata() error {
 	if err := common.DownloadFile(path.Join(builds.Config.XrayHelper.DataDir, "geosite.dat"), geositeDownloadUrl); err != nil {
 		return err
 	}
+	// refresh the bypass sets, geoip categories of bypass lists are extracted from the new geoip.dat
+	if !tools.BypassEnabled() {
+		return nil
+	}
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil || !proxy.Enabled() {
+		return nil
+	}
+	if ruleset, err := proxy.Ruleset(); err == nil && tools.UseBypassSets(ruleset) {
+		log.HandleInfo("update: refreshing bypass sets")
+		if err := tools.ApplyBypassSets(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
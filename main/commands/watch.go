@@ -0,0 +1,350 @@
+package commands
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies"
+	"XrayHelper/main/proxies/tools"
+	"bytes"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tagWatch = "watch"
+	// watchDebounce wait for editors to finish writing before reload
+	watchDebounce = 1 * time.Second
+)
+
+type WatchCommand struct{}
+
+func (this *WatchCommand) Execute(args []string) error {
+	if len(args) > 0 {
+		return e.New("too many arguments").WithPrefix(tagWatch).WithPathObj(*this)
+	}
+	if err := builds.LoadConfig(); err != nil {
+		return err
+	}
+	if err := builds.CheckConfig(); err != nil {
+		return err
+	}
+	return watchConfig()
+}
+
+// configSnapshot the state which is used to decide what should be reapplied after config changed
+type configSnapshot struct {
+	config     reflect.Value
+	ruleset    tools.Ruleset
+	coreConfig map[string][]byte
+}
+
+// takeConfigSnapshot save current config, the proxy rules generated from it and the content of core config
+func takeConfigSnapshot() configSnapshot {
+	var snapshot configSnapshot
+	snapshot.config = reflect.ValueOf(builds.Config)
+	if err := builds.LoadPackage(); err != nil {
+		log.HandleDebug(err)
+	}
+	if proxy, err := proxies.NewProxy(builds.Config.Proxy.Method); err == nil {
+		if ruleset, err := proxy.Ruleset(); err == nil {
+			snapshot.ruleset = ruleset
+		} else {
+			log.HandleDebug(err)
+		}
+	}
+	if coreConfig, err := backupCoreConfig(); err == nil {
+		snapshot.coreConfig = coreConfig
+	} else {
+		log.HandleDebug(err)
+	}
+	return snapshot
+}
+
+// watchConfig watch xrayhelper config and core config, reapply the changes until receive SIGINT or SIGTERM
+func watchConfig() error {
+	watcher, err := common.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// inotify report the path joined by the watched directory, so use absolute path to compare
+	configPath, err := filepath.Abs(builds.LoadedConfigPath())
+	if err != nil {
+		return e.New("get config path failed, ", err).WithPrefix(tagWatch)
+	}
+	coreConfigPath, err := filepath.Abs(builds.Config.XrayHelper.CoreConfig)
+	if err != nil {
+		return e.New("get core config path failed, ", err).WithPrefix(tagWatch)
+	}
+	watchDirs := map[string]bool{path.Dir(configPath): true}
+	if info, err := os.Stat(coreConfigPath); err == nil && info.IsDir() {
+		watchDirs[coreConfigPath] = true
+	} else {
+		watchDirs[path.Dir(coreConfigPath)] = true
+	}
+	// watch package list to update uid rules when apps are installed or uninstalled
+	packageListPath := builds.PackageListPath
+	if _, err := os.Stat(packageListPath); err == nil {
+		watchDirs[path.Dir(packageListPath)] = true
+	} else {
+		log.HandleDebug("watch: " + packageListPath + " not exist, skip watching packages")
+	}
+	for dir := range watchDirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+	changes := make(chan []string)
+	go func() {
+		for {
+			changed, err := watcher.Read()
+			if err != nil {
+				log.HandleDebug(err)
+				return
+			}
+			changes <- changed
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	snapshot := takeConfigSnapshot()
+	log.HandleInfo("watch: watching " + configPath + " and " + coreConfigPath)
+	var debounce <-chan time.Time
+	configChanged, coreConfigChanged, packageChanged := false, false, false
+	rotateTicker := time.NewTicker(logRotateInterval)
+	defer rotateTicker.Stop()
+	for {
+		select {
+		case sig := <-signals:
+			log.HandleInfo("watch: received " + sig.String() + ", exit")
+			return nil
+		case <-rotateTicker.C:
+			rotateOversizeLogs()
+		case changed := <-changes:
+			for _, file := range changed {
+				if file == configPath {
+					configChanged = true
+				} else if file == coreConfigPath || strings.HasPrefix(file, coreConfigPath+"/") {
+					coreConfigChanged = true
+				} else if file == packageListPath {
+					packageChanged = true
+				} else {
+					continue
+				}
+				debounce = time.After(watchDebounce)
+			}
+		case <-debounce:
+			debounce = nil
+			if configChanged {
+				snapshot = reloadConfig(snapshot)
+			}
+			if coreConfigChanged {
+				snapshot = reloadCoreConfig(snapshot)
+			}
+			// the snapshot taken by reloadConfig already contains the new packages
+			if packageChanged && !configChanged {
+				snapshot = reloadPackages(snapshot)
+			}
+			configChanged, coreConfigChanged, packageChanged = false, false, false
+		}
+	}
+}
+
+// reloadConfig reload xrayhelper config, restart core or update proxy rules according to what changed
+func reloadConfig(snapshot configSnapshot) configSnapshot {
+	log.HandleInfo("watch: config changed, reload it")
+	err := builds.LoadConfig()
+	if err == nil {
+		err = builds.CheckConfig()
+	}
+	if err != nil {
+		log.HandleError(err)
+		log.HandleError("watch: new config is invalid, keep the old one")
+		setConfig(snapshot.config)
+		return snapshot
+	}
+	newSnapshot := takeConfigSnapshot()
+	// core config changes are handled by reloadCoreConfig unless core is restarted here
+	newSnapshot.coreConfig = snapshot.coreConfig
+	oldConfig, newConfig := snapshot.config, newSnapshot.config
+	coreRunning := len(getServicePid()) > 0
+	if coreRunning && configFieldsChanged(oldConfig, newConfig, coreFields) {
+		log.HandleInfo("watch: core related config changed, restart core")
+		if err := applyCoreConfig(); err != nil {
+			log.HandleError(err)
+		}
+		newSnapshot = takeConfigSnapshot()
+	}
+	// the proxy rules are applied by the old config, check and disable them under it
+	setConfig(oldConfig)
+	oldProxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	proxyEnabled := err == nil && oldProxy.Enabled()
+	// nftables rules are always reloaded as a whole table, which is atomic
+	if proxyEnabled && (configFieldsChanged(oldConfig, newConfig, proxyFields) || tools.UseNftables()) {
+		log.HandleInfo("watch: refresh proxy rules")
+		oldProxy.Disable()
+		setConfig(newConfig)
+		proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+		if err == nil {
+			err = enableProxy(proxy)
+		}
+		if err != nil {
+			log.HandleError(err)
+		}
+		return newSnapshot
+	}
+	setConfig(newConfig)
+	if !proxyEnabled {
+		return newSnapshot
+	}
+	added, deleted, err := tools.UpdateRuleset(snapshot.ruleset, newSnapshot.ruleset)
+	if err != nil {
+		log.HandleError(err)
+		log.HandleError("watch: update proxy rules failed, refresh all rules")
+		proxy, _ := proxies.NewProxy(builds.Config.Proxy.Method)
+		if err := enableProxy(proxy); err != nil {
+			log.HandleError(err)
+		}
+		return newSnapshot
+	}
+	log.HandleInfo("watch: proxy rules updated, " + strconv.Itoa(added) + " added, " + strconv.Itoa(deleted) + " deleted")
+	return newSnapshot
+}
+
+// reloadPackages reload package list, then insert or delete only the uid rules of the packages which are installed or uninstalled
+func reloadPackages(snapshot configSnapshot) configSnapshot {
+	if err := builds.LoadPackage(); err != nil {
+		log.HandleError(err)
+		return snapshot
+	}
+	proxy, err := proxies.NewProxy(builds.Config.Proxy.Method)
+	if err != nil {
+		log.HandleError(err)
+		return snapshot
+	}
+	ruleset, err := proxy.Ruleset()
+	if err != nil {
+		log.HandleError(err)
+		return snapshot
+	}
+	oldRuleset := snapshot.ruleset
+	snapshot.ruleset = ruleset
+	if !proxy.Enabled() {
+		return snapshot
+	}
+	// nftables table is replaced atomically, no traffic leaks during reload
+	if tools.UseNftables() {
+		if err := tools.ApplyNftables(ruleset); err != nil {
+			log.HandleError(err)
+			return snapshot
+		}
+		log.HandleInfo("watch: packages changed, nftables rules reloaded")
+		return snapshot
+	}
+	added, deleted, err := tools.UpdateRuleset(oldRuleset, ruleset)
+	if err != nil {
+		log.HandleError(err)
+		log.HandleError("watch: update package rules failed, refresh all rules")
+		if err := enableProxy(proxy); err != nil {
+			log.HandleError(err)
+		}
+		return snapshot
+	}
+	if added > 0 || deleted > 0 {
+		log.HandleInfo("watch: packages changed, " + strconv.Itoa(added) + " rules added, " + strconv.Itoa(deleted) + " deleted")
+	}
+	return snapshot
+}
+
+// reloadCoreConfig test changed core config, restart core if it is running
+func reloadCoreConfig(snapshot configSnapshot) configSnapshot {
+	coreConfig, err := backupCoreConfig()
+	if err != nil {
+		log.HandleError(err)
+		return snapshot
+	}
+	// prepareCoreConfig also writes core config, ignore the changes which do not modify the content
+	if coreConfigEqual(snapshot.coreConfig, coreConfig) {
+		return snapshot
+	}
+	snapshot.coreConfig = coreConfig
+	if len(getServicePid()) == 0 {
+		log.HandleInfo("watch: core config changed, core is not running")
+		return snapshot
+	}
+	log.HandleInfo("watch: core config changed, restart core")
+	if err := applyCoreConfig(); err != nil {
+		log.HandleError(err)
+		log.HandleError("watch: keep core running with the old config")
+	}
+	if coreConfig, err := backupCoreConfig(); err == nil {
+		snapshot.coreConfig = coreConfig
+	}
+	return snapshot
+}
+
+// applyCoreConfig test core config, then restart core
+func applyCoreConfig() error {
+	if err := prepareCoreConfig(); err != nil {
+		return err
+	}
+	if err := testCoreConfig(builds.Config.XrayHelper.CorePath); err != nil {
+		return err
+	}
+	return restartService()
+}
+
+// coreFields the config fields which need to restart core when changed
+var coreFields = []string{
+	"XrayHelper.CoreType", "XrayHelper.CorePath", "XrayHelper.CoreConfig", "XrayHelper.DataDir", "XrayHelper.RunDir",
+	"Proxy.EnableIPv6", "Proxy.AutoDNSStrategy", "DNS.Port", "Clash.DNSPort", "Clash.Template",
+}
+
+// proxyFields the config fields which need to refresh all proxy rules when changed, other proxy fields only change rules in the chains
+var proxyFields = []string{
+	"XrayHelper.CoreType", "Proxy.Method", "Proxy.Firewall", "Proxy.TproxyPort", "Proxy.SocksPort", "Proxy.RedirectPort", "Proxy.RedirectUDP", "Proxy.TunDevice", "Proxy.EnableIPv6", "Proxy.AppGroups", "Proxy.BypassLists", "Proxy.BlockQuic", "DNS", "Clash.DNSPort",
+}
+
+// configFieldsChanged whether any of the fields is different between two config
+func configFieldsChanged(old reflect.Value, new reflect.Value, fields []string) bool {
+	for _, field := range fields {
+		oldField, newField := old, new
+		for _, name := range strings.Split(field, ".") {
+			oldField = oldField.FieldByName(name)
+			newField = newField.FieldByName(name)
+		}
+		if !reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			log.HandleDebug("watch: " + field + " changed")
+			return true
+		}
+	}
+	return false
+}
+
+// setConfig replace current config with a snapshot
+func setConfig(config reflect.Value) {
+	reflect.ValueOf(&builds.Config).Elem().Set(config)
+}
+
+// coreConfigEqual whether two core config backups have the same content
+func coreConfigEqual(a map[string][]byte, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for confFile, confByte := range a {
+		if !bytes.Equal(confByte, b[confFile]) {
+			return false
+		}
+	}
+	return true
+}
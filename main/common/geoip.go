@@ -0,0 +1,126 @@
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"encoding/binary"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const tagGeoIP = "geoip"
+
+// LoadGeoIP read the CIDR list of the category from v2ray geoip.dat, the file is a protobuf encoded GeoIPList,
+// GeoIPList{repeated GeoIP entry = 1}, GeoIP{string country_code = 1; repeated CIDR cidr = 2}, CIDR{bytes ip = 1; uint32 prefix = 2}
+func LoadGeoIP(geoipPath string, category string) ([]string, error) {
+	geoipBytes, err := os.ReadFile(geoipPath)
+	if err != nil {
+		return nil, e.New("read "+geoipPath+" failed, ", err).WithPrefix(tagGeoIP)
+	}
+	var cidrs []string
+	found := false
+	err = readProtoFields(geoipBytes, func(field uint64, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+		var code string
+		var entryCidrs []string
+		err := readProtoFields(value, func(field uint64, value []byte) error {
+			switch field {
+			case 1:
+				code = string(value)
+			case 2:
+				// skip decoding cidr of other categories, country_code is always encoded first
+				if len(code) > 0 && !strings.EqualFold(code, category) {
+					return nil
+				}
+				cidr, err := readGeoIPCidr(value)
+				if err != nil {
+					return err
+				}
+				entryCidrs = append(entryCidrs, cidr)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if strings.EqualFold(code, category) {
+			found = true
+			cidrs = append(cidrs, entryCidrs...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, e.New("parse "+geoipPath+" failed, ", err).WithPrefix(tagGeoIP)
+	}
+	if !found {
+		return nil, e.New("cannot find category " + category + " in " + geoipPath).WithPrefix(tagGeoIP)
+	}
+	return cidrs, nil
+}
+
+// readGeoIPCidr decode the CIDR message
+func readGeoIPCidr(message []byte) (string, error) {
+	var ip net.IP
+	var prefix uint64
+	err := readProtoFields(message, func(field uint64, value []byte) error {
+		switch field {
+		case 1:
+			ip = value
+		case 2:
+			prefix, _ = binary.Uvarint(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return "", e.New("invalid ip length " + strconv.Itoa(len(ip))).WithPrefix(tagGeoIP)
+	}
+	return ip.String() + "/" + strconv.FormatUint(prefix, 10), nil
+}
+
+// readProtoFields walk through the fields of protobuf message, the value of varint field is passed as its encoded bytes
+func readProtoFields(message []byte, handle func(field uint64, value []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return e.New("invalid field key").WithPrefix(tagGeoIP)
+		}
+		message = message[n:]
+		var value []byte
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(message)
+			if n <= 0 {
+				return e.New("invalid varint").WithPrefix(tagGeoIP)
+			}
+			value, message = message[:n], message[n:]
+		case 1:
+			if len(message) < 8 {
+				return e.New("invalid fixed64").WithPrefix(tagGeoIP)
+			}
+			value, message = message[:8], message[8:]
+		case 2:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < length {
+				return e.New("invalid length").WithPrefix(tagGeoIP)
+			}
+			value, message = message[n:n+int(length)], message[n+int(length):]
+		case 5:
+			if len(message) < 4 {
+				return e.New("invalid fixed32").WithPrefix(tagGeoIP)
+			}
+			value, message = message[:4], message[4:]
+		default:
+			return e.New("unsupported wire type " + strconv.FormatUint(key&7, 10)).WithPrefix(tagGeoIP)
+		}
+		if err := handle(key>>3, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
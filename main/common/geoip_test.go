@@ -0,0 +1,57 @@
+package common_test
+
+import (
+	"XrayHelper/main/common"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// protoBytes encode a length delimited protobuf field
+func protoBytes(field byte, value []byte) []byte {
+	return append([]byte{field<<3 | 2, byte(len(value))}, value...)
+}
+
+// geoIPEntry encode a GeoIP message with its CIDR messages
+func geoIPEntry(code string, cidrs ...[]byte) []byte {
+	entry := protoBytes(1, []byte(code))
+	for _, cidr := range cidrs {
+		entry = append(entry, protoBytes(2, cidr)...)
+	}
+	return protoBytes(1, entry)
+}
+
+// geoIPCidr encode a CIDR message
+func geoIPCidr(ip []byte, prefix byte) []byte {
+	return append(protoBytes(1, ip), 2<<3, prefix)
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	var geoip []byte
+	geoip = append(geoip, geoIPEntry("US", geoIPCidr([]byte{8, 8, 8, 0}, 24))...)
+	geoip = append(geoip, geoIPEntry("CN",
+		geoIPCidr([]byte{1, 0, 1, 0}, 24),
+		geoIPCidr([]byte{0x24, 0x0e, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 20),
+	)...)
+	geoipPath := path.Join(t.TempDir(), "geoip.dat")
+	if err := os.WriteFile(geoipPath, geoip, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cidrs, err := common.LoadGeoIP(geoipPath, "cn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cidrs, ",") != "1.0.1.0/24,240e::/20" {
+		t.Errorf("unexpected cidrs %v", cidrs)
+	}
+	if _, err := common.LoadGeoIP(geoipPath, "jp"); err == nil {
+		t.Error("unknown category should be rejected")
+	}
+	if err := os.WriteFile(geoipPath, geoip[:len(geoip)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := common.LoadGeoIP(geoipPath, "cn"); err == nil {
+		t.Error("truncated file should be rejected")
+	}
+}
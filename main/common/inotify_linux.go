@@ -0,0 +1,73 @@
+//go:build linux
+
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"path"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	tagInotify  = "inotify"
+	inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_CREATE | syscall.IN_DELETE
+)
+
+// Watcher watch the file changes of directories by inotify
+type Watcher struct {
+	fd      int
+	watches map[int32]string
+	// buffer the event buffer, it is reused by every Read
+	buffer []byte
+}
+
+// NewWatcher create an inotify watcher
+func NewWatcher() (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, e.New("init inotify failed, ", err).WithPrefix(tagInotify)
+	}
+	return &Watcher{fd: fd, watches: make(map[int32]string), buffer: make([]byte, 4096*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))}, nil
+}
+
+// Add watch the directory, editors usually replace the file by rename, so watch the directory instead of file
+func (this *Watcher) Add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(this.fd, dir, inotifyMask)
+	if err != nil {
+		return e.New("watch "+dir+" failed, ", err).WithPrefix(tagInotify)
+	}
+	this.watches[int32(wd)] = dir
+	return nil
+}
+
+// Read block until some files changed, return the changed file paths
+func (this *Watcher) Read() ([]string, error) {
+	buffer := this.buffer
+	n, err := syscall.Read(this.fd, buffer)
+	if err != nil {
+		return nil, e.New("read inotify event failed, ", err).WithPrefix(tagInotify)
+	}
+	var changed []string
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+		nameBytes := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+		name := string(nameBytes)
+		for i := 0; i < len(nameBytes); i++ {
+			if nameBytes[i] == 0 {
+				name = string(nameBytes[:i])
+				break
+			}
+		}
+		if dir, ok := this.watches[event.Wd]; ok {
+			changed = append(changed, path.Join(dir, name))
+		}
+		offset += syscall.SizeofInotifyEvent + int(event.Len)
+	}
+	return changed, nil
+}
+
+// Close stop watching
+func (this *Watcher) Close() error {
+	return syscall.Close(this.fd)
+}
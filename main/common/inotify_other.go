@@ -0,0 +1,30 @@
+//go:build !linux
+
+package common
+
+import e "XrayHelper/main/errors"
+
+const tagInotify = "inotify"
+
+// Watcher not implement
+type Watcher struct{}
+
+// NewWatcher not implement
+func NewWatcher() (*Watcher, error) {
+	return nil, e.New("system not support inotify").WithPrefix(tagInotify)
+}
+
+// Add not implement
+func (this *Watcher) Add(dir string) error {
+	return e.New("system not support inotify").WithPrefix(tagInotify)
+}
+
+// Read not implement
+func (this *Watcher) Read() ([]string, error) {
+	return nil, e.New("system not support inotify").WithPrefix(tagInotify)
+}
+
+// Close not implement
+func (this *Watcher) Close() error {
+	return nil
+}
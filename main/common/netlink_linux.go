@@ -0,0 +1,69 @@
+//go:build linux
+
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"syscall"
+)
+
+const (
+	tagNetlink = "netlink"
+	// rtnetlink multicast groups, syscall package does not define them
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+	// netlinkGroups the groups of link, address and route changes
+	netlinkGroups = rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route
+)
+
+// NetlinkMonitor receive the link, address and route change events from rtnetlink
+type NetlinkMonitor struct {
+	fd int
+	// buffer the message buffer, it is reused by every Read
+	buffer []byte
+}
+
+// NewNetlinkMonitor subscribe the link, address and route changes
+func NewNetlinkMonitor() (*NetlinkMonitor, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, e.New("create netlink socket failed, ", err).WithPrefix(tagNetlink)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: netlinkGroups}); err != nil {
+		_ = syscall.Close(fd)
+		return nil, e.New("subscribe netlink groups failed, ", err).WithPrefix(tagNetlink)
+	}
+	return &NetlinkMonitor{fd: fd, buffer: make([]byte, syscall.Getpagesize()*4)}, nil
+}
+
+// Read block until some events are received, return the event types, eg: syscall.RTM_NEWLINK,
+// if the socket buffer overruns, the lost events are unknown, so it returns no events and nil error, the caller should check the whole state
+func (this *NetlinkMonitor) Read() ([]uint16, error) {
+	n, _, err := syscall.Recvfrom(this.fd, this.buffer, 0)
+	for err == syscall.EINTR {
+		n, _, err = syscall.Recvfrom(this.fd, this.buffer, 0)
+	}
+	if err == syscall.ENOBUFS {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, e.New("read netlink event failed, ", err).WithPrefix(tagNetlink)
+	}
+	messages, err := syscall.ParseNetlinkMessage(this.buffer[:n])
+	if err != nil {
+		return nil, e.New("parse netlink event failed, ", err).WithPrefix(tagNetlink)
+	}
+	var events []uint16
+	for _, message := range messages {
+		events = append(events, message.Header.Type)
+	}
+	return events, nil
+}
+
+// Close stop receiving events
+func (this *NetlinkMonitor) Close() error {
+	return syscall.Close(this.fd)
+}
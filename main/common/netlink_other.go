@@ -0,0 +1,25 @@
+//go:build !linux
+
+package common
+
+import e "XrayHelper/main/errors"
+
+const tagNetlink = "netlink"
+
+// NetlinkMonitor not implement
+type NetlinkMonitor struct{}
+
+// NewNetlinkMonitor not implement
+func NewNetlinkMonitor() (*NetlinkMonitor, error) {
+	return nil, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Read not implement
+func (this *NetlinkMonitor) Read() ([]uint16, error) {
+	return nil, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Close not implement
+func (this *NetlinkMonitor) Close() error {
+	return nil
+}
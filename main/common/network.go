@@ -2,12 +2,14 @@ package common
 
 import (
 	e "XrayHelper/main/errors"
-	"bytes"
+	"bufio"
 	"context"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"path"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -52,11 +54,92 @@ func CheckPort(protocol string, host string, port string) bool {
 	return true
 }
 
-// CheckLocalPort check whether the local port is listening
-func CheckLocalPort(port string) bool {
-	var msg bytes.Buffer
-	NewExternal(0, &msg, nil, "netstat", "-tnlp").Run()
-	return strings.Contains(msg.String(), port)
+// CheckLocalPort check whether the local port is listening on protocol(tcp or udp), if pid > 0, also check the socket belongs to the process
+func CheckLocalPort(protocol string, port string, pid int) bool {
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return false
+	}
+	inodes := make(map[string]struct{})
+	for _, procNet := range []string{protocol, protocol + "6"} {
+		procNetFile, err := os.Open(path.Join("/proc/net", procNet))
+		if err != nil {
+			continue
+		}
+		for _, inode := range getListenInodes(procNetFile, protocol, uint16(portNum)) {
+			inodes[inode] = struct{}{}
+		}
+		_ = procNetFile.Close()
+	}
+	if len(inodes) == 0 {
+		return false
+	}
+	if pid <= 0 {
+		return true
+	}
+	// the socket inode should be found in process fd list
+	fdDir := path.Join("/proc", strconv.Itoa(pid), "fd")
+	fds, err := os.ReadDir(fdDir)
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		link, err := os.Readlink(path.Join(fdDir, fd.Name()))
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		if _, ok := inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getListenInodes parse /proc/net/{tcp,tcp6,udp,udp6}, get the socket inodes which listen on port
+func getListenInodes(procNet io.Reader, protocol string, port uint16) []string {
+	var inodes []string
+	scanner := bufio.NewScanner(procNet)
+	// skip the header line
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		localPort, ok := parseProcNetPort(fields[1])
+		if !ok || localPort != port {
+			continue
+		}
+		switch protocol {
+		case "tcp":
+			// TCP_LISTEN
+			if fields[3] != "0A" {
+				continue
+			}
+		case "udp":
+			// unconnected udp socket
+			if remotePort, ok := parseProcNetPort(fields[2]); !ok || remotePort != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		inodes = append(inodes, fields[9])
+	}
+	return inodes
+}
+
+// parseProcNetPort parse the port of address like 0100007F:FFFF
+func parseProcNetPort(address string) (uint16, bool) {
+	index := strings.LastIndexByte(address, ':')
+	if index < 0 {
+		return 0, false
+	}
+	port, err := strconv.ParseUint(address[index+1:], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(port), true
 }
 
 func IsIPv6(cidr string) bool {
@@ -0,0 +1,33 @@
+package common_test
+
+import (
+	"XrayHelper/main/common"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestCheckLocalPort(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	udpListener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpListener.Close()
+	tcpPort := strconv.Itoa(tcpListener.Addr().(*net.TCPAddr).Port)
+	udpPort := strconv.Itoa(udpListener.LocalAddr().(*net.UDPAddr).Port)
+	if !common.CheckLocalPort("tcp", tcpPort, os.Getpid()) {
+		t.Error("tcp port " + tcpPort + " should be listening")
+	}
+	if !common.CheckLocalPort("udp", udpPort, os.Getpid()) {
+		t.Error("udp port " + udpPort + " should be listening")
+	}
+	if common.CheckLocalPort("tcp", tcpPort, 1) {
+		t.Error("tcp port " + tcpPort + " should not belong to pid 1")
+	}
+}
@@ -0,0 +1,138 @@
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tagProcess = "process"
+	// clockTicks USER_HZ of linux kernel, used by /proc/<pid>/stat
+	clockTicks = 100
+)
+
+// processAlive check whether the process is alive, zombie process is treated as dead
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(path.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// the state is the first field after the command name, which is wrapped by parentheses
+	index := strings.LastIndexByte(string(stat), ')')
+	if index < 0 || index+2 >= len(stat) {
+		return false
+	}
+	return stat[index+2] != 'Z'
+}
+
+// CheckProcess check whether the process of pid is running the executable binPath
+func CheckProcess(pid int, binPath string) bool {
+	if pid <= 0 || len(binPath) == 0 || !processAlive(pid) {
+		return false
+	}
+	binPath = filepath.Clean(binPath)
+	procDir := path.Join("/proc", strconv.Itoa(pid))
+	if exe, err := os.Readlink(path.Join(procDir, "exe")); err == nil {
+		// the executable may be replaced after process started
+		if filepath.Clean(strings.TrimSuffix(exe, " (deleted)")) == binPath {
+			return true
+		}
+	}
+	cmdline, err := os.ReadFile(path.Join(procDir, "cmdline"))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) > 0 && len(args[0]) > 0 && filepath.Clean(args[0]) == binPath
+}
+
+// StopProcess stop process gracefully, send SIGTERM first, then send SIGKILL if it is still alive after grace period
+func StopProcess(pid int, grace time.Duration) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return e.New("find process "+strconv.Itoa(pid)+" failed, ", err).WithPrefix(tagProcess)
+	}
+	if err := process.Signal(syscall.SIGTERM); err != nil && !processAlive(pid) {
+		return nil
+	}
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); {
+		if !processAlive(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := process.Kill(); err != nil && processAlive(pid) {
+		return e.New("kill process "+strconv.Itoa(pid)+" failed, ", err).WithPrefix(tagProcess)
+	}
+	return nil
+}
+
+// ReadPidFile read pid from pid file
+func ReadPidFile(pidFile string) (int, error) {
+	pidByte, err := os.ReadFile(pidFile)
+	if err != nil {
+		return 0, e.New("read pid file failed, ", err).WithPrefix(tagProcess)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidByte)))
+	if err != nil {
+		return 0, e.New("invalid pid file "+pidFile+", ", err).WithPrefix(tagProcess)
+	}
+	return pid, nil
+}
+
+// ProcessStat resource usage of a process
+type ProcessStat struct {
+	Uptime  time.Duration
+	CpuTime time.Duration
+	Rss     uint64
+	Vms     uint64
+	Threads int
+	Fds     int
+}
+
+// GetProcessStat get process resource usage from /proc/<pid>
+func GetProcessStat(pid int) (*ProcessStat, error) {
+	procDir := path.Join("/proc", strconv.Itoa(pid))
+	stat, err := os.ReadFile(path.Join(procDir, "stat"))
+	if err != nil {
+		return nil, e.New("read process stat failed, ", err).WithPrefix(tagProcess)
+	}
+	index := strings.LastIndexByte(string(stat), ')')
+	if index < 0 {
+		return nil, e.New("invalid process stat").WithPrefix(tagProcess)
+	}
+	// fields start from the process state, which is the third field of stat
+	fields := strings.Fields(string(stat[index+1:]))
+	if len(fields) < 22 {
+		return nil, e.New("invalid process stat").WithPrefix(tagProcess)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	threads, _ := strconv.Atoi(fields[17])
+	startTime, _ := strconv.ParseUint(fields[19], 10, 64)
+	vsize, _ := strconv.ParseUint(fields[20], 10, 64)
+	rss, _ := strconv.ParseUint(fields[21], 10, 64)
+	processStat := &ProcessStat{
+		CpuTime: time.Duration(utime+stime) * time.Second / clockTicks,
+		Rss:     rss * uint64(os.Getpagesize()),
+		Vms:     vsize,
+		Threads: threads,
+	}
+	if uptime, err := os.ReadFile("/proc/uptime"); err == nil {
+		if uptimeFields := strings.Fields(string(uptime)); len(uptimeFields) > 0 {
+			if systemUptime, err := strconv.ParseFloat(uptimeFields[0], 64); err == nil {
+				processStat.Uptime = time.Duration(systemUptime*float64(time.Second)) - time.Duration(startTime)*time.Second/clockTicks
+			}
+		}
+	}
+	if fds, err := os.ReadDir(path.Join(procDir, "fd")); err == nil {
+		processStat.Fds = len(fds)
+	}
+	return processStat, nil
+}
@@ -0,0 +1,30 @@
+package common_test
+
+import (
+	"XrayHelper/main/common"
+	"os"
+	"testing"
+)
+
+func TestCheckProcess(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.CheckProcess(os.Getpid(), self) {
+		t.Error("current process should match its executable")
+	}
+	if common.CheckProcess(os.Getpid(), "/system/bin/not-a-core") {
+		t.Error("current process should not match other executable")
+	}
+}
+
+func TestGetProcessStat(t *testing.T) {
+	stat, err := common.GetProcessStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Threads <= 0 || stat.Rss == 0 || stat.Fds == 0 {
+		t.Errorf("unexpected process stat %+v", *stat)
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"syscall"
+)
+
+// IPRule an ip rule which looks up a routing table, eg: ip rule add [not] from all fwmark 1111 [prio 31999] table 233
+type IPRule struct {
+	IPv6  bool
+	Table string
+	// Mark the fwmark selector, empty means all traffic
+	Mark string
+	// Invert the selector is inverted, like ip rule not
+	Invert bool
+	// Priority the rule priority, empty means the kernel chooses one when added, or any priority when matched
+	Priority string
+}
+
+// String describe the rule in ip rule syntax, eg: ipv4 rule from all fwmark 1111 table 233
+func (this IPRule) String() string {
+	description := familyName(this.IPv6) + " rule "
+	if this.Invert {
+		description += "not "
+	}
+	description += "from all"
+	if len(this.Mark) > 0 {
+		description += " fwmark " + this.Mark
+	}
+	if len(this.Priority) > 0 {
+		description += " prio " + this.Priority
+	}
+	return description + " table " + this.Table
+}
+
+// IPRoute an ip route in a routing table, eg: ip route add [local] default dev lo table 233
+type IPRoute struct {
+	IPv6  bool
+	Table string
+	// Local the route type is local, otherwise unicast
+	Local bool
+	// Dst the destination CIDR, empty means default
+	Dst string
+	// Dev the output interface, it may be empty when the route is deleted
+	Dev string
+}
+
+// String describe the route in ip route syntax, eg: ipv4 route local default dev lo table 233
+func (this IPRoute) String() string {
+	description := familyName(this.IPv6) + " route "
+	if this.Local {
+		description += "local "
+	}
+	if len(this.Dst) > 0 {
+		description += this.Dst
+	} else {
+		description += "default"
+	}
+	if len(this.Dev) > 0 {
+		description += " dev " + this.Dev
+	}
+	return description + " table " + this.Table
+}
+
+// Neighbor a neighbor in the ARP or NDP table, eg: the client of hotspot or usb tethering
+type Neighbor struct {
+	IP    string
+	MAC   string
+	Dev   string
+	State string
+}
+
+// NetlinkError the error of a netlink request, Errno is the error code returned by kernel, so that it can be checked by errors.Is
+type NetlinkError struct {
+	Op    string
+	Errno syscall.Errno
+}
+
+func (this *NetlinkError) Error() string {
+	return e.New(this.Op+" failed, ", this.Errno.Error()).WithPrefix(tagNetlink).Error()
+}
+
+func (this *NetlinkError) Unwrap() error {
+	return this.Errno
+}
+
+// familyName get the protocol name used in description
+func familyName(ipv6 bool) string {
+	if ipv6 {
+		return "ipv6"
+	}
+	return "ipv4"
+}
@@ -0,0 +1,547 @@
+//go:build linux
+
+package common
+
+import (
+	e "XrayHelper/main/errors"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// fib rule attributes and link info attributes, syscall package does not define them
+const (
+	fraPriority   = 6
+	fraFwmark     = 10
+	fraTable      = 15
+	frActToTbl    = 1
+	fibRuleInvert = 0x2
+	iflaInfoKind  = 1
+	ndaDst        = 1
+	ndaLladdr     = 2
+	// netlinkBufferSize a dump reply may be larger than one page
+	netlinkBufferSize = 64 * 1024
+)
+
+// ndMsg the neighbor message header, syscall package does not define it
+type ndMsg struct {
+	Family  uint8
+	Pad1    uint8
+	Pad2    uint16
+	Ifindex int32
+	State   uint16
+	Flags   uint8
+	Type    uint8
+}
+
+// neighborStates the names of neighbor states, incomplete, failed and noarp neighbors are not listed
+var neighborStates = map[uint16]string{0x02: "reachable", 0x04: "stale", 0x08: "delay", 0x10: "probe", 0x80: "permanent"}
+
+// netlinkSeq the sequence number of the last netlink request
+var netlinkSeq uint32
+
+// netlinkRequest send a rtnetlink request and wait for its ack, return the replies of dump or get request,
+// the error code from kernel is returned as syscall.Errno
+func netlinkRequest(msgType uint16, flags uint16, data []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	// a lost ack should not block forever
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 5}); err != nil {
+		return nil, err
+	}
+	flags |= syscall.NLM_F_REQUEST
+	// dump request ends with NLMSG_DONE, other requests end with an ack,
+	// NLM_F_DUMP shares bits with NLM_F_EXCL, so both bits must be checked
+	if flags&syscall.NLM_F_DUMP != syscall.NLM_F_DUMP {
+		flags |= syscall.NLM_F_ACK
+	}
+	header := syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(data)), Type: msgType, Flags: flags, Seq: atomic.AddUint32(&netlinkSeq, 1)}
+	request := append(structBytes(&header), data...)
+	if err := syscall.Sendto(fd, request, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+	var replies []syscall.NetlinkMessage
+	for {
+		// the replies refer to the buffer, so each read needs a new one
+		buffer := make([]byte, netlinkBufferSize)
+		n, _, err := syscall.Recvfrom(fd, buffer, 0)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			if message.Header.Seq != header.Seq {
+				continue
+			}
+			switch message.Header.Type {
+			case syscall.NLMSG_DONE, syscall.NLMSG_ERROR:
+				if len(message.Data) >= 4 {
+					if errno := -*(*int32)(unsafe.Pointer(&message.Data[0])); errno > 0 {
+						return nil, syscall.Errno(errno)
+					}
+				}
+				return replies, nil
+			default:
+				replies = append(replies, message)
+			}
+		}
+	}
+}
+
+// structBytes get the memory of a netlink struct in native byte order
+func structBytes[T any](value *T) []byte {
+	return append([]byte{}, unsafe.Slice((*byte)(unsafe.Pointer(value)), unsafe.Sizeof(*value))...)
+}
+
+// uint32Bytes get the uint32 attribute value in native byte order
+func uint32Bytes(value uint32) []byte {
+	return structBytes(&value)
+}
+
+// appendAttr append a netlink attribute, the attribute is padded to 4 bytes
+func appendAttr(data []byte, attrType uint16, value []byte) []byte {
+	attr := syscall.RtAttr{Len: uint16(syscall.SizeofRtAttr + len(value)), Type: attrType}
+	data = append(data, structBytes(&attr)...)
+	data = append(data, value...)
+	for len(data)%syscall.NLMSG_ALIGNTO != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// parseAttrs parse the netlink attributes, the nested flag of attribute type is cleared
+func parseAttrs(data []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(data) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&data[0]))
+		if int(attr.Len) < syscall.SizeofRtAttr || int(attr.Len) > len(data) {
+			break
+		}
+		attrs[attr.Type&0x3fff] = data[syscall.SizeofRtAttr:attr.Len]
+		aligned := (int(attr.Len) + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+		if aligned > len(data) {
+			break
+		}
+		data = data[aligned:]
+	}
+	return attrs
+}
+
+// attrUint32 get the uint32 value of attribute in native byte order
+func attrUint32(value []byte) uint32 {
+	if len(value) < 4 {
+		return 0
+	}
+	return *(*uint32)(unsafe.Pointer(&value[0]))
+}
+
+// parseUint32 parse the decimal value of table, mark or priority
+func parseUint32(value string, name string) (uint32, error) {
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, e.New("invalid "+name+" "+strconv.Quote(value), ", ", err).WithPrefix(tagNetlink)
+	}
+	return uint32(number), nil
+}
+
+// addressFamily get the address family of ipv4 or ipv6
+func addressFamily(ipv6 bool) uint8 {
+	if ipv6 {
+		return syscall.AF_INET6
+	}
+	return syscall.AF_INET
+}
+
+// isExist whether the error means the object already exists
+func isExist(err error) bool {
+	return errors.Is(err, syscall.EEXIST)
+}
+
+// isNotExist whether the error means the object does not exist
+func isNotExist(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENODEV) || errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+// wrapErrno convert the errno to NetlinkError, other errors are returned as is
+func wrapErrno(op string, err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return &NetlinkError{Op: op, Errno: errno}
+	}
+	return err
+}
+
+// message build the fib rule message
+func (this IPRule) message() ([]byte, error) {
+	table, err := parseUint32(this.Table, "table")
+	if err != nil {
+		return nil, err
+	}
+	// fib_rule_hdr has the same layout as rtmsg, the type field is the rule action
+	header := syscall.RtMsg{Family: addressFamily(this.IPv6), Type: frActToTbl}
+	if table < 256 {
+		header.Table = uint8(table)
+	}
+	if this.Invert {
+		header.Flags = fibRuleInvert
+	}
+	data := appendAttr(structBytes(&header), fraTable, uint32Bytes(table))
+	if len(this.Mark) > 0 {
+		mark, err := parseUint32(this.Mark, "mark")
+		if err != nil {
+			return nil, err
+		}
+		data = appendAttr(data, fraFwmark, uint32Bytes(mark))
+	}
+	if len(this.Priority) > 0 {
+		priority, err := parseUint32(this.Priority, "priority")
+		if err != nil {
+			return nil, err
+		}
+		data = appendAttr(data, fraPriority, uint32Bytes(priority))
+	}
+	return data, nil
+}
+
+// Add add the ip rule, it is not an error if the same rule exists
+func (this IPRule) Add() error {
+	data, err := this.message()
+	if err != nil {
+		return err
+	}
+	// the kernel chooses a new priority for the rule without priority, so NLM_F_EXCL never reports it exists
+	if len(this.Priority) == 0 {
+		if exist, err := this.Exists(); err != nil {
+			return err
+		} else if exist {
+			return nil
+		}
+	}
+	if _, err := netlinkRequest(syscall.RTM_NEWRULE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil && !isExist(err) {
+		return wrapErrno("add "+this.String(), err)
+	}
+	return nil
+}
+
+// Delete delete the ip rule, it is not an error if the rule does not exist
+func (this IPRule) Delete() error {
+	data, err := this.message()
+	if err != nil {
+		return err
+	}
+	if _, err := netlinkRequest(syscall.RTM_DELRULE, 0, data); err != nil && !isNotExist(err) {
+		return wrapErrno("delete "+this.String(), err)
+	}
+	return nil
+}
+
+// Exists check whether the ip rule is in place, the priority is compared only if it is set
+func (this IPRule) Exists() (bool, error) {
+	rules, err := ListIPRules(this.IPv6)
+	if err != nil {
+		return false, err
+	}
+	for _, rule := range rules {
+		if rule.Table == this.Table && rule.Mark == this.Mark && rule.Invert == this.Invert && (len(this.Priority) == 0 || rule.Priority == this.Priority) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListIPRules list all ip rules of ipv4 or ipv6
+func ListIPRules(ipv6 bool) ([]IPRule, error) {
+	header := syscall.RtMsg{Family: addressFamily(ipv6)}
+	replies, err := netlinkRequest(syscall.RTM_GETRULE, syscall.NLM_F_DUMP, structBytes(&header))
+	if err != nil {
+		return nil, wrapErrno("list "+familyName(ipv6)+" rules", err)
+	}
+	var rules []IPRule
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.RTM_NEWRULE || len(reply.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		ruleHeader := (*syscall.RtMsg)(unsafe.Pointer(&reply.Data[0]))
+		attrs := parseAttrs(reply.Data[syscall.SizeofRtMsg:])
+		rule := IPRule{IPv6: ipv6, Table: strconv.Itoa(int(ruleHeader.Table)), Invert: ruleHeader.Flags&fibRuleInvert != 0}
+		if table, ok := attrs[fraTable]; ok {
+			rule.Table = strconv.FormatUint(uint64(attrUint32(table)), 10)
+		}
+		if mark, ok := attrs[fraFwmark]; ok {
+			rule.Mark = strconv.FormatUint(uint64(attrUint32(mark)), 10)
+		}
+		if priority, ok := attrs[fraPriority]; ok {
+			rule.Priority = strconv.FormatUint(uint64(attrUint32(priority)), 10)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// DeleteIPRules delete all ip rules which look up the table, so that the rules added by old config are cleaned up as well
+func DeleteIPRules(ipv6 bool, table string) error {
+	rules, err := ListIPRules(ipv6)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Table != table {
+			continue
+		}
+		if err := rule.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// message build the route message, the scope of deleted route is a wildcard
+func (this IPRoute) message(delete bool) ([]byte, error) {
+	table, err := parseUint32(this.Table, "table")
+	if err != nil {
+		return nil, err
+	}
+	header := syscall.RtMsg{Family: addressFamily(this.IPv6), Protocol: syscall.RTPROT_BOOT, Scope: syscall.RT_SCOPE_LINK, Type: syscall.RTN_UNICAST}
+	if this.Local {
+		header.Scope, header.Type = syscall.RT_SCOPE_HOST, syscall.RTN_LOCAL
+	}
+	if delete {
+		header.Scope = syscall.RT_SCOPE_NOWHERE
+	}
+	if table < 256 {
+		header.Table = uint8(table)
+	}
+	var dst []byte
+	if len(this.Dst) > 0 {
+		_, ipNet, err := net.ParseCIDR(this.Dst)
+		if err != nil {
+			return nil, e.New("invalid destination "+strconv.Quote(this.Dst), ", ", err).WithPrefix(tagNetlink)
+		}
+		ones, _ := ipNet.Mask.Size()
+		header.Dst_len = uint8(ones)
+		dst = ipNet.IP.To16()
+		if !this.IPv6 {
+			dst = ipNet.IP.To4()
+		}
+	}
+	data := appendAttr(structBytes(&header), syscall.RTA_TABLE, uint32Bytes(table))
+	if dst != nil {
+		data = appendAttr(data, syscall.RTA_DST, dst)
+	}
+	if len(this.Dev) > 0 {
+		device, err := net.InterfaceByName(this.Dev)
+		if err != nil {
+			return nil, &NetlinkError{Op: "find device " + this.Dev, Errno: syscall.ENODEV}
+		}
+		data = appendAttr(data, syscall.RTA_OIF, uint32Bytes(uint32(device.Index)))
+	}
+	return data, nil
+}
+
+// Add add the ip route, it is not an error if the same route exists
+func (this IPRoute) Add() error {
+	data, err := this.message(false)
+	if err != nil {
+		return err
+	}
+	if _, err := netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil && !isExist(err) {
+		return wrapErrno("add "+this.String(), err)
+	}
+	return nil
+}
+
+// Delete delete the ip route, it is not an error if the route or its device does not exist
+func (this IPRoute) Delete() error {
+	data, err := this.message(true)
+	if err != nil {
+		if isNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if _, err := netlinkRequest(syscall.RTM_DELROUTE, 0, data); err != nil && !isNotExist(err) {
+		return wrapErrno("delete "+this.String(), err)
+	}
+	return nil
+}
+
+// Exists check whether the ip route is in place
+func (this IPRoute) Exists() (bool, error) {
+	routes, err := ListIPRoutes(this.IPv6, this.Table)
+	if err != nil {
+		return false, err
+	}
+	for _, route := range routes {
+		if route.Local == this.Local && route.Dst == this.Dst && route.Dev == this.Dev {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListIPRoutes list the ip routes of ipv4 or ipv6 in the table
+func ListIPRoutes(ipv6 bool, table string) ([]IPRoute, error) {
+	header := syscall.RtMsg{Family: addressFamily(ipv6)}
+	replies, err := netlinkRequest(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, structBytes(&header))
+	if err != nil {
+		return nil, wrapErrno("list "+familyName(ipv6)+" routes", err)
+	}
+	var routes []IPRoute
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.RTM_NEWROUTE || len(reply.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		routeHeader := (*syscall.RtMsg)(unsafe.Pointer(&reply.Data[0]))
+		attrs := parseAttrs(reply.Data[syscall.SizeofRtMsg:])
+		routeTable := uint32(routeHeader.Table)
+		if value, ok := attrs[syscall.RTA_TABLE]; ok {
+			routeTable = attrUint32(value)
+		}
+		if strconv.FormatUint(uint64(routeTable), 10) != table {
+			continue
+		}
+		route := IPRoute{IPv6: ipv6, Table: table, Local: routeHeader.Type == syscall.RTN_LOCAL}
+		if dst, ok := attrs[syscall.RTA_DST]; ok {
+			route.Dst = (&net.IPNet{IP: net.IP(dst), Mask: net.CIDRMask(int(routeHeader.Dst_len), len(dst)*8)}).String()
+		}
+		if oif, ok := attrs[syscall.RTA_OIF]; ok {
+			if device, err := net.InterfaceByIndex(int(attrUint32(oif))); err == nil {
+				route.Dev = device.Name
+			}
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// FlushIPRoutes delete all ip routes in the table
+func FlushIPRoutes(ipv6 bool, table string) error {
+	routes, err := ListIPRoutes(ipv6, table)
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := route.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetRouteDevice get the output interface which the kernel chooses for the destination ip, like ip route get
+func GetRouteDevice(ip string) (string, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return "", e.New("invalid ip " + strconv.Quote(ip)).WithPrefix(tagNetlink)
+	}
+	ipv6 := dst.To4() == nil
+	header := syscall.RtMsg{Family: addressFamily(ipv6), Dst_len: 128}
+	if !ipv6 {
+		header.Dst_len, dst = 32, dst.To4()
+	}
+	replies, err := netlinkRequest(syscall.RTM_GETROUTE, 0, appendAttr(structBytes(&header), syscall.RTA_DST, dst))
+	if err != nil {
+		return "", wrapErrno("get route of "+ip, err)
+	}
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.RTM_NEWROUTE || len(reply.Data) < syscall.SizeofRtMsg {
+			continue
+		}
+		if oif, ok := parseAttrs(reply.Data[syscall.SizeofRtMsg:])[syscall.RTA_OIF]; ok {
+			device, err := net.InterfaceByIndex(int(attrUint32(oif)))
+			if err != nil {
+				return "", e.New("find route device failed, ", err).WithPrefix(tagNetlink)
+			}
+			return device.Name, nil
+		}
+	}
+	return "", e.New("no route to " + ip).WithPrefix(tagNetlink)
+}
+
+// AddDummyDevice create the dummy device with the address and set it up, the existing device and address are reused
+func AddDummyDevice(name string, cidr string) error {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return e.New("invalid address "+strconv.Quote(cidr), ", ", err).WithPrefix(tagNetlink)
+	}
+	link := syscall.IfInfomsg{Family: syscall.AF_UNSPEC}
+	data := appendAttr(structBytes(&link), syscall.IFLA_IFNAME, append([]byte(name), 0))
+	data = appendAttr(data, syscall.IFLA_LINKINFO, appendAttr(nil, iflaInfoKind, []byte("dummy")))
+	if _, err := netlinkRequest(syscall.RTM_NEWLINK, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil && !isExist(err) {
+		return wrapErrno("add dummy device "+name, err)
+	}
+	device, err := net.InterfaceByName(name)
+	if err != nil {
+		return &NetlinkError{Op: "find device " + name, Errno: syscall.ENODEV}
+	}
+	ones, _ := ipNet.Mask.Size()
+	ipv6 := ip.To4() == nil
+	address := ip.To16()
+	if !ipv6 {
+		address = ip.To4()
+	}
+	addr := syscall.IfAddrmsg{Family: addressFamily(ipv6), Prefixlen: uint8(ones), Index: uint32(device.Index)}
+	data = appendAttr(structBytes(&addr), syscall.IFA_LOCAL, address)
+	data = appendAttr(data, syscall.IFA_ADDRESS, address)
+	if _, err := netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, data); err != nil && !isExist(err) {
+		return wrapErrno("add address "+cidr+" to "+name, err)
+	}
+	link = syscall.IfInfomsg{Family: syscall.AF_UNSPEC, Index: int32(device.Index), Flags: syscall.IFF_UP, Change: syscall.IFF_UP}
+	if _, err := netlinkRequest(syscall.RTM_NEWLINK, 0, structBytes(&link)); err != nil {
+		return wrapErrno("set "+name+" up", err)
+	}
+	return nil
+}
+
+// DeleteDevice delete the device, it is not an error if the device does not exist
+func DeleteDevice(name string) error {
+	link := syscall.IfInfomsg{Family: syscall.AF_UNSPEC}
+	data := appendAttr(structBytes(&link), syscall.IFLA_IFNAME, append([]byte(name), 0))
+	if _, err := netlinkRequest(syscall.RTM_DELLINK, 0, data); err != nil && !isNotExist(err) {
+		return wrapErrno("delete device "+name, err)
+	}
+	return nil
+}
+
+// ListNeighbors list the ipv4 and ipv6 neighbors which have a link layer address, like ip neigh
+func ListNeighbors() ([]Neighbor, error) {
+	header := ndMsg{Family: syscall.AF_UNSPEC}
+	replies, err := netlinkRequest(syscall.RTM_GETNEIGH, syscall.NLM_F_DUMP, structBytes(&header))
+	if err != nil {
+		return nil, wrapErrno("list neighbors", err)
+	}
+	var neighbors []Neighbor
+	for _, reply := range replies {
+		if reply.Header.Type != syscall.RTM_NEWNEIGH || len(reply.Data) < int(unsafe.Sizeof(header)) {
+			continue
+		}
+		message := *(*ndMsg)(unsafe.Pointer(&reply.Data[0]))
+		state, ok := neighborStates[message.State]
+		if !ok {
+			continue
+		}
+		attrs := parseAttrs(reply.Data[unsafe.Sizeof(header):])
+		dst, lladdr := attrs[ndaDst], attrs[ndaLladdr]
+		if len(dst) == 0 || len(lladdr) != 6 {
+			continue
+		}
+		neighbor := Neighbor{IP: net.IP(dst).String(), MAC: net.HardwareAddr(lladdr).String(), State: state}
+		if device, err := net.InterfaceByIndex(int(message.Ifindex)); err == nil {
+			neighbor.Dev = device.Name
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, nil
+}
@@ -0,0 +1,75 @@
+//go:build !linux
+
+package common
+
+import e "XrayHelper/main/errors"
+
+// Add not implement
+func (this IPRule) Add() error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Delete not implement
+func (this IPRule) Delete() error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Exists not implement
+func (this IPRule) Exists() (bool, error) {
+	return false, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// ListIPRules not implement
+func ListIPRules(ipv6 bool) ([]IPRule, error) {
+	return nil, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// DeleteIPRules not implement
+func DeleteIPRules(ipv6 bool, table string) error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Add not implement
+func (this IPRoute) Add() error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Delete not implement
+func (this IPRoute) Delete() error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// Exists not implement
+func (this IPRoute) Exists() (bool, error) {
+	return false, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// ListIPRoutes not implement
+func ListIPRoutes(ipv6 bool, table string) ([]IPRoute, error) {
+	return nil, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// FlushIPRoutes not implement
+func FlushIPRoutes(ipv6 bool, table string) error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// GetRouteDevice not implement
+func GetRouteDevice(ip string) (string, error) {
+	return "", e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// AddDummyDevice not implement
+func AddDummyDevice(name string, cidr string) error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// DeleteDevice not implement
+func DeleteDevice(name string) error {
+	return e.New("system not support netlink").WithPrefix(tagNetlink)
+}
+
+// ListNeighbors not implement
+func ListNeighbors() ([]Neighbor, error) {
+	return nil, e.New("system not support netlink").WithPrefix(tagNetlink)
+}
@@ -0,0 +1,102 @@
+//go:build linux
+
+package common_test
+
+import (
+	"XrayHelper/main/common"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestIPRule(t *testing.T) {
+	rule := common.IPRule{Table: "2333", Mark: "2333", Priority: "23333"}
+	if err := rule.Add(); errors.Is(err, syscall.EPERM) {
+		t.Skip("need CAP_NET_ADMIN to add ip rule")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer rule.Delete()
+	if err := rule.Add(); err != nil {
+		t.Errorf("add existing rule should succeed, got %v", err)
+	}
+	if exist, err := (common.IPRule{Table: "2333", Mark: "2333"}).Exists(); err != nil || !exist {
+		t.Errorf("rule should exist, got %v, %v", exist, err)
+	}
+	if err := common.DeleteIPRules(false, "2333"); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := rule.Exists(); exist {
+		t.Error("rule should be deleted")
+	}
+	if err := rule.Delete(); err != nil {
+		t.Errorf("delete missing rule should succeed, got %v", err)
+	}
+}
+
+func TestIPRuleWithoutPriority(t *testing.T) {
+	rule := common.IPRule{Table: "2334", Mark: "2334"}
+	if err := rule.Add(); errors.Is(err, syscall.EPERM) {
+		t.Skip("need CAP_NET_ADMIN to add ip rule")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer common.DeleteIPRules(false, "2334")
+	if err := rule.Add(); err != nil {
+		t.Errorf("add existing rule should succeed, got %v", err)
+	}
+	rules, err := common.ListIPRules(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, listed := range rules {
+		if listed.Table == "2334" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("add rule twice should keep one rule, got %d", count)
+	}
+}
+
+func TestIPRoute(t *testing.T) {
+	route := common.IPRoute{Table: "2333", Local: true, Dev: "lo"}
+	if err := route.Add(); errors.Is(err, syscall.EPERM) {
+		t.Skip("need CAP_NET_ADMIN to add ip route")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer route.Delete()
+	if err := route.Add(); err != nil {
+		t.Errorf("add existing route should succeed, got %v", err)
+	}
+	if exist, err := route.Exists(); err != nil || !exist {
+		t.Errorf("route should exist, got %v, %v", exist, err)
+	}
+	if err := common.FlushIPRoutes(false, "2333"); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := route.Exists(); exist {
+		t.Error("route should be flushed")
+	}
+	var netlinkErr *common.NetlinkError
+	if err := (common.IPRoute{Table: "2333", Dev: "not-a-device"}).Add(); !errors.As(err, &netlinkErr) || !errors.Is(err, syscall.ENODEV) {
+		t.Errorf("route of missing device should fail with ENODEV, got %v", err)
+	}
+	if device, err := common.GetRouteDevice("127.0.0.1"); err != nil || device != "lo" {
+		t.Errorf("route device of 127.0.0.1 should be lo, got %q, %v", device, err)
+	}
+}
+
+func TestListNeighbors(t *testing.T) {
+	neighbors, err := common.ListNeighbors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, neighbor := range neighbors {
+		if len(neighbor.IP) == 0 || len(neighbor.MAC) == 0 {
+			t.Errorf("neighbor should have ip and mac, got %+v", neighbor)
+		}
+	}
+}
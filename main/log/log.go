@@ -4,6 +4,7 @@ import (
 	"XrayHelper/main/serial"
 	"fmt"
 	"github.com/fatih/color"
+	"io"
 	"os/exec"
 	"strings"
 	"time"
@@ -11,6 +12,9 @@ import (
 
 var Verbose *bool
 
+// logFile if not nil, logs will also be written to it without color
+var logFile io.WriteCloser
+
 func init() {
 	out, err := exec.Command("/system/bin/getprop", "persist.sys.timezone").Output()
 	if err != nil {
@@ -23,10 +27,31 @@ func init() {
 	time.Local = z
 }
 
+// SetLogFile write logs to a rotated log file, maxSize is in bytes
+func SetLogFile(path string, maxSize int64, keep int) error {
+	writer, err := NewRotateWriter(path, maxSize, keep, false)
+	if err != nil {
+		return err
+	}
+	if logFile != nil {
+		_ = logFile.Close()
+	}
+	logFile = writer
+	return nil
+}
+
+// writeLogFile record log to log file
+func writeLogFile(level string, str string) {
+	if logFile != nil {
+		_, _ = fmt.Fprintln(logFile, time.Now().Format("2006-01-02 15:04:05"), level, ":", str)
+	}
+}
+
 // HandleError record error log
 func HandleError(v interface{}) {
 	if str := serial.ToString(v); str != "" {
 		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.RedString("ERROR"), ":", str)
+		writeLogFile("ERROR", str)
 	}
 }
 
@@ -34,6 +59,7 @@ func HandleError(v interface{}) {
 func HandleInfo(v interface{}) {
 	if str := serial.ToString(v); str != "" {
 		fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.GreenString("INFO"), ":", str)
+		writeLogFile("INFO", str)
 	}
 }
 
@@ -42,6 +68,7 @@ func HandleDebug(v interface{}) {
 	if *Verbose {
 		if str := serial.ToString(v); str != "" {
 			fmt.Println(time.Now().Format("2006-01-02 15:04:05"), color.BlueString("DEBUG"), ":", str)
+			writeLogFile("DEBUG", str)
 		}
 	}
 }
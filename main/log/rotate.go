@@ -0,0 +1,187 @@
+package log
+
+import (
+	e "XrayHelper/main/errors"
+	"compress/gzip"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const tagRotate = "rotate"
+
+// RotateWriter implement io.Writer, rotate the log file when it exceeds max size, rotated generations are compressed by gzip
+type RotateWriter struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	keep    int
+	file    *os.File
+	size    int64
+}
+
+// NewRotateWriter open log file in append mode, if rotateExist is true, the existing log file will be rotated as previous generation
+func NewRotateWriter(path string, maxSize int64, keep int, rotateExist bool) (*RotateWriter, error) {
+	writer := &RotateWriter{path: path, maxSize: maxSize, keep: keep}
+	if rotateExist {
+		if err := Rotate(path, keep); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write implement io.Writer
+func (this *RotateWriter) Write(p []byte) (int, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.file == nil {
+		return 0, e.New("log file " + this.path + " is closed").WithPrefix(tagRotate)
+	}
+	if this.maxSize > 0 && this.size > 0 && this.size+int64(len(p)) > this.maxSize {
+		_ = this.file.Close()
+		this.file = nil
+		if err := Rotate(this.path, this.keep); err != nil {
+			return 0, err
+		}
+		if err := this.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := this.file.Write(p)
+	this.size += int64(n)
+	return n, err
+}
+
+// Close close the log file
+func (this *RotateWriter) Close() error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	if this.file == nil {
+		return nil
+	}
+	err := this.file.Close()
+	this.file = nil
+	return err
+}
+
+func (this *RotateWriter) open() error {
+	file, err := os.OpenFile(this.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return e.New("open log file "+this.path+" failed, ", err).WithPrefix(tagRotate)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return e.New("stat log file "+this.path+" failed, ", err).WithPrefix(tagRotate)
+	}
+	this.file = file
+	this.size = info.Size()
+	return nil
+}
+
+// Rotate compress the log file to path.1.gz, older generations are shifted, keep at most keep generations
+func Rotate(path string, keep int) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return nil
+	}
+	if keep <= 0 {
+		if err := os.Truncate(path, 0); err != nil {
+			return e.New("truncate log file "+path+" failed, ", err).WithPrefix(tagRotate)
+		}
+		return nil
+	}
+	if err := shift(path, keep); err != nil {
+		return err
+	}
+	if err := compress(path, generation(path, 1)); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return e.New("remove rotated log file "+path+" failed, ", err).WithPrefix(tagRotate)
+	}
+	return nil
+}
+
+// RotateOversize rotate the log file which is written by another process if it exceeds max size, the file is compressed to path.1.gz,
+// then truncated in place rather than removed, so that the writer which opens it in append mode keeps writing to it
+func RotateOversize(path string, maxSize int64, keep int) error {
+	if maxSize <= 0 {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	// several xrayhelper processes may check the same log file, only one of them rotates it
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		return nil
+	}
+	if info, err := file.Stat(); err != nil || info.Size() <= maxSize {
+		return nil
+	}
+	if keep > 0 {
+		if err := shift(path, keep); err != nil {
+			return err
+		}
+		if err := compress(path, generation(path, 1)); err != nil {
+			return err
+		}
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		return e.New("truncate log file "+path+" failed, ", err).WithPrefix(tagRotate)
+	}
+	return nil
+}
+
+// shift remove the oldest generation, then rename generation i to i+1, so that path.1.gz is free
+func shift(path string, keep int) error {
+	_ = os.Remove(generation(path, keep))
+	for i := keep - 1; i > 0; i-- {
+		if _, err := os.Stat(generation(path, i)); err == nil {
+			if err := os.Rename(generation(path, i), generation(path, i+1)); err != nil {
+				return e.New("shift log generation failed, ", err).WithPrefix(tagRotate)
+			}
+		}
+	}
+	return nil
+}
+
+// generation get the file name of log generation
+func generation(path string, index int) string {
+	return path + "." + strconv.Itoa(index) + ".gz"
+}
+
+// compress compress src to gzip file dst
+func compress(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return e.New("open log file "+src+" failed, ", err).WithPrefix(tagRotate)
+	}
+	defer func(srcFile *os.File) {
+		_ = srcFile.Close()
+	}(srcFile)
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return e.New("open log generation "+dst+" failed, ", err).WithPrefix(tagRotate)
+	}
+	defer func(dstFile *os.File) {
+		_ = dstFile.Close()
+	}(dstFile)
+	gzipWriter := gzip.NewWriter(dstFile)
+	if _, err := io.Copy(gzipWriter, srcFile); err != nil {
+		_ = gzipWriter.Close()
+		return e.New("compress log file "+src+" failed, ", err).WithPrefix(tagRotate)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return e.New("compress log file "+src+" failed, ", err).WithPrefix(tagRotate)
+	}
+	return nil
+}
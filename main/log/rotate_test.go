@@ -0,0 +1,69 @@
+package log_test
+
+import (
+	"XrayHelper/main/log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRotateWriter(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "error.log")
+	if err := os.WriteFile(logPath, []byte("previous run\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writer, err := log.NewRotateWriter(logPath, 64, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	line := strings.Repeat("x", 40) + "\n"
+	for i := 0; i < 4; i++ {
+		if _, err := writer.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, generation := range []string{logPath, logPath + ".1.gz", logPath + ".2.gz"} {
+		if _, err := os.Stat(generation); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(logPath + ".3.gz"); err == nil {
+		t.Error("should keep at most 2 generations")
+	}
+}
+
+func TestRotateOversize(t *testing.T) {
+	logPath := path.Join(t.TempDir(), "tun2socks.log")
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(strings.Repeat("x", 40) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.RotateOversize(logPath, 64, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logPath + ".1.gz"); err == nil {
+		t.Error("log file under max size should not be rotated")
+	}
+	if _, err := file.WriteString(strings.Repeat("y", 40) + "\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.RotateOversize(logPath, 64, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(logPath + ".1.gz"); err != nil {
+		t.Error(err)
+	}
+	// the writer keeps appending to the truncated file
+	if _, err := file.WriteString("z\n"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(logPath); err != nil || string(content) != "z\n" {
+		t.Errorf("log file should be truncated in place, got %q, %v", content, err)
+	}
+}
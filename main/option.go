@@ -14,6 +14,7 @@ var Option struct {
 	BypassSelf       bool   `short:"b" long:"bypass-self" description:"bypass xrayhelper self network traffic (tproxy only)"`
 	ConfigFilePath   string `short:"c" long:"config" default:"/data/adb/xray/xrayhelper.yml" description:"specify configuration file"`
 	CoreStartTimeout int    `short:"t" long:"core-start-timeout" default:"15" description:"core listen check timeout (second)"`
+	StopTimeout      int    `short:"s" long:"stop-timeout" default:"5" description:"graceful stop timeout before kill core and tun2socks (second)"`
 	VerboseFlag      bool   `short:"v" long:"verbose" description:"show verbose debug information"`
 	VersionFlag      bool   `short:"V" long:"version" description:"show current version"`
 
@@ -21,6 +22,10 @@ var Option struct {
 	Proxy   commands.ProxyCommand   `command:"proxy" description:"control system proxy"`
 	Update  commands.UpdateCommand  `command:"update" description:"update core, tun2socks, geodata, yacd-meta or subscribe"`
 	Switch  commands.SwitchCommand  `command:"switch" description:"switch proxy node or clash config"`
+	Check   commands.CheckCommand   `command:"check" description:"check xrayhelper config"`
+	Profile commands.ProfileCommand `command:"profile" description:"list, use or show current profile"`
+	Watch   commands.WatchCommand   `command:"watch" description:"watch config changes and reapply them"`
+	Policy  commands.PolicyCommand  `command:"policy" description:"monitor network changes and apply proxy policies"`
 }
 
 // LoadOption load Option, the program entry
@@ -34,6 +39,7 @@ func LoadOption() int {
 	log.Verbose = &Option.VerboseFlag
 	builds.ConfigFilePath = &Option.ConfigFilePath
 	builds.CoreStartTimeout = &Option.CoreStartTimeout
+	builds.StopTimeout = &Option.StopTimeout
 	builds.BypassSelf = &Option.BypassSelf
 	rCode := 0
 	parser := flags.NewParser(&Option, flags.HelpFlag|flags.PassDoubleDash)
@@ -2,6 +2,8 @@ package proxies
 
 import (
 	e "XrayHelper/main/errors"
+	"XrayHelper/main/proxies/redirect"
+	"XrayHelper/main/proxies/tools"
 	"XrayHelper/main/proxies/tproxy"
 	"XrayHelper/main/proxies/tun"
 )
@@ -12,12 +14,17 @@ const tagProxies = "proxies"
 type ProxyMethod interface {
 	Enable() error
 	Disable()
+	Enabled() bool
+	Ruleset() (tools.Ruleset, error)
+	Routes() []tools.Route
 }
 
 func NewProxy(method string) (ProxyMethod, error) {
 	switch method {
 	case "tproxy":
 		return new(tproxy.Tproxy), nil
+	case "redirect":
+		return new(redirect.Redirect), nil
 	case "tun", "tun2socks":
 		return new(tun.Tun), nil
 	default:
@@ -0,0 +1,263 @@
+package redirect
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"XrayHelper/main/proxies/tools"
+	"XrayHelper/main/proxies/tun"
+)
+
+const tagRedirect = "redirect"
+
+// the chains of redirect, prerouting chain redirects the traffic from ApList, output chain redirects the local traffic
+const (
+	preroutingChain = tools.ChainPrefix + "REDIRECT_PRE"
+	outputChain     = tools.ChainPrefix + "REDIRECT_OUT"
+)
+
+// Redirect redirect tcp traffic to the redir port of core by nat table, it works on the kernels without TPROXY,
+// udp traffic can be sent to tun2socks optionally
+type Redirect struct{}
+
+func (this *Redirect) Enable() error {
+	if builds.Config.Proxy.RedirectUDP {
+		if err := tun.EnableUDP(); err != nil {
+			this.Disable()
+			return err
+		}
+	}
+	rules, err := this.Ruleset()
+	if err != nil {
+		this.Disable()
+		return err
+	}
+	// all rules are committed at once, nothing is left if commit fails
+	if tools.UseNftables() {
+		err = tools.ApplyNftables(rules)
+	} else {
+		err = tools.RestoreRuleset(rules)
+	}
+	if err != nil {
+		this.Disable()
+		return err
+	}
+	return nil
+}
+
+func (this *Redirect) Disable() {
+	cleanIptablesChain(false)
+	//always clean ipv6 rules
+	cleanIptablesChain(true)
+	//always clean udp rules, redirectUDP may be changed after rules are applied
+	tun.DisableUDP()
+	//always clean rules of both firewalls, the firewall may be changed after rules are applied
+	tools.CleanNftables()
+	//always destroy bypass ipsets after the rules which match them are deleted
+	tools.CleanBypassSets()
+	//always clean dns rules
+	tools.CleanDNS()
+}
+
+// Enabled check whether the redirect rules are applied
+func (this *Redirect) Enabled() bool {
+	if tools.UseNftables() {
+		return tools.NftablesEnabled()
+	}
+	if common.Ipt == nil {
+		return false
+	}
+	if exist, err := common.Ipt.ChainExists("nat", preroutingChain); err != nil || !exist {
+		return false
+	}
+	if exist, err := common.Ipt.ChainExists("nat", outputChain); err != nil || !exist {
+		return false
+	}
+	return true
+}
+
+// Ruleset get all rules of redirect, include the udp rules of tun2socks and dns rules
+func (this *Redirect) Ruleset() (tools.Ruleset, error) {
+	rules, err := familyRuleset(false)
+	if err != nil {
+		return nil, err
+	}
+	if builds.Config.Proxy.EnableIPv6 {
+		rules6, err := familyRuleset(true)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rules6...)
+	}
+	if builds.Config.Proxy.RedirectUDP {
+		udpRules, err := tun.UDPRuleset()
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, udpRules...)
+	}
+	return append(rules, tools.DNSRuleset()...), nil
+}
+
+// Routes get the ip rules and routes of redirect, only tun2socks which proxy udp traffic need routes
+func (this *Redirect) Routes() []tools.Route {
+	if builds.Config.Proxy.RedirectUDP {
+		return tun.UDPRoutes()
+	}
+	return nil
+}
+
+// familyRuleset get redirect rules of ipv4 or ipv6
+func familyRuleset(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	rules.Append(ipv6, "nat", "PREROUTING", "apply nat chain "+preroutingChain+" to PREROUTING", "-j", preroutingChain)
+	rules.Append(ipv6, "nat", "OUTPUT", "apply nat chain "+outputChain+" to OUTPUT", "-j", outputChain)
+	rules = append(rules, preroutingChainRules(ipv6)...)
+	proxyRules, err := proxyChainRules(ipv6)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, proxyRules...).Tag("redirect"), nil
+}
+
+// proxyChainRules get the rules of output chain, which redirect local tcp traffic
+func proxyChainRules(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	proxy := func(desc string, spec ...string) {
+		rules.Append(ipv6, "nat", outputChain, desc, spec...)
+	}
+	redirect := []string{"-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort}
+	// redirect all tcp dns request if dns is hijacked by tproxy, udp dns request is marked by tun2socks rules
+	if builds.GetDNSHijack() == "tproxy" {
+		proxy("redirect all dns request", append([]string{"-p", "tcp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53"}, redirect...)...)
+	}
+	// allow IntraList
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if ipv6 == common.IsIPv6(intra) {
+			proxy("allow intra "+intra, append([]string{"-p", "tcp", "-d", intra}, redirect...)...)
+		}
+	}
+	// bypass PkgList
+	if len(builds.Config.Proxy.PkgList) > 0 && builds.Config.Proxy.Mode == "blacklist" {
+		for _, pkg := range builds.Config.Proxy.PkgList {
+			uids, err := tools.GetUids(pkg)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			matches, err := tools.GetPackageMatches(pkg, false)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				for _, match := range matches {
+					proxy("bypass package "+pkg, match.Spec(uid, "-j", "RETURN")...)
+				}
+			}
+		}
+	}
+	// bypass ignore list
+	for _, ignore := range builds.Config.Proxy.IgnoreList {
+		proxy("apply ignore interface "+ignore, "-o", ignore, "-j", "RETURN")
+	}
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		proxy("bypass lists", tools.BypassSpec(ipv6)...)
+	}
+	// bypass intraNet list
+	for _, intraIp := range intraNet(ipv6) {
+		proxy("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
+	}
+	// bypass Core itself
+	proxy("bypass core gid", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN")
+	// start processing proxy rules
+	// if PkgList has no package, should proxy everything
+	if len(builds.Config.Proxy.PkgList) == 0 || builds.Config.Proxy.Mode == "blacklist" {
+		proxy("create local applications proxy", append([]string{"-p", "tcp"}, redirect...)...)
+	} else if builds.Config.Proxy.Mode == "whitelist" {
+		// allow PkgList
+		for _, pkg := range builds.Config.Proxy.PkgList {
+			uids, err := tools.GetUids(pkg)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			matches, err := tools.GetPackageMatches(pkg, true)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				for _, match := range matches {
+					// udp traffic cannot be redirected, it is handled by tun2socks
+					if match.Proto[1] != "tcp" {
+						continue
+					}
+					proxy("create package "+pkg+" proxy", match.Spec(uid, redirect...)...)
+				}
+			}
+		}
+		// allow root user(eg: magisk, ksud, netd...)
+		proxy("create root user proxy", append([]string{"-p", "tcp", "-m", "owner", "--uid-owner", "0"}, redirect...)...)
+		// allow dns_tether user(eg: dnsmasq...)
+		proxy("create dns_tether user proxy", append([]string{"-p", "tcp", "-m", "owner", "--uid-owner", "1052"}, redirect...)...)
+	} else {
+		return nil, e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagRedirect)
+	}
+	return rules, nil
+}
+
+// preroutingChainRules get the rules of prerouting chain, which redirect tcp traffic from ApList
+func preroutingChainRules(ipv6 bool) tools.Ruleset {
+	var rules tools.Ruleset
+	xray := func(desc string, spec ...string) {
+		rules.Append(ipv6, "nat", preroutingChain, desc, spec...)
+	}
+	redirect := []string{"-j", "REDIRECT", "--to-ports", builds.Config.Proxy.RedirectPort}
+	// redirect all tcp dns request if dns is hijacked by tproxy
+	if builds.GetDNSHijack() == "tproxy" {
+		for _, ap := range builds.Config.Proxy.ApList {
+			xray("redirect all dns request", append([]string{"-p", "tcp", "-i", ap, "--dport", "53"}, redirect...)...)
+		}
+	}
+	// bypass the denied ap clients
+	for _, source := range tools.BypassedApSources(ipv6) {
+		xray("bypass "+source.String(), source.Spec("", "-j", "RETURN")...)
+	}
+	// allow ApList to IntraList
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		for _, intra := range builds.Config.Proxy.IntraList {
+			if ipv6 == common.IsIPv6(intra) {
+				xray("allow intra "+intra, source.Spec("tcp", append([]string{"-d", intra}, redirect...)...)...)
+			}
+		}
+	}
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		xray("bypass lists", tools.BypassSpec(ipv6)...)
+	}
+	// bypass intraNet list
+	for _, intraIp := range intraNet(ipv6) {
+		xray("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
+	}
+	// trans ApList to prerouting chain
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		xray("create "+source.String()+" proxy", source.Spec("tcp", redirect...)...)
+	}
+	return rules
+}
+
+// intraNet get the intranet address list of ipv4 or ipv6
+func intraNet(ipv6 bool) []string {
+	if ipv6 {
+		return common.IntraNet6
+	}
+	return common.IntraNet
+}
+
+// cleanIptablesChain Clean all iptables rules tagged by redirect, whatever config creates them
+func cleanIptablesChain(ipv6 bool) {
+	tools.CleanIptables(ipv6, "redirect")
+}
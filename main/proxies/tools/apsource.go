@@ -0,0 +1,70 @@
+package tools
+
+import "XrayHelper/main/builds"
+
+// ApSource the source of ap traffic, it is an ap interface, or a client on the ap interface if Client is not nil
+type ApSource struct {
+	Interface string
+	Client    *builds.ApClient
+}
+
+// Spec build the rule spec of the source, eg: -p tcp -i wlan2 -m mac --mac-source AA:BB:CC:DD:EE:FF -j RETURN,
+// proto is omitted if it is empty
+func (this ApSource) Spec(proto string, target ...string) []string {
+	var spec []string
+	if len(proto) > 0 {
+		spec = append(spec, "-p", proto)
+	}
+	spec = append(spec, "-i", this.Interface)
+	if this.Client != nil {
+		if len(this.Client.MAC) > 0 {
+			spec = append(spec, "-m", "mac", "--mac-source", this.Client.MAC)
+		} else {
+			spec = append(spec, "-s", this.Client.CIDR)
+		}
+	}
+	return append(spec, target...)
+}
+
+// String describe the source, eg: ap client AA:BB:CC:DD:EE:FF on wlan2
+func (this ApSource) String() string {
+	if this.Client != nil {
+		return "ap client " + this.Client.Entry + " on " + this.Interface
+	}
+	return "ap interface " + this.Interface
+}
+
+// apClientSources get the sources of apClients on every ap interface, the IP/CIDR client of the other family is skipped
+func apClientSources(ipv6 bool) []ApSource {
+	var sources []ApSource
+	clients := builds.GetApClients()
+	for _, ap := range builds.Config.Proxy.ApList {
+		for i := range clients {
+			if len(clients[i].MAC) == 0 && clients[i].IPv6 != ipv6 {
+				continue
+			}
+			sources = append(sources, ApSource{Interface: ap, Client: &clients[i]})
+		}
+	}
+	return sources
+}
+
+// ProxiedApSources get the ap sources which are proxied, they are the allowed clients in allow mode, otherwise the whole ap interfaces
+func ProxiedApSources(ipv6 bool) []ApSource {
+	if builds.ApClientAllowMode() {
+		return apClientSources(ipv6)
+	}
+	var sources []ApSource
+	for _, ap := range builds.Config.Proxy.ApList {
+		sources = append(sources, ApSource{Interface: ap})
+	}
+	return sources
+}
+
+// BypassedApSources get the ap sources which are bypassed before any proxy rule, they are the denied clients in deny mode
+func BypassedApSources(ipv6 bool) []ApSource {
+	if builds.ApClientAllowMode() {
+		return nil
+	}
+	return apClientSources(ipv6)
+}
@@ -0,0 +1,196 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// bypass set names, they are ipset names with iptables, or set names of XrayHelper table with nftables
+const (
+	bypassSet  = "xrayhelper_bypass"
+	bypassSet6 = "xrayhelper_bypass6"
+	// bypassSetMaxElem geoip:cn has about ten thousand ipv4 CIDR, the default maxelem 65536 of ipset may be not enough for other lists
+	bypassSetMaxElem = "262144"
+)
+
+// bypassSetName get the bypass set name of ipv4 or ipv6
+func bypassSetName(ipv6 bool) string {
+	if ipv6 {
+		return bypassSet6
+	}
+	return bypassSet
+}
+
+// BypassEnabled whether proxy.bypassLists is configured
+func BypassEnabled() bool {
+	return len(builds.Config.Proxy.BypassLists) > 0
+}
+
+// BypassSpec get the rule spec which return the traffic to the destination in bypass set
+func BypassSpec(ipv6 bool) []string {
+	return []string{"-m", "set", "--match-set", bypassSetName(ipv6), "dst", "-j", "RETURN"}
+}
+
+// UseBypassSets whether the ruleset matches the bypass sets, the methods which do not emit BypassSpec do not need them
+func UseBypassSets(ruleset Ruleset) bool {
+	for _, rule := range ruleset {
+		for i := 0; i+1 < len(rule.Spec); i++ {
+			if rule.Spec[i] == "--match-set" && (rule.Spec[i+1] == bypassSet || rule.Spec[i+1] == bypassSet6) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoadBypassLists load the CIDR of proxy.bypassLists, the entry is a CIDR file or geoip:category which is extracted from geoip.dat in dataDir,
+// the list which cannot be loaded is skipped
+func LoadBypassLists() (cidrs []string, cidrs6 []string) {
+	for _, bypassList := range builds.Config.Proxy.BypassLists {
+		var listCidrs []string
+		var err error
+		if category, ok := strings.CutPrefix(bypassList, "geoip:"); ok {
+			listCidrs, err = common.LoadGeoIP(path.Join(builds.Config.XrayHelper.DataDir, "geoip.dat"), category)
+		} else {
+			listCidrs, err = loadCidrFile(bypassList)
+		}
+		if err != nil {
+			log.HandleError(err)
+			log.HandleError("bypass list " + bypassList + " is skipped")
+			continue
+		}
+		for _, cidr := range listCidrs {
+			if common.IsIPv6(cidr) {
+				cidrs6 = append(cidrs6, cidr)
+			} else {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+		log.HandleDebug("load " + strconv.Itoa(len(listCidrs)) + " CIDR from bypass list " + bypassList)
+	}
+	return cidrs, cidrs6
+}
+
+// loadCidrFile read the CIDR file, one CIDR or ip per line, the line starts with # is comment
+func loadCidrFile(cidrPath string) ([]string, error) {
+	cidrFile, err := os.Open(cidrPath)
+	if err != nil {
+		return nil, e.New("open bypass list failed, ", err).WithPrefix(tagTools)
+	}
+	defer cidrFile.Close()
+	var cidrs []string
+	scanner := bufio.NewScanner(cidrFile)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(line); err != nil {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, e.New("invalid CIDR " + strconv.Quote(line) + " in " + cidrPath).WithPrefix(tagTools)
+			}
+			// single ip is converted to CIDR, so that its family can be told by common.IsIPv6
+			if ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		cidrs = append(cidrs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, e.New("read bypass list failed, ", err).WithPrefix(tagTools)
+	}
+	return cidrs, nil
+}
+
+// ipsetScript generate the ipset restore script, the new content is filled into a temporary set then swapped in, so the set is replaced atomically
+func ipsetScript(name string, family string, cidrs []string) string {
+	var script strings.Builder
+	tmpName := name + "_tmp"
+	script.WriteString("create " + name + " hash:net family " + family + " maxelem " + bypassSetMaxElem + " -exist\n")
+	script.WriteString("create " + tmpName + " hash:net family " + family + " maxelem " + bypassSetMaxElem + " -exist\n")
+	script.WriteString("flush " + tmpName + "\n")
+	for _, cidr := range cidrs {
+		script.WriteString("add " + tmpName + " " + cidr + " -exist\n")
+	}
+	script.WriteString("swap " + tmpName + " " + name + "\n")
+	script.WriteString("destroy " + tmpName + "\n")
+	return script.String()
+}
+
+// nftSetElementScript generate the nftables script which replace the elements of bypass sets, ipv6 set only exists when ipv6 proxy is enabled
+func nftSetElementScript(cidrs []string, cidrs6 []string) string {
+	var script strings.Builder
+	sets := []struct {
+		name  string
+		cidrs []string
+	}{{bypassSet, cidrs}}
+	if builds.Config.Proxy.EnableIPv6 {
+		sets = append(sets, struct {
+			name  string
+			cidrs []string
+		}{bypassSet6, cidrs6})
+	}
+	for _, set := range sets {
+		script.WriteString("flush set inet " + NftTable + " " + set.name + "\n")
+		if len(set.cidrs) > 0 {
+			script.WriteString("add element inet " + NftTable + " " + set.name + " { " + strings.Join(set.cidrs, ", ") + " }\n")
+		}
+	}
+	return script.String()
+}
+
+// ApplyBypassSets load bypass lists into the ipsets, or into the sets of XrayHelper table with nftables, the old content is replaced atomically
+func ApplyBypassSets() error {
+	if !BypassEnabled() {
+		return nil
+	}
+	cidrs, cidrs6 := LoadBypassLists()
+	scriptPath := path.Join(builds.Config.XrayHelper.RunDir, "bypass.sets")
+	var script string
+	var load common.External
+	var errMsg bytes.Buffer
+	if UseNftables() {
+		// the sets are created with XrayHelper table, only refresh the elements here
+		script = nftSetElementScript(cidrs, cidrs6)
+		load = common.NewExternal(0, nil, &errMsg, "nft", "-f", scriptPath)
+	} else {
+		if _, err := exec.LookPath("ipset"); err != nil {
+			return e.New("ipset not found, bypass lists need ipset with iptables firewall, install ipset or set proxy.firewall to nftables").WithPrefix(tagTools)
+		}
+		script = ipsetScript(bypassSet, "inet", cidrs) + ipsetScript(bypassSet6, "inet6", cidrs6)
+		load = common.NewExternal(0, nil, &errMsg, "ipset", "-file", scriptPath, "restore")
+	}
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		return e.New("write bypass sets script failed, ", err).WithPrefix(tagTools)
+	}
+	load.Run()
+	if load.Err() != nil {
+		return e.New("load bypass sets script "+scriptPath+" failed, ", load.Err(), ", "+errMsg.String()).WithPrefix(tagTools)
+	}
+	log.HandleDebug("load " + strconv.Itoa(len(cidrs)) + " ipv4 CIDR and " + strconv.Itoa(len(cidrs6)) + " ipv6 CIDR into bypass sets")
+	return nil
+}
+
+// CleanBypassSets destroy the ipsets, it should be called after the rules which match them are deleted, nftables sets are deleted with XrayHelper table
+func CleanBypassSets() {
+	for _, name := range []string{bypassSet, bypassSet6} {
+		var errMsg bytes.Buffer
+		common.NewExternal(0, nil, &errMsg, "ipset", "destroy", name).Run()
+		if errMsg.Len() > 0 {
+			log.HandleDebug("destroy ipset " + name + ": " + errMsg.String())
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package tools
+
+import (
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"net"
+	"slices"
+	"strings"
+)
+
+// ChainPrefix the prefix of the chains created by XrayHelper, so that they do not collide with the chains of other proxy modules,
+// the chain of component id is named ChainPrefix + upper case id, eg: XRAYHELPER_TPROXY_PRE
+const ChainPrefix = "XRAYHELPER_"
+
+// tagPrefix the comment prefix of the rules created by XrayHelper, the comment is xrayhelper:<id>, id is the component which creates the rule
+const tagPrefix = "xrayhelper:"
+
+// cleanupTables the iptables tables which are scanned for XrayHelper rules and chains
+var cleanupTables = []string{"raw", "mangle", "nat", "filter"}
+
+// Artifact a rule, chain, table, set, route or device left by XrayHelper
+type Artifact struct {
+	Desc   string
+	remove func() error
+}
+
+// Remove remove the artifact from system
+func (this Artifact) Remove() error {
+	return this.remove()
+}
+
+// hasTag whether the rule spec has the comment of component id, any XrayHelper comment matches if id is empty
+func hasTag(spec []string, id string) bool {
+	for i := 0; i+1 < len(spec); i++ {
+		if spec[i] == "--comment" && strings.HasPrefix(spec[i+1], tagPrefix) {
+			return len(id) == 0 || spec[i+1] == tagPrefix+id
+		}
+	}
+	return false
+}
+
+// ownChain whether the chain is created by component id, any XrayHelper chain matches if id is empty
+func ownChain(chain string, id string) bool {
+	if len(id) == 0 {
+		return strings.HasPrefix(chain, ChainPrefix)
+	}
+	prefix := ChainPrefix + strings.ToUpper(id)
+	return chain == prefix || strings.HasPrefix(chain, prefix+"_")
+}
+
+// iptablesArtifacts scan the tagged rules in builtin chains and the chains of component id, the rules come before the chains,
+// because they may jump to the chains
+func iptablesArtifacts(ipv6 bool, id string) ([]Artifact, error) {
+	currentIpt, err := getIptables(ipv6)
+	if err != nil {
+		return nil, err
+	}
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	var rules, chains []Artifact
+	for _, table := range cleanupTables {
+		tableChains, err := currentIpt.ListChains(table)
+		if err != nil {
+			// the table is not supported by kernel
+			log.HandleDebug("list chains of " + table + ": " + err.Error())
+			continue
+		}
+		for _, chain := range tableChains {
+			if ownChain(chain, id) {
+				chains = append(chains, Artifact{Desc: family + " " + table + " chain " + chain, remove: func() error {
+					return currentIpt.ClearAndDeleteChain(table, chain)
+				}})
+				continue
+			}
+			if !builtinChains[chain] {
+				continue
+			}
+			lines, err := currentIpt.List(table, chain)
+			if err != nil {
+				return nil, e.New("list chain "+chain+" failed, ", err).WithPrefix(tagTools)
+			}
+			for _, line := range lines {
+				spec := splitRule(line)
+				if len(spec) < 2 || spec[0] != "-A" || !hasTag(spec, id) {
+					continue
+				}
+				rule := Rule{IPv6: ipv6, Table: table, Chain: chain, Spec: spec[2:]}
+				rules = append(rules, Artifact{Desc: rule.Key(), remove: func() error {
+					return currentIpt.Delete(rule.Table, rule.Chain, rule.Spec...)
+				}})
+			}
+		}
+	}
+	return append(rules, chains...), nil
+}
+
+// legacyChains the chains created by XrayHelper before they are named by ChainPrefix, keyed by table
+var legacyChains = map[string][]string{
+	"mangle": {"XRAY", "PROXY", "XD", "DUMMY", "XT", "TUN2SOCKS"},
+	"nat":    {"PROXY", "XRAY_REDIRECT", "PROXY_REDIRECT"},
+	"filter": {"BLOCK_QUIC"},
+}
+
+// isLegacyRule whether the untagged rule of builtin chain is created by XrayHelper before rules are tagged,
+// they are the rules which jump to legacy chains and the dns rules
+func isLegacyRule(table string, chain string, spec []string) bool {
+	if hasTag(spec, "") {
+		return false
+	}
+	for i := 0; i+1 < len(spec); i++ {
+		if spec[i] == "-j" && slices.Contains(legacyChains[table], spec[i+1]) {
+			return len(spec) == 2
+		}
+	}
+	if chain != "OUTPUT" {
+		return false
+	}
+	canonical := canonicalSpec(spec)
+	var legacySpecs []string
+	switch table {
+	case "filter":
+		legacySpecs = []string{
+			"-p udp --dport 53 -j REJECT",
+			"-p tcp --dport 53 -j REJECT",
+			"-p tcp -m owner ! --gid-owner " + common.CoreGid + " --dport 853 -j REJECT --reject-with tcp-reset",
+		}
+	case "nat":
+		// the dns port is configurable, take it from the rule
+		destination := ""
+		for i := 0; i+1 < len(spec); i++ {
+			if spec[i] == "--to-destination" && strings.HasPrefix(spec[i+1], "127.0.0.1:") {
+				destination = spec[i+1]
+			}
+		}
+		if len(destination) == 0 {
+			return false
+		}
+		for _, proto := range []string{"udp", "tcp"} {
+			for _, dport := range []string{"53", "853"} {
+				legacySpecs = append(legacySpecs, "-p "+proto+" -m owner ! --gid-owner "+common.CoreGid+" --dport "+dport+" -j DNAT --to-destination "+destination)
+			}
+		}
+	}
+	for _, legacySpec := range legacySpecs {
+		if canonicalSpec(strings.Fields(legacySpec)) == canonical {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyIptablesArtifacts scan the legacy chains and the untagged rules created by XrayHelper before chains are named by ChainPrefix,
+// the rules come before the chains
+func legacyIptablesArtifacts(ipv6 bool) ([]Artifact, error) {
+	currentIpt, err := getIptables(ipv6)
+	if err != nil {
+		return nil, err
+	}
+	family := "ipv4"
+	if ipv6 {
+		family = "ipv6"
+	}
+	var rules, chains []Artifact
+	for _, table := range cleanupTables {
+		tableChains, err := currentIpt.ListChains(table)
+		if err != nil {
+			continue
+		}
+		for _, chain := range tableChains {
+			if slices.Contains(legacyChains[table], chain) {
+				chains = append(chains, Artifact{Desc: family + " " + table + " legacy chain " + chain, remove: func() error {
+					return currentIpt.ClearAndDeleteChain(table, chain)
+				}})
+				continue
+			}
+			if !builtinChains[chain] {
+				continue
+			}
+			lines, err := currentIpt.List(table, chain)
+			if err != nil {
+				return nil, e.New("list chain "+chain+" failed, ", err).WithPrefix(tagTools)
+			}
+			for _, line := range lines {
+				spec := splitRule(line)
+				if len(spec) < 2 || spec[0] != "-A" || !isLegacyRule(table, chain, spec[2:]) {
+					continue
+				}
+				rule := Rule{IPv6: ipv6, Table: table, Chain: chain, Spec: spec[2:]}
+				rules = append(rules, Artifact{Desc: "legacy " + rule.Key(), remove: func() error {
+					return currentIpt.Delete(rule.Table, rule.Chain, rule.Spec...)
+				}})
+			}
+		}
+	}
+	return append(rules, chains...), nil
+}
+
+// CleanIptables delete the rules tagged with component id in builtin chains and the chains of component id,
+// whatever config creates them
+func CleanIptables(ipv6 bool, id string) {
+	artifacts, err := iptablesArtifacts(ipv6, id)
+	if err != nil {
+		log.HandleDebug(err)
+		return
+	}
+	for _, artifact := range artifacts {
+		if err := artifact.Remove(); err != nil {
+			log.HandleDebug("remove " + artifact.Desc + ": " + err.Error())
+		}
+	}
+}
+
+// ScanArtifacts find everything XrayHelper may leave, include the tagged iptables rules and XrayHelper chains of all tables, the legacy ones of old versions if legacy is set,
+// the nftables table, the bypass ipsets, the ip rules and routes of tproxy, tun and dummy tables, and the dummy device
+func ScanArtifacts(legacy bool) []Artifact {
+	var artifacts []Artifact
+	for _, ipv6 := range []bool{false, true} {
+		if iptablesArtifact, err := iptablesArtifacts(ipv6, ""); err == nil {
+			artifacts = append(artifacts, iptablesArtifact...)
+		} else {
+			log.HandleDebug(err)
+		}
+		// legacy chains have generic names, they are only removed when asked
+		if !legacy {
+			continue
+		}
+		if legacyArtifact, err := legacyIptablesArtifacts(ipv6); err == nil {
+			artifacts = append(artifacts, legacyArtifact...)
+		} else {
+			log.HandleDebug(err)
+		}
+	}
+	if NftablesEnabled() {
+		artifacts = append(artifacts, Artifact{Desc: "nftables table inet " + NftTable, remove: func() error {
+			var errMsg bytes.Buffer
+			nft := common.NewExternal(0, nil, &errMsg, "nft", "delete", "table", "inet", NftTable)
+			nft.Run()
+			if nft.Err() != nil {
+				return e.New("delete nftables table failed, ", nft.Err(), ", "+errMsg.String()).WithPrefix(tagTools)
+			}
+			return nil
+		}})
+	}
+	// ipsets are destroyed after the rules which match them
+	for _, name := range []string{bypassSet, bypassSet6} {
+		list := common.NewExternal(0, nil, nil, "ipset", "-n", "list", name)
+		list.Run()
+		if list.Err() != nil {
+			continue
+		}
+		artifacts = append(artifacts, Artifact{Desc: "ipset " + name, remove: func() error {
+			var errMsg bytes.Buffer
+			destroy := common.NewExternal(0, nil, &errMsg, "ipset", "destroy", name)
+			destroy.Run()
+			if destroy.Err() != nil {
+				return e.New("destroy ipset "+name+" failed, ", destroy.Err(), ", "+errMsg.String()).WithPrefix(tagTools)
+			}
+			return nil
+		}})
+	}
+	tables := []string{common.TproxyTableId, common.TunTableId, common.DummyTableId}
+	for _, ipv6 := range []bool{false, true} {
+		if rules, err := common.ListIPRules(ipv6); err == nil {
+			for _, rule := range rules {
+				for _, table := range tables {
+					if rule.Table == table {
+						artifacts = append(artifacts, Artifact{Desc: rule.String(), remove: rule.Delete})
+					}
+				}
+			}
+		} else {
+			log.HandleDebug(err)
+		}
+		for _, table := range tables {
+			routes, err := common.ListIPRoutes(ipv6, table)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, route := range routes {
+				artifacts = append(artifacts, Artifact{Desc: route.String(), remove: route.Delete})
+			}
+		}
+	}
+	if _, err := net.InterfaceByName(common.DummyDevice); err == nil {
+		artifacts = append(artifacts, Artifact{Desc: "dummy device " + common.DummyDevice, remove: func() error {
+			return common.DeleteDevice(common.DummyDevice)
+		}})
+	}
+	return artifacts
+}
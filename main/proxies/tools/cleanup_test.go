@@ -0,0 +1,64 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCleanupMatch(t *testing.T) {
+	spec := splitRule(`-A OUTPUT -p tcp -m comment --comment "xrayhelper:dns" -j REJECT --reject-with tcp-reset`)
+	if !hasTag(spec, "dns") || !hasTag(spec, "") || hasTag(spec, "tproxy") {
+		t.Errorf("unexpected tag match of %q", spec)
+	}
+	if hasTag(strings.Fields("-A OUTPUT -m comment --comment other -j RETURN"), "") {
+		t.Error("rule without XrayHelper comment should not match")
+	}
+	cases := []struct {
+		chain    string
+		id       string
+		expected bool
+	}{
+		{"XRAYHELPER_TPROXY_PRE", "tproxy", true},
+		{"XRAYHELPER_QUIC", "quic", true},
+		{"XRAYHELPER_TUN_OUT", "tun", true},
+		{"XRAYHELPER_TUN_OUT", "", true},
+		{"XRAYHELPER_TPROXY_PRE", "tun", false},
+		{"XRAYHELPER_TUNNEL", "tun", false},
+		{"XRAY", "", false},
+	}
+	for _, c := range cases {
+		if ownChain(c.chain, c.id) != c.expected {
+			t.Errorf("%s of %q should be %v", c.chain, c.id, c.expected)
+		}
+	}
+}
+
+func TestLegacyRule(t *testing.T) {
+	cases := []struct {
+		table    string
+		line     string
+		expected bool
+	}{
+		{"mangle", "-A PREROUTING -j XRAY", true},
+		{"mangle", "-A OUTPUT -j PROXY", true},
+		{"nat", "-A OUTPUT -j PROXY", true},
+		{"mangle", "-A OUTPUT -j XT", true},
+		{"nat", "-A PREROUTING -j XRAY_REDIRECT", true},
+		{"filter", "-A OUTPUT -j BLOCK_QUIC", true},
+		{"nat", "-A PREROUTING -j XRAY", false},
+		{"mangle", "-A PREROUTING -i wlan0 -j XRAY", false},
+		{"nat", "-A OUTPUT -p udp -m owner ! --gid-owner 3005 -m udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533", true},
+		{"nat", "-A OUTPUT -p udp -m owner ! --gid-owner 3005 -m udp --dport 53 -j DNAT --to-destination 10.0.0.1:53", false},
+		{"nat", `-A OUTPUT -p udp -m owner ! --gid-owner 3005 -m udp --dport 53 -m comment --comment "xrayhelper:dns" -j DNAT --to-destination 127.0.0.1:65533`, false},
+		{"filter", "-A OUTPUT -p udp -m udp --dport 53 -j REJECT --reject-with icmp6-port-unreachable", true},
+		{"filter", "-A OUTPUT -p tcp -m owner ! --gid-owner 3005 -m tcp --dport 853 -j REJECT --reject-with tcp-reset", true},
+		{"filter", "-A INPUT -p udp -m udp --dport 53 -j REJECT --reject-with icmp6-port-unreachable", false},
+		{"filter", "-A OUTPUT -p udp -m udp --dport 443 -j REJECT --reject-with icmp6-port-unreachable", false},
+	}
+	for _, c := range cases {
+		spec := splitRule(c.line)
+		if isLegacyRule(c.table, spec[1], spec[2:]) != c.expected {
+			t.Errorf("%s %q should be %v", c.table, c.line, c.expected)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+)
+
+// DNSRuleset get the dns rules applied with proxy rules, redirect hijack mode redirects dns request to dns.port,
+// ipv6 dns request is rejected when it is redirected or ipv6 proxy is disabled, DoT request is rejected or redirected to dns.dotPort,
+// the dns request of tproxy hijack mode is marked by the proxy chains
+func DNSRuleset() Ruleset {
+	var rules Ruleset
+	hijack := builds.GetDNSHijack()
+	if hijack == "redirect" {
+		rules = append(rules, redirectDNSRule("udp", "53", builds.GetDNSPort()), redirectDNSRule("tcp", "53", builds.GetDNSPort()))
+	}
+	if hijack == "redirect" || !builds.Config.Proxy.EnableIPv6 {
+		rules = append(rules, disableIPv6DNSRule("udp"), disableIPv6DNSRule("tcp"))
+	}
+	switch builds.Config.DNS.DoT {
+	case "block":
+		rules = append(rules, blockDoTRule(false), blockDoTRule(true))
+	case "redirect":
+		// the core only listens on ipv4 loopback, ipv6 DoT is rejected so that clients fall back to ipv4
+		rules = append(rules, redirectDNSRule("tcp", "853", builds.Config.DNS.DoTPort), blockDoTRule(true))
+	}
+	return rules
+}
+
+// disableIPv6DNSRule reject ipv6 dns request
+func disableIPv6DNSRule(proto string) Rule {
+	return Rule{IPv6: true, Table: "filter", Chain: "OUTPUT", Spec: tagSpec([]string{"-p", proto, "--dport", "53", "-j", "REJECT"}, "dns"), Desc: "disable " + proto + " dns request on ipv6", Insert: true}
+}
+
+// redirectDNSRule redirect dns request to local dns port, except core itself
+func redirectDNSRule(proto string, dport string, port string) Rule {
+	return Rule{Table: "nat", Chain: "OUTPUT", Spec: tagSpec([]string{"-p", proto, "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", dport, "-j", "DNAT", "--to-destination", "127.0.0.1:" + port}, "dns"), Desc: "redirect " + proto + " dns request to port " + dport, Insert: true}
+}
+
+// blockDoTRule reset DoT connection, so that Android Private DNS falls back to plain dns, except core itself
+func blockDoTRule(ipv6 bool) Rule {
+	return Rule{IPv6: ipv6, Table: "filter", Chain: "OUTPUT", Spec: tagSpec([]string{"-p", "tcp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "853", "-j", "REJECT", "--reject-with", "tcp-reset"}, "dns"), Desc: "block DoT request", Insert: true}
+}
+
+// CleanDNS delete the dns rules of all hijack and DoT modes, the mode may be changed after rules are applied
+func CleanDNS() {
+	CleanIptables(false, "dns")
+	CleanIptables(true, "dns")
+}
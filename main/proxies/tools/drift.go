@@ -0,0 +1,503 @@
+package tools
+
+import (
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Drift the difference between the rules and routes which current config would produce and the live ones
+type Drift struct {
+	MissingRules Ruleset
+	// ExtraRules the live rules in the chains created by XrayHelper which are not expected
+	ExtraRules    Ruleset
+	MissingRoutes []Route
+	// ExtraRoutes the live ip rules and routes of XrayHelper routing tables which are not expected
+	ExtraRoutes []Route
+}
+
+// routeTables the routing tables used by XrayHelper
+var routeTables = []string{common.TproxyTableId, common.TunTableId, common.DummyTableId}
+
+// Empty whether nothing drifts
+func (this Drift) Empty() bool {
+	return len(this.MissingRules) == 0 && len(this.ExtraRules) == 0 && len(this.MissingRoutes) == 0 && len(this.ExtraRoutes) == 0
+}
+
+// CheckDrift compare the expected ruleset and routes with the live ones
+func CheckDrift(ruleset Ruleset, routes []Route) (Drift, error) {
+	var drift Drift
+	var err error
+	if UseNftables() {
+		drift, err = checkNftablesDrift(ruleset)
+	} else {
+		drift, err = checkIptablesDrift(ruleset)
+	}
+	if err != nil {
+		return drift, err
+	}
+	for _, route := range routes {
+		exist, err := route.Exists()
+		if err != nil {
+			return drift, err
+		}
+		if !exist {
+			drift.MissingRoutes = append(drift.MissingRoutes, route)
+		}
+	}
+	extraRoutes, err := listExtraRoutes(routes)
+	drift.ExtraRoutes = extraRoutes
+	return drift, err
+}
+
+// listExtraRoutes list the ip rules which look up XrayHelper routing tables and the routes in them, which are not expected
+func listExtraRoutes(routes []Route) ([]Route, error) {
+	var extraRoutes []Route
+	for _, ipv6 := range []bool{false, true} {
+		rules, err := common.ListIPRules(ipv6)
+		if err != nil {
+			return extraRoutes, err
+		}
+		for _, rule := range rules {
+			if slices.Contains(routeTables, rule.Table) && !routeExpected(rule, routes) {
+				extraRoutes = append(extraRoutes, rule)
+			}
+		}
+		for _, table := range routeTables {
+			tableRoutes, err := common.ListIPRoutes(ipv6, table)
+			if err != nil {
+				return extraRoutes, err
+			}
+			for _, route := range tableRoutes {
+				if !routeExpected(route, routes) {
+					extraRoutes = append(extraRoutes, route)
+				}
+			}
+		}
+	}
+	return extraRoutes, nil
+}
+
+// routeExpected whether the live ip rule or route is one of the expected routes, the priority of ip rule is compared only if it is set
+func routeExpected(live Route, routes []Route) bool {
+	for _, route := range routes {
+		compared := live
+		rule, isRule := route.(common.IPRule)
+		liveRule, isLiveRule := live.(common.IPRule)
+		if isRule && isLiveRule && len(rule.Priority) == 0 {
+			liveRule.Priority = ""
+			compared = liveRule
+		}
+		if route == compared {
+			return true
+		}
+	}
+	return false
+}
+
+// sequenceDrift compare the expected and live rule keys of a chain in order, return the index of missing expected keys and extra live keys
+func sequenceDrift(expected []string, live []string) (missing []int, extra []int) {
+	lengths := make([][]int, len(expected)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(live)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(live) - 1; j >= 0; j-- {
+			if expected[i] == live[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(expected) && j < len(live) {
+		switch {
+		case expected[i] == live[j]:
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			missing = append(missing, i)
+			i++
+		default:
+			extra = append(extra, j)
+			j++
+		}
+	}
+	for ; i < len(expected); i++ {
+		missing = append(missing, i)
+	}
+	for ; j < len(live); j++ {
+		extra = append(extra, j)
+	}
+	return missing, extra
+}
+
+// driftTables the iptables operations used to check and repair drift, it is implemented by *iptables.IPTables
+type driftTables interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	List(table, chain string) ([]string, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+}
+
+// getDriftTables get iptables of the rule protocol to check and repair drift, it is replaced in test
+var getDriftTables = func(ipv6 bool) (driftTables, error) {
+	return getIptables(ipv6)
+}
+
+// jumpChain get the user defined chain which the rule jumps to, return empty if the target is not a chain of ruleset
+func jumpChain(rule Rule, chainRules map[string][]Rule) string {
+	for i := 0; i+1 < len(rule.Spec); i++ {
+		if rule.Spec[i] == "-j" {
+			if _, ok := chainRules[Rule{IPv6: rule.IPv6, Table: rule.Table, Chain: rule.Spec[i+1]}.Key()]; ok {
+				return rule.Spec[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// checkIptablesDrift rules of builtin chains are checked one by one, rules of user defined chains are compared with iptables -S
+func checkIptablesDrift(ruleset Ruleset) (Drift, error) {
+	var drift Drift
+	chainKeys, chainRules := ruleset.chains()
+	for _, chainKey := range chainKeys {
+		rules := chainRules[chainKey]
+		table, chain, ipv6 := rules[0].Table, rules[0].Chain, rules[0].IPv6
+		currentIpt, err := getDriftTables(ipv6)
+		if err != nil {
+			return drift, err
+		}
+		if builtinChains[chain] {
+			for _, rule := range rules {
+				// iptables -C fails rather than returns false when the jump target does not exist
+				if target := jumpChain(rule, chainRules); len(target) > 0 {
+					exist, err := currentIpt.ChainExists(table, target)
+					if err != nil {
+						return drift, e.New("check chain "+target+" failed, ", err).WithPrefix(tagTools)
+					}
+					if !exist {
+						drift.MissingRules = append(drift.MissingRules, rule)
+						continue
+					}
+				}
+				exist, err := currentIpt.Exists(table, chain, rule.Spec...)
+				if err != nil {
+					return drift, e.New("check rule "+rule.Key()+" failed, ", err).WithPrefix(tagTools)
+				}
+				if !exist {
+					drift.MissingRules = append(drift.MissingRules, rule)
+				}
+			}
+			continue
+		}
+		if exist, err := currentIpt.ChainExists(table, chain); err != nil || !exist {
+			drift.MissingRules = append(drift.MissingRules, rules...)
+			continue
+		}
+		lines, err := currentIpt.List(table, chain)
+		if err != nil {
+			return drift, e.New("list chain "+chain+" failed, ", err).WithPrefix(tagTools)
+		}
+		// the rules of user defined chains are matched in order, a rule in wrong position is both missing and extra
+		var liveRules Ruleset
+		var liveSpecs, expectSpecs []string
+		for _, line := range lines {
+			spec := splitRule(line)
+			if len(spec) < 2 || spec[0] != "-A" {
+				continue
+			}
+			liveRules = append(liveRules, Rule{IPv6: ipv6, Table: table, Chain: chain, Spec: spec[2:]})
+			liveSpecs = append(liveSpecs, canonicalSpec(spec[2:]))
+		}
+		for _, rule := range rules {
+			expectSpecs = append(expectSpecs, canonicalSpec(rule.Spec))
+		}
+		missing, extra := sequenceDrift(expectSpecs, liveSpecs)
+		for _, i := range missing {
+			drift.MissingRules = append(drift.MissingRules, rules[i])
+		}
+		for _, j := range extra {
+			drift.ExtraRules = append(drift.ExtraRules, liveRules[j])
+		}
+	}
+	return drift, nil
+}
+
+// checkNftablesDrift compare the rule expressions of each chain in order, nftables rewrites the expressions, so both sides are normalized by nftCanonical
+func checkNftablesDrift(ruleset Ruleset) (Drift, error) {
+	var drift Drift
+	var out, errMsg bytes.Buffer
+	nft := common.NewExternal(0, &out, &errMsg, "nft", "list", "table", "inet", NftTable)
+	nft.Run()
+	if nft.Err() != nil {
+		log.HandleDebug("list nftables table: " + errMsg.String())
+		drift.MissingRules = append(drift.MissingRules, ruleset...)
+		return drift, nil
+	}
+	var liveChains []string
+	liveRules := make(map[string][]string)
+	chain := ""
+	for _, line := range strings.Split(out.String(), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "chain "):
+			chain = strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(line, "chain ")), " {")
+			liveChains = append(liveChains, chain)
+		case line == "}":
+			chain = ""
+		case len(line) > 0 && len(chain) > 0 && !strings.HasPrefix(line, "type "):
+			liveRules[chain] = append(liveRules[chain], line)
+		}
+	}
+	var chainNames []string
+	expectRules := make(map[string]Ruleset)
+	for _, rule := range ruleset {
+		chainName := nftChainName(rule.Table, rule.Chain)
+		if _, ok := expectRules[chainName]; !ok {
+			chainNames = append(chainNames, chainName)
+		}
+		expectRules[chainName] = append(expectRules[chainName], rule)
+	}
+	// the chains which are not expected are extra as a whole
+	for _, chainName := range liveChains {
+		if _, ok := expectRules[chainName]; !ok {
+			chainNames = append(chainNames, chainName)
+		}
+	}
+	for _, chainName := range chainNames {
+		var expectExprs, liveExprs []string
+		for _, rule := range expectRules[chainName] {
+			expr, err := nftRule(rule)
+			if err != nil {
+				return drift, err
+			}
+			expectExprs = append(expectExprs, nftCanonical(expr))
+		}
+		for _, line := range liveRules[chainName] {
+			liveExprs = append(liveExprs, nftCanonical(line))
+		}
+		missing, extra := sequenceDrift(expectExprs, liveExprs)
+		for _, i := range missing {
+			drift.MissingRules = append(drift.MissingRules, expectRules[chainName][i])
+		}
+		for _, j := range extra {
+			drift.ExtraRules = append(drift.ExtraRules, Rule{Table: "inet", Chain: chainName, Spec: []string{liveRules[chainName][j]}})
+		}
+	}
+	return drift, nil
+}
+
+// nftCanonical normalize the nftables rule expression, so that the expression in nft list output equals to the one it is added with
+func nftCanonical(expr string) string {
+	fields := strings.Fields(expr)
+	protocol := ""
+	for i := 0; i+2 < len(fields); i++ {
+		if fields[i] == "meta" && fields[i+1] == "l4proto" {
+			protocol = fields[i+2]
+		}
+	}
+	var result []string
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		switch {
+		case field == "meta" && i+2 < len(fields) && fields[i+1] == "nfproto":
+			// nft drops the family which is implied by address match, the chain order keeps ipv4 and ipv6 rules apart
+			i += 2
+			continue
+		case field == "meta" && i+2 < len(fields) && fields[i+1] == "l4proto" && len(protocol) > 0 && strings.Contains(expr, " dport "):
+			// nft folds protocol match into transport header match, eg: meta l4proto udp th dport 53 becomes udp dport 53
+			i += 2
+			continue
+		case field == "th" && len(protocol) > 0:
+			field = protocol
+		case field == "reject" && i+3 < len(fields) && fields[i+1] == "with" && strings.HasSuffix(fields[i+3], "port-unreachable"):
+			// nft shows the default reject type
+			i += 3
+		case strings.HasPrefix(field, "0x"):
+			if number, err := strconv.ParseUint(field, 0, 32); err == nil {
+				field = strconv.FormatUint(number, 10)
+			}
+		case strings.HasSuffix(field, "/32") && !strings.Contains(field, ":"), strings.HasSuffix(field, "/128"):
+			field = field[:strings.LastIndex(field, "/")]
+		}
+		result = append(result, field)
+	}
+	return strings.Join(result, " ")
+}
+
+// RepairDrift reapply the missing rules and routes, and delete the extra rules and routes, nftables table is reloaded as a whole
+func RepairDrift(ruleset Ruleset, drift Drift) error {
+	for _, route := range drift.MissingRoutes {
+		if err := route.Add(); err != nil {
+			return err
+		}
+	}
+	for _, route := range drift.ExtraRoutes {
+		if err := route.Delete(); err != nil {
+			return err
+		}
+	}
+	if len(drift.MissingRules) == 0 && len(drift.ExtraRules) == 0 {
+		return nil
+	}
+	if UseNftables() {
+		return ApplyNftables(ruleset)
+	}
+	if err := ApplyBypassSets(); err != nil {
+		return err
+	}
+	for _, rule := range drift.ExtraRules {
+		currentIpt, err := getDriftTables(rule.IPv6)
+		if err != nil {
+			return err
+		}
+		if err := currentIpt.Delete(rule.Table, rule.Chain, rule.Spec...); err != nil {
+			return e.New("delete extra rule "+rule.Key()+" failed, ", err).WithPrefix(tagTools)
+		}
+	}
+	missing := make(map[string]int)
+	for _, rule := range drift.MissingRules {
+		missing[rule.Key()]++
+		// the chains are created first, so that the rules which jump to them can be added
+		if builtinChains[rule.Chain] {
+			continue
+		}
+		currentIpt, err := getDriftTables(rule.IPv6)
+		if err != nil {
+			return err
+		}
+		if exist, err := currentIpt.ChainExists(rule.Table, rule.Chain); err == nil && !exist {
+			if err := currentIpt.NewChain(rule.Table, rule.Chain); err != nil {
+				return e.New("create chain "+rule.Chain+" failed, ", err).WithPrefix(tagTools)
+			}
+		}
+	}
+	// fill the user defined chains before the builtin chains jump to them, the position of missing rule is after the expected rules which are in place
+	position := make(map[string]int)
+	for _, hook := range []bool{false, true} {
+		for _, rule := range ruleset {
+			if builtinChains[rule.Chain] != hook {
+				continue
+			}
+			currentIpt, err := getDriftTables(rule.IPv6)
+			if err != nil {
+				return err
+			}
+			chainKey := Rule{IPv6: rule.IPv6, Table: rule.Table, Chain: rule.Chain}.Key()
+			position[chainKey]++
+			if missing[rule.Key()] == 0 {
+				continue
+			}
+			missing[rule.Key()]--
+			switch {
+			case rule.Insert:
+				err = currentIpt.Insert(rule.Table, rule.Chain, 1, rule.Spec...)
+			case hook:
+				err = currentIpt.Append(rule.Table, rule.Chain, rule.Spec...)
+			default:
+				err = currentIpt.Insert(rule.Table, rule.Chain, position[chainKey], rule.Spec...)
+			}
+			if err != nil {
+				return e.New(rule.Desc+" on "+rule.Table+" chain "+rule.Chain+" failed, ", err).WithPrefix(tagTools)
+			}
+		}
+	}
+	return nil
+}
+
+// canonicalSpec normalize the rule spec, so that the spec in iptables -S output equals to the spec it is added with
+func canonicalSpec(spec []string) string {
+	var options []string
+	negate := ""
+	for i := 0; i < len(spec); i++ {
+		option := spec[i]
+		if option == "!" {
+			negate = "! "
+			continue
+		}
+		if option == "-m" {
+			// match module is implied by its options
+			i++
+			continue
+		}
+		value := ""
+		if i+1 < len(spec) && !strings.HasPrefix(spec[i+1], "-") {
+			i++
+			value = spec[i]
+		}
+		switch option {
+		case "--set-mark":
+			option = "--set-xmark"
+		case "-d", "-s":
+			if !strings.Contains(value, "/") {
+				if strings.Contains(value, ":") {
+					value += "/128"
+				} else {
+					value += "/32"
+				}
+			}
+		case "--on-ip":
+			if value == "0.0.0.0" || value == "::" {
+				negate = ""
+				continue
+			}
+		case "--reject-with":
+			// iptables shows the default reject type
+			if value == "icmp-port-unreachable" || value == "icmp6-port-unreachable" {
+				continue
+			}
+		}
+		// iptables shows mark in hex with full mask
+		value = strings.TrimSuffix(value, "/0xffffffff")
+		if strings.HasPrefix(value, "0x") {
+			if number, err := strconv.ParseUint(value, 0, 32); err == nil {
+				value = strconv.FormatUint(number, 10)
+			}
+		}
+		options = append(options, negate+option+" "+value)
+		negate = ""
+	}
+	sort.Strings(options)
+	return strings.Join(options, " ")
+}
+
+// splitRule split the rule in iptables -S output, quoted value is kept as one field
+func splitRule(line string) []string {
+	var fields []string
+	var field strings.Builder
+	quoted, hasField := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case c == '"':
+			quoted = !quoted
+			hasField = true
+		case c == ' ' && !quoted:
+			if hasField {
+				fields = append(fields, field.String())
+				field.Reset()
+				hasField = false
+			}
+		default:
+			field.WriteByte(c)
+			hasField = true
+		}
+	}
+	if hasField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
@@ -0,0 +1,200 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalSpec(t *testing.T) {
+	cases := []struct {
+		added string
+		shown string
+	}{
+		{"-p udp -m owner ! --gid-owner 3005 --dport 53 -j MARK --set-mark 1111", "-p udp -m owner ! --gid-owner 3005 -m udp --dport 53 -j MARK --set-xmark 0x457/0xffffffff"},
+		{"-p tcp -i wlan+ -d 192.168.1.0/24 -j TPROXY --on-port 65535 --tproxy-mark 1111", "-d 192.168.1.0/24 -i wlan+ -p tcp -j TPROXY --on-port 65535 --on-ip 0.0.0.0 --tproxy-mark 0x457/0xffffffff"},
+		{"-i xdummy -p udp -j TPROXY --on-ip :: --on-port 65535 --tproxy-mark 164", "-i xdummy -p udp -j TPROXY --on-port 65535 --on-ip :: --tproxy-mark 0xa4/0xffffffff"},
+		{"-p tcp -m mark --mark 1111 -j MARK --set-xmark 168", "-p tcp -m mark --mark 0x457 -j MARK --set-xmark 0xa8/0xffffffff"},
+		{"-d 2001:db8::1 -j RETURN", "-d 2001:db8::1/128 -j RETURN"},
+		{"-p tcp -m owner ! --gid-owner 3005 --dport 853 -j REJECT --reject-with tcp-reset", "-p tcp -m owner ! --gid-owner 3005 -m tcp --dport 853 -j REJECT --reject-with tcp-reset"},
+		{"-p tcp -i wlan2 -m mac --mac-source AA:BB:CC:DD:EE:FF -j MARK --set-xmark 168", "-i wlan2 -p tcp -m mac --mac-source AA:BB:CC:DD:EE:FF -j MARK --set-xmark 0xa8/0xffffffff"},
+		{"-p tcp -m comment --comment xrayhelper:tproxy -j RETURN", `-p tcp -m comment --comment "xrayhelper:tproxy" -j RETURN`},
+		{"-p udp --dport 443 -m mark --mark 168 -j REJECT", "-p udp -m udp --dport 443 -m mark --mark 0xa8 -j REJECT --reject-with icmp6-port-unreachable"},
+	}
+	for _, c := range cases {
+		shown := splitRule("-A XRAY " + c.shown)[2:]
+		if canonicalSpec(strings.Fields(c.added)) != canonicalSpec(shown) {
+			t.Errorf("%q should equal to %q, got %q and %q", c.added, c.shown, canonicalSpec(strings.Fields(c.added)), canonicalSpec(shown))
+		}
+	}
+	if canonicalSpec(strings.Fields("-m owner --uid-owner 10001 -j RETURN")) == canonicalSpec(strings.Fields("-m owner --uid-owner 10002 -j RETURN")) {
+		t.Error("different rules should not be equal")
+	}
+	if fields := splitRule(`-A XT -m comment --comment "xrayhelper: a \"b\"" -j RETURN`); len(fields) != 8 || fields[5] != `xrayhelper: a "b"` {
+		t.Errorf("unexpected fields %q", fields)
+	}
+}
+
+func TestSequenceDrift(t *testing.T) {
+	missing, extra := sequenceDrift([]string{"a", "b", "c", "d"}, []string{"b", "a", "c", "e"})
+	// b is kept, a is in wrong position, so it is both missing and extra
+	if len(missing) != 2 || missing[0] != 0 || missing[1] != 3 {
+		t.Errorf("expect missing [0 3], got %v", missing)
+	}
+	if len(extra) != 2 || extra[0] != 1 || extra[1] != 3 {
+		t.Errorf("expect extra [1 3], got %v", extra)
+	}
+	if missing, extra := sequenceDrift([]string{"a", "a"}, []string{"a"}); len(missing) != 1 || len(extra) != 0 {
+		t.Errorf("duplicated rule should be counted, got missing %v and extra %v", missing, extra)
+	}
+}
+
+func TestNftCanonical(t *testing.T) {
+	cases := []struct {
+		added string
+		shown string
+	}{
+		{"meta nfproto ipv4 meta l4proto udp th dport 53 meta mark set 1111 tproxy ip to :65535 accept", "udp dport 53 meta mark set 0x00000457 tproxy ip to :65535 accept"},
+		{"meta nfproto ipv6 ip6 daddr 2001:db8::1/128 return", "ip6 daddr 2001:db8::1 return"},
+		{"meta nfproto ipv4 meta l4proto tcp meta skgid != 3005 th dport { 80-90, 443 } reject", "meta skgid != 3005 tcp dport { 80-90, 443 } reject with icmpx port-unreachable"},
+		{"meta nfproto ipv4 iifname \"wlan*\" jump XRAY", "meta nfproto ipv4 iifname \"wlan*\" jump XRAY"},
+		{"meta nfproto ipv4 meta l4proto tcp meta mark 1111 return comment \"xrayhelper:tun\"", "meta nfproto ipv4 meta l4proto tcp meta mark 0x00000457 return comment \"xrayhelper:tun\""},
+	}
+	for _, c := range cases {
+		if nftCanonical(c.added) != nftCanonical(c.shown) {
+			t.Errorf("%q should equal to %q, got %q and %q", c.added, c.shown, nftCanonical(c.added), nftCanonical(c.shown))
+		}
+	}
+	if nftCanonical("meta nfproto ipv4 meta skuid 10001 return") == nftCanonical("meta nfproto ipv4 meta skuid 10002 return") {
+		t.Error("different rules should not be equal")
+	}
+}
+
+func TestRouteExpected(t *testing.T) {
+	routes := []Route{
+		common.IPRule{Table: common.TunTableId, Mark: common.TunMarkId},
+		common.IPRule{IPv6: true, Table: common.TunTableId, Priority: "31999"},
+		common.IPRoute{Table: common.TunTableId, Dev: "xtun"},
+	}
+	if !routeExpected(common.IPRule{Table: common.TunTableId, Mark: common.TunMarkId, Priority: "32000"}, routes) {
+		t.Error("priority should not be compared when it is not set")
+	}
+	if routeExpected(common.IPRule{IPv6: true, Table: common.TunTableId, Priority: "32000"}, routes) {
+		t.Error("priority should be compared when it is set")
+	}
+	if routeExpected(common.IPRoute{Table: common.TunTableId, Dev: "tun0"}, routes) {
+		t.Error("route of other device should be extra")
+	}
+	if routeExpected(common.IPRule{Table: common.TproxyTableId, Mark: common.TproxyMarkId}, routes) {
+		t.Error("rule of other table should be extra")
+	}
+}
+
+// fakeTables simulate iptables, the rule which jumps to a missing chain is rejected like iptables does
+type fakeTables struct {
+	chains map[string][]string
+}
+
+func (this *fakeTables) checkTarget(table string, rulespec []string) error {
+	for i := 0; i+1 < len(rulespec); i++ {
+		if rulespec[i] == "-j" && strings.HasPrefix(rulespec[i+1], ChainPrefix) {
+			if _, ok := this.chains[table+" "+rulespec[i+1]]; !ok {
+				return errors.New("Couldn't load target `" + rulespec[i+1] + "', exit status 2")
+			}
+		}
+	}
+	return nil
+}
+
+func (this *fakeTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	if err := this.checkTarget(table, rulespec); err != nil {
+		return false, err
+	}
+	for _, rule := range this.chains[table+" "+chain] {
+		if rule == strings.Join(rulespec, " ") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (this *fakeTables) ChainExists(table, chain string) (bool, error) {
+	_, ok := this.chains[table+" "+chain]
+	return ok || builtinChains[chain], nil
+}
+
+func (this *fakeTables) NewChain(table, chain string) error {
+	this.chains[table+" "+chain] = []string{}
+	return nil
+}
+
+func (this *fakeTables) List(table, chain string) ([]string, error) {
+	lines := []string{"-N " + chain}
+	for _, rule := range this.chains[table+" "+chain] {
+		lines = append(lines, "-A "+chain+" "+rule)
+	}
+	return lines, nil
+}
+
+func (this *fakeTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	if err := this.checkTarget(table, rulespec); err != nil {
+		return err
+	}
+	rules := this.chains[table+" "+chain]
+	this.chains[table+" "+chain] = append(rules[:pos-1], append([]string{strings.Join(rulespec, " ")}, rules[pos-1:]...)...)
+	return nil
+}
+
+func (this *fakeTables) Append(table, chain string, rulespec ...string) error {
+	if err := this.checkTarget(table, rulespec); err != nil {
+		return err
+	}
+	this.chains[table+" "+chain] = append(this.chains[table+" "+chain], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (this *fakeTables) Delete(table, chain string, rulespec ...string) error {
+	rules := this.chains[table+" "+chain]
+	for i, rule := range rules {
+		if rule == strings.Join(rulespec, " ") {
+			this.chains[table+" "+chain] = append(rules[:i], rules[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("bad rule, exit status 1")
+}
+
+func TestRepairMissingChain(t *testing.T) {
+	builds.Config.Proxy.Firewall = "iptables"
+	tables := &fakeTables{chains: map[string][]string{"mangle PREROUTING": {"-j OTHER_MODULE"}}}
+	getDriftTables = func(ipv6 bool) (driftTables, error) { return tables, nil }
+	defer func() {
+		getDriftTables = func(ipv6 bool) (driftTables, error) { return getIptables(ipv6) }
+	}()
+	var ruleset Ruleset
+	ruleset.Append(false, "mangle", "PREROUTING", "apply chain", "-j", "XRAYHELPER_TPROXY_PRE")
+	ruleset.Append(false, "mangle", "XRAYHELPER_TPROXY_PRE", "bypass intra", "-d", "10.0.0.0/8", "-j", "RETURN")
+	ruleset.Append(false, "mangle", "XRAYHELPER_TPROXY_PRE", "proxy tcp", "-p", "tcp", "-j", "MARK")
+	// the chain and its hook are flushed and deleted by another module
+	drift, err := checkIptablesDrift(ruleset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift.MissingRules) != 3 {
+		t.Fatalf("expect 3 missing rules, got %v", drift.MissingRules)
+	}
+	if err := RepairDrift(ruleset, drift); err != nil {
+		t.Fatal(err)
+	}
+	if hooks := strings.Join(tables.chains["mangle PREROUTING"], "\n"); hooks != "-j OTHER_MODULE\n-j XRAYHELPER_TPROXY_PRE" {
+		t.Errorf("unexpected PREROUTING rules\n%s", hooks)
+	}
+	if rules := strings.Join(tables.chains["mangle XRAYHELPER_TPROXY_PRE"], "\n"); rules != "-d 10.0.0.0/8 -j RETURN\n-p tcp -j MARK" {
+		t.Errorf("unexpected chain rules\n%s", rules)
+	}
+	if drift, err := checkIptablesDrift(ruleset); err != nil || !drift.Empty() {
+		t.Errorf("expect no drift after repair, got %v, %v", drift, err)
+	}
+}
@@ -0,0 +1,299 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NftTable the inet table which holds all nftables rules of XrayHelper
+const NftTable = "xrayhelper"
+
+// nftBaseChains the base chain definitions of iptables builtin chains, the base chain name is table_chain in lower case
+var nftBaseChains = map[string]string{
+	"mangle_prerouting": "type filter hook prerouting priority mangle; policy accept;",
+	// mark in output should trigger reroute, so use route type
+	"mangle_output":  "type route hook output priority mangle; policy accept;",
+	"nat_prerouting": "type nat hook prerouting priority dstnat; policy accept;",
+	"nat_output":     "type nat hook output priority -100; policy accept;",
+	"filter_input":   "type filter hook input priority filter; policy accept;",
+	"filter_forward": "type filter hook forward priority filter; policy accept;",
+	"filter_output":  "type filter hook output priority filter; policy accept;",
+}
+
+// nftAvailable cache the result of nftables detection
+var nftAvailable *bool
+
+// UseNftables whether proxy rules should be applied by nftables, decided by proxy.firewall
+func UseNftables() bool {
+	switch builds.Config.Proxy.Firewall {
+	case "nftables":
+		return true
+	case "auto":
+		if nftAvailable == nil {
+			available := common.NewExternal(0, nil, nil, "nft", "list", "tables")
+			available.Run()
+			result := available.Err() == nil
+			nftAvailable = &result
+			log.HandleDebug("nftables available: " + strconv.FormatBool(result))
+		}
+		return *nftAvailable
+	default:
+		return false
+	}
+}
+
+// nftChainName get the nftables chain name of the rule, builtin chains become base chains
+func nftChainName(table string, chain string) string {
+	if strings.ToUpper(chain) == chain {
+		baseChain := strings.ToLower(table + "_" + chain)
+		if _, ok := nftBaseChains[baseChain]; ok {
+			return baseChain
+		}
+	}
+	return chain
+}
+
+// nftInterface convert iptables interface wildcard to nftables
+func nftInterface(name string) string {
+	if strings.HasSuffix(name, "+") {
+		name = strings.TrimSuffix(name, "+") + "*"
+	}
+	return "\"" + name + "\""
+}
+
+// nftRule convert the iptables rule spec to nftables rule expression
+func nftRule(rule Rule) (string, error) {
+	family, addr := "ipv4", "ip"
+	if rule.IPv6 {
+		family, addr = "ipv6", "ip6"
+	}
+	expr := []string{"meta", "nfproto", family}
+	var statements []string
+	comment := ""
+	op := ""
+	spec := rule.Spec
+	next := func(i int) (string, error) {
+		if i+1 >= len(spec) {
+			return "", e.New("missing value of " + spec[i] + " in rule " + rule.Key()).WithPrefix(tagTools)
+		}
+		return spec[i+1], nil
+	}
+	for i := 0; i < len(spec); i++ {
+		if spec[i] == "!" {
+			op = "!= "
+			continue
+		}
+		if spec[i] == "-m" {
+			// nftables has no match module, skip the module name
+			i++
+			continue
+		}
+		value, err := next(i)
+		if err != nil {
+			return "", err
+		}
+		switch spec[i] {
+		case "-p":
+			expr = append(expr, "meta l4proto "+op+value)
+		case "-d":
+			expr = append(expr, addr+" daddr "+op+value)
+		case "-s":
+			expr = append(expr, addr+" saddr "+op+value)
+		case "--mac-source":
+			expr = append(expr, "ether saddr "+op+strings.ToLower(value))
+		case "-i":
+			expr = append(expr, "iifname "+op+nftInterface(value))
+		case "-o":
+			expr = append(expr, "oifname "+op+nftInterface(value))
+		case "--dport":
+			expr = append(expr, "th dport "+op+value)
+		case "--dports":
+			expr = append(expr, "th dport "+op+"{ "+strings.ReplaceAll(strings.ReplaceAll(value, ":", "-"), ",", ", ")+" }")
+		case "--uid-owner":
+			expr = append(expr, "meta skuid "+op+value)
+		case "--gid-owner":
+			expr = append(expr, "meta skgid "+op+value)
+		case "--match-set":
+			direction := "daddr"
+			if i+2 < len(spec) && spec[i+2] == "src" {
+				direction = "saddr"
+			}
+			expr = append(expr, addr+" "+direction+" "+op+"@"+value)
+			// skip the direction
+			i++
+		case "--mark":
+			expr = append(expr, "meta mark "+op+value)
+		case "--comment":
+			// comment should be the last part of nftables rule
+			comment = "comment " + strconv.Quote(value)
+		case "-j":
+			target, err := nftTarget(addr, value, spec[i+2:])
+			if err != nil {
+				return "", e.New(err.Error() + " in rule " + rule.Key()).WithPrefix(tagTools)
+			}
+			statements = append(statements, target)
+			i = len(spec)
+			continue
+		default:
+			return "", e.New("unsupported option " + spec[i] + " in rule " + rule.Key()).WithPrefix(tagTools)
+		}
+		op = ""
+		i++
+	}
+	if len(comment) > 0 {
+		statements = append(statements, comment)
+	}
+	return strings.Join(append(expr, statements...), " "), nil
+}
+
+// nftTarget convert the iptables target and its options to nftables statement
+func nftTarget(addr string, target string, options []string) (string, error) {
+	values := make(map[string]string)
+	for i := 0; i+1 < len(options); i += 2 {
+		values[options[i]] = options[i+1]
+	}
+	switch target {
+	case "RETURN":
+		return "return", nil
+	case "ACCEPT":
+		return "accept", nil
+	case "DROP":
+		return "drop", nil
+	case "REJECT":
+		if values["--reject-with"] == "tcp-reset" {
+			return "reject with tcp reset", nil
+		}
+		return "reject", nil
+	case "MARK":
+		if mark, ok := values["--set-mark"]; ok {
+			return "meta mark set " + mark, nil
+		}
+		if mark, ok := values["--set-xmark"]; ok {
+			return "meta mark set " + mark, nil
+		}
+		return "", e.New("MARK target without mark")
+	case "TPROXY":
+		ip := values["--on-ip"]
+		if strings.Contains(ip, ":") {
+			ip = "[" + ip + "]"
+		}
+		// TPROXY target is terminating in iptables, but tproxy statement is not in nftables
+		statement := "tproxy " + addr + " to " + ip + ":" + values["--on-port"] + " accept"
+		if mark, ok := values["--tproxy-mark"]; ok {
+			statement = "meta mark set " + mark + " " + statement
+		}
+		return statement, nil
+	case "REDIRECT":
+		return "redirect to :" + values["--to-ports"], nil
+	case "DNAT":
+		return "dnat " + addr + " to " + values["--to-destination"], nil
+	default:
+		// user defined chain
+		if len(options) > 0 {
+			return "", e.New("unsupported target " + target)
+		}
+		return "jump " + target, nil
+	}
+}
+
+// NftScript generate the nftables script which replace the XrayHelper table with the ruleset atomically
+func NftScript(ruleset Ruleset) (string, error) {
+	var chainNames, setNames []string
+	chainRules := make(map[string][]string)
+	setIPv6 := make(map[string]bool)
+	for _, rule := range ruleset {
+		for i := 0; i+1 < len(rule.Spec); i++ {
+			if rule.Spec[i] == "--match-set" {
+				if _, ok := setIPv6[rule.Spec[i+1]]; !ok {
+					setNames = append(setNames, rule.Spec[i+1])
+				}
+				setIPv6[rule.Spec[i+1]] = rule.IPv6
+			}
+		}
+		chainName := nftChainName(rule.Table, rule.Chain)
+		if _, ok := chainRules[chainName]; !ok {
+			chainNames = append(chainNames, chainName)
+			chainRules[chainName] = nil
+		}
+		expr, err := nftRule(rule)
+		if err != nil {
+			return "", err
+		}
+		chainRules[chainName] = append(chainRules[chainName], expr)
+	}
+	var script strings.Builder
+	// declare then delete the table, so that it works whether the table exists or not
+	script.WriteString("table inet " + NftTable + "\n")
+	script.WriteString("delete table inet " + NftTable + "\n")
+	// declare all chains first, the jump target should exist before the rule is added
+	script.WriteString("table inet " + NftTable + " {\n")
+	// the elements of sets are added by nftSetElementScript
+	for _, setName := range setNames {
+		setType := "ipv4_addr"
+		if setIPv6[setName] {
+			setType = "ipv6_addr"
+		}
+		script.WriteString("\tset " + setName + " {\n\t\ttype " + setType + "; flags interval; auto-merge;\n\t}\n")
+	}
+	for _, chainName := range chainNames {
+		script.WriteString("\tchain " + chainName + " {\n")
+		if definition, ok := nftBaseChains[chainName]; ok {
+			script.WriteString("\t\t" + definition + "\n")
+		}
+		script.WriteString("\t}\n")
+	}
+	script.WriteString("}\n")
+	for _, chainName := range chainNames {
+		for _, expr := range chainRules[chainName] {
+			script.WriteString("add rule inet " + NftTable + " " + chainName + " " + expr + "\n")
+		}
+	}
+	return script.String(), nil
+}
+
+// ApplyNftables load the ruleset into the XrayHelper table by one nft command, the old table is replaced atomically
+func ApplyNftables(ruleset Ruleset) error {
+	script, err := NftScript(ruleset)
+	if err != nil {
+		return err
+	}
+	// fill the bypass sets in the same transaction, so that the sets are never empty
+	if BypassEnabled() {
+		script += nftSetElementScript(LoadBypassLists())
+	}
+	scriptPath := path.Join(builds.Config.XrayHelper.RunDir, "xrayhelper.nft")
+	if err := os.WriteFile(scriptPath, []byte(script), 0644); err != nil {
+		return e.New("write nftables script failed, ", err).WithPrefix(tagTools)
+	}
+	var errMsg bytes.Buffer
+	nft := common.NewExternal(0, nil, &errMsg, "nft", "-f", scriptPath)
+	nft.Run()
+	if nft.Err() != nil {
+		return e.New("load nftables script "+scriptPath+" failed, ", nft.Err(), ", "+errMsg.String()).WithPrefix(tagTools)
+	}
+	return nil
+}
+
+// CleanNftables delete the XrayHelper table
+func CleanNftables() {
+	var errMsg bytes.Buffer
+	nft := common.NewExternal(0, nil, &errMsg, "nft", "delete", "table", "inet", NftTable)
+	nft.Run()
+	if nft.Err() != nil {
+		log.HandleDebug("delete nftables table: " + errMsg.String())
+	}
+}
+
+// NftablesEnabled check whether the XrayHelper table exists
+func NftablesEnabled() bool {
+	nft := common.NewExternal(0, nil, nil, "nft", "list", "table", "inet", NftTable)
+	nft.Run()
+	return nft.Err() == nil
+}
@@ -0,0 +1,47 @@
+package tools_test
+
+import (
+	"XrayHelper/main/proxies/tools"
+	"strings"
+	"testing"
+)
+
+func TestNftScript(t *testing.T) {
+	var ruleset tools.Ruleset
+	ruleset.Append(false, "mangle", "PREROUTING", "", "-j", "XRAY")
+	ruleset.Append(false, "mangle", "XRAY", "", "-p", "udp", "--dport", "53", "-j", "TPROXY", "--on-port", "65535", "--tproxy-mark", "1111")
+	ruleset.Append(true, "mangle", "XRAY", "", "-i", "wlan+", "-p", "tcp", "-j", "TPROXY", "--on-ip", "::", "--on-port", "65535", "--tproxy-mark", "164")
+	ruleset.Append(false, "nat", "PROXY", "", "-p", "udp", "-m", "owner", "!", "--gid-owner", "3005", "--dport", "53", "-j", "MARK", "--set-mark", "1111")
+	ruleset.Append(true, "nat", "PROXY", "", "-d", "fc00::/7", "-j", "RETURN")
+	ruleset.Append(false, "nat", "PREROUTING", "", "-j", "XRAY_REDIRECT")
+	ruleset.Append(true, "nat", "PROXY", "", "-m", "set", "--match-set", "xrayhelper_bypass6", "dst", "-j", "RETURN")
+	ruleset.Append(false, "nat", "XRAY_REDIRECT", "", "-p", "tcp", "-i", "rndis0", "-j", "REDIRECT", "--to-ports", "65532")
+	ruleset.Append(true, "filter", "OUTPUT", "", "-p", "tcp", "-m", "owner", "!", "--gid-owner", "3005", "--dport", "853", "-j", "REJECT", "--reject-with", "tcp-reset")
+	ruleset.Append(false, "mangle", "XRAY", "", "-i", "wlan2", "-m", "mac", "--mac-source", "AA:BB:CC:DD:EE:FF", "-j", "RETURN")
+	script, err := tools.NftScript(ruleset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"\tchain mangle_prerouting {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n\t}",
+		"add rule inet xrayhelper mangle_prerouting meta nfproto ipv4 jump XRAY",
+		"add rule inet xrayhelper XRAY meta nfproto ipv4 meta l4proto udp th dport 53 meta mark set 1111 tproxy ip to :65535 accept",
+		"add rule inet xrayhelper XRAY meta nfproto ipv6 iifname \"wlan*\" meta l4proto tcp meta mark set 164 tproxy ip6 to [::]:65535 accept",
+		"add rule inet xrayhelper PROXY meta nfproto ipv4 meta l4proto udp meta skgid != 3005 th dport 53 meta mark set 1111",
+		"add rule inet xrayhelper PROXY meta nfproto ipv6 ip6 daddr fc00::/7 return",
+		"\tset xrayhelper_bypass6 {\n\t\ttype ipv6_addr; flags interval; auto-merge;\n\t}",
+		"add rule inet xrayhelper PROXY meta nfproto ipv6 ip6 daddr @xrayhelper_bypass6 return",
+		"\tchain nat_prerouting {\n\t\ttype nat hook prerouting priority dstnat; policy accept;\n\t}",
+		"add rule inet xrayhelper XRAY_REDIRECT meta nfproto ipv4 meta l4proto tcp iifname \"rndis0\" redirect to :65532",
+		"add rule inet xrayhelper filter_output meta nfproto ipv6 meta l4proto tcp meta skgid != 3005 th dport 853 reject with tcp reset",
+		"add rule inet xrayhelper XRAY meta nfproto ipv4 iifname \"wlan2\" ether saddr aa:bb:cc:dd:ee:ff return",
+	}
+	for _, line := range expected {
+		if !strings.Contains(script, line) {
+			t.Errorf("script should contain %q, got\n%s", line, script)
+		}
+	}
+	if _, err := tools.NftScript(tools.Ruleset{{Table: "mangle", Chain: "XT", Spec: []string{"--unknown", "1", "-j", "RETURN"}}}); err == nil {
+		t.Error("unsupported option should be rejected")
+	}
+}
@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/log"
+)
+
+// blockQuicChain the filter chain which rejects QUIC of proxied traffic, REJECT target only works in filter table,
+// so the traffic marked by the output chain of tproxy or tun2socks is matched by its mark here
+const blockQuicChain = ChainPrefix + "QUIC"
+
+// BlockQuicEnabled whether proxy.blockQuic or proxy.blockQuicList is configured
+func BlockQuicEnabled() bool {
+	return builds.Config.Proxy.BlockQuic || len(builds.Config.Proxy.BlockQuicList) > 0
+}
+
+// BlockQuicRuleset get the rules which reject udp 443 of the traffic marked with marks, so that clients fall back to tcp,
+// local traffic is rejected in OUTPUT, ap traffic is rejected in apHook, which is INPUT for tproxy and FORWARD for tun2socks,
+// if proxy.blockQuicList is not empty, only the packages in it are rejected, ap clients are not packages, so apHook is not applied
+func BlockQuicRuleset(ipv6 bool, apHook string, marks ...string) Ruleset {
+	var rules Ruleset
+	if !BlockQuicEnabled() {
+		return rules
+	}
+	block := func(desc string, spec ...string) {
+		rules.Append(ipv6, "filter", blockQuicChain, desc, spec...)
+	}
+	rules.Append(ipv6, "filter", "OUTPUT", "apply filter chain "+blockQuicChain+" to OUTPUT", "-j", blockQuicChain)
+	// owner match only works in OUTPUT
+	if len(builds.Config.Proxy.BlockQuicList) == 0 {
+		rules.Append(ipv6, "filter", apHook, "apply filter chain "+blockQuicChain+" to "+apHook, "-j", blockQuicChain)
+	}
+	for _, mark := range marks {
+		markSpec := []string{"-m", "mark", "--mark", mark, "-j", "REJECT"}
+		if len(builds.Config.Proxy.BlockQuicList) == 0 {
+			block("block quic of mark "+mark, append([]string{"-p", "udp", "--dport", "443"}, markSpec...)...)
+			continue
+		}
+		for _, pkg := range builds.Config.Proxy.BlockQuicList {
+			uids, err := GetUids(pkg)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				block("block quic of package "+pkg, append([]string{"-p", "udp", "--dport", "443", "-m", "owner", "--uid-owner", uid}, markSpec...)...)
+			}
+		}
+	}
+	return rules.Tag("quic")
+}
+
+// CleanBlockQuic delete the quic chain of ipv4 or ipv6 and the rule which applies it
+func CleanBlockQuic(ipv6 bool) {
+	CleanIptables(ipv6, "quic")
+}
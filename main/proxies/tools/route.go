@@ -0,0 +1,11 @@
+package tools
+
+// Route an ip rule or ip route added by XrayHelper, it is implemented by common.IPRule and common.IPRoute,
+// Add and Delete are idempotent, so they can be called after an unclean shutdown
+type Route interface {
+	Add() error
+	Delete() error
+	Exists() (bool, error)
+	// String describe the route, eg: ipv4 rule from all fwmark 1111 table 233
+	String() string
+}
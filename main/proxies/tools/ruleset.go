@@ -0,0 +1,366 @@
+package tools
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/common"
+	e "XrayHelper/main/errors"
+	"XrayHelper/main/log"
+	"bytes"
+	"github.com/coreos/go-iptables/iptables"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Rule an iptables rule in the chain created by XrayHelper
+type Rule struct {
+	IPv6  bool
+	Table string
+	Chain string
+	Spec  []string
+	// Desc describe what the rule does, used in log and error message
+	Desc string
+	// Insert the rule is inserted to the head of builtin chain rather than appended
+	Insert bool
+}
+
+// Key identify the rule, rules with the same key are the same rule in iptables
+func (this Rule) Key() string {
+	proto := "ipv4"
+	if this.IPv6 {
+		proto = "ipv6"
+	}
+	return proto + " " + this.Table + " " + this.Chain + " " + strings.Join(this.Spec, " ")
+}
+
+// Ruleset the ordered rules, rules of the same chain are applied in order
+type Ruleset []Rule
+
+// Append add rules to the end of ruleset
+func (this *Ruleset) Append(ipv6 bool, table string, chain string, desc string, spec ...string) {
+	*this = append(*this, Rule{IPv6: ipv6, Table: table, Chain: chain, Spec: spec, Desc: desc})
+}
+
+// Tag add comment xrayhelper:<id> to the rules which are not tagged yet, so that they can be found by cleanup
+// whatever config creates them, the comment match is put before the target
+func (this Ruleset) Tag(id string) Ruleset {
+	for i := range this {
+		this[i].Spec = tagSpec(this[i].Spec, id)
+	}
+	return this
+}
+
+// tagSpec add the comment match of component id to the rule spec if it has no comment
+func tagSpec(spec []string, id string) []string {
+	target := len(spec)
+	for i, option := range spec {
+		if option == "--comment" {
+			return spec
+		}
+		if option == "-j" {
+			target = i
+			break
+		}
+	}
+	tagged := append([]string{}, spec[:target]...)
+	tagged = append(tagged, "-m", "comment", "--comment", tagPrefix+id)
+	return append(tagged, spec[target:]...)
+}
+
+// chains group rules by chain, keep the order of chains and rules
+func (this Ruleset) chains() ([]string, map[string][]Rule) {
+	var chainKeys []string
+	chainRules := make(map[string][]Rule)
+	for _, rule := range this {
+		chainKey := Rule{IPv6: rule.IPv6, Table: rule.Table, Chain: rule.Chain}.Key()
+		if _, ok := chainRules[chainKey]; !ok {
+			chainKeys = append(chainKeys, chainKey)
+		}
+		chainRules[chainKey] = append(chainRules[chainKey], rule)
+	}
+	return chainKeys, chainRules
+}
+
+// getIptables get iptables of the rule protocol
+func getIptables(ipv6 bool) (*iptables.IPTables, error) {
+	currentIpt := common.Ipt
+	if ipv6 {
+		currentIpt = common.Ipt6
+	}
+	if currentIpt == nil {
+		return nil, e.New("get iptables failed").WithPrefix(tagTools)
+	}
+	return currentIpt, nil
+}
+
+// xtablesWait the seconds to wait for the xtables lock, netd and other programs also hold it while changing rules
+const xtablesWait = 5
+
+// builtinChains the builtin chains of iptables, they cannot be created or deleted
+var builtinChains = map[string]bool{"PREROUTING": true, "INPUT": true, "FORWARD": true, "OUTPUT": true, "POSTROUTING": true}
+
+// RestoreScript generate iptables-restore input of the rules, user defined chains are declared first,
+// with --noflush, the declared chain is created if not exists, or flushed if exists
+func RestoreScript(ruleset Ruleset) string {
+	var tables []string
+	tableChains := make(map[string][]string)
+	tableRules := make(map[string][]string)
+	for _, rule := range ruleset {
+		if _, ok := tableRules[rule.Table]; !ok {
+			tables = append(tables, rule.Table)
+			tableRules[rule.Table] = nil
+		}
+		if !builtinChains[rule.Chain] {
+			declared := false
+			for _, chain := range tableChains[rule.Table] {
+				declared = declared || chain == rule.Chain
+			}
+			if !declared {
+				tableChains[rule.Table] = append(tableChains[rule.Table], rule.Chain)
+			}
+		}
+		line := "-A " + rule.Chain
+		if rule.Insert {
+			line = "-I " + rule.Chain + " 1"
+		}
+		for _, spec := range rule.Spec {
+			if strings.ContainsAny(spec, " \t\"'") {
+				spec = strconv.Quote(spec)
+			}
+			line += " " + spec
+		}
+		tableRules[rule.Table] = append(tableRules[rule.Table], line)
+	}
+	var script strings.Builder
+	for _, table := range tables {
+		script.WriteString("*" + table + "\n")
+		for _, chain := range tableChains[table] {
+			script.WriteString(":" + chain + " - [0:0]\n")
+		}
+		for _, line := range tableRules[table] {
+			script.WriteString(line + "\n")
+		}
+		script.WriteString("COMMIT\n")
+	}
+	return script.String()
+}
+
+// restoreIptables commit the rules of one protocol by one iptables-restore call
+func restoreIptables(ipv6 bool, ruleset Ruleset) error {
+	command, scriptName := "iptables-restore", "iptables.rules"
+	if ipv6 {
+		command, scriptName = "ip6tables-restore", "ip6tables.rules"
+	}
+	scriptPath := path.Join(builds.Config.XrayHelper.RunDir, scriptName)
+	if err := os.WriteFile(scriptPath, []byte(RestoreScript(ruleset)), 0644); err != nil {
+		return e.New("write "+scriptName+" failed, ", err).WithPrefix(tagTools)
+	}
+	var errMsg bytes.Buffer
+	restore := common.NewExternal(0, nil, &errMsg, command, "--wait="+strconv.Itoa(xtablesWait), "--noflush", scriptPath)
+	restore.Run()
+	if restore.Err() != nil {
+		return e.New(command+" "+scriptPath+" failed, ", restore.Err(), ", "+errMsg.String()).WithPrefix(tagTools)
+	}
+	return nil
+}
+
+// RestoreRuleset commit ipv4 and ipv6 rules each by one iptables-restore call, if any commit fails, roll back both
+func RestoreRuleset(ruleset Ruleset) error {
+	// the ipsets should exist before the rules which match them are committed
+	if err := ApplyBypassSets(); err != nil {
+		return err
+	}
+	var rules, rules6 Ruleset
+	for _, rule := range ruleset {
+		if rule.IPv6 {
+			rules6 = append(rules6, rule)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) > 0 {
+		if err := restoreIptables(false, rules); err != nil {
+			RemoveRuleset(ruleset)
+			return err
+		}
+	}
+	if len(rules6) > 0 {
+		if err := restoreIptables(true, rules6); err != nil {
+			RemoveRuleset(ruleset)
+			return err
+		}
+	}
+	log.HandleDebug("restore " + strconv.Itoa(len(rules)) + " ipv4 rules and " + strconv.Itoa(len(rules6)) + " ipv6 rules")
+	return nil
+}
+
+// RemoveRuleset delete the rules of builtin chains, then delete the user defined chains in ruleset
+func RemoveRuleset(ruleset Ruleset) {
+	var chains Ruleset
+	for _, rule := range ruleset {
+		currentIpt, err := getIptables(rule.IPv6)
+		if err != nil {
+			continue
+		}
+		if builtinChains[rule.Chain] {
+			_ = currentIpt.DeleteIfExists(rule.Table, rule.Chain, rule.Spec...)
+		} else {
+			chains = append(chains, Rule{IPv6: rule.IPv6, Table: rule.Table, Chain: rule.Chain})
+		}
+	}
+	for _, chain := range chains {
+		currentIpt, _ := getIptables(chain.IPv6)
+		if exist, err := currentIpt.ChainExists(chain.Table, chain.Chain); err == nil && exist {
+			_ = currentIpt.ClearAndDeleteChain(chain.Table, chain.Chain)
+		}
+	}
+}
+
+// RuleChange a rule which should be deleted from or inserted to its chain, Position is the 1-based insert position,
+// other programs also add rules to builtin chains, so the position there is 0 and found by After in the live chain
+type RuleChange struct {
+	Rule
+	Delete   bool
+	Position int
+	// After the spec of the rule which the inserted rule follows in builtin chain, nil means append to the chain
+	After []string
+}
+
+// DiffRuleset get the changes which update the applied ruleset to the new one, deletions of a chain come before its insertions,
+// the rules kept by both ruleset are not touched, and the position of inserted rules follows the new ruleset
+func DiffRuleset(old Ruleset, new Ruleset) []RuleChange {
+	var changes []RuleChange
+	oldChainKeys, oldChains := old.chains()
+	chainKeys, newChains := new.chains()
+	for _, chainKey := range oldChainKeys {
+		if _, ok := newChains[chainKey]; !ok {
+			chainKeys = append(chainKeys, chainKey)
+		}
+	}
+	for _, chainKey := range chainKeys {
+		oldRules, newRules := oldChains[chainKey], newChains[chainKey]
+		kept := commonRules(oldRules, newRules)
+		// delete the rules which are not kept, then current chain is the same as kept rules
+		keptIndex := 0
+		for _, rule := range oldRules {
+			if keptIndex < len(kept) && kept[keptIndex].Key() == rule.Key() {
+				keptIndex++
+				continue
+			}
+			changes = append(changes, RuleChange{Rule: rule, Delete: true})
+		}
+		// insert new rules at the position of new ruleset
+		keptIndex = 0
+		var after []string
+		for position, rule := range newRules {
+			if keptIndex < len(kept) && kept[keptIndex].Key() == rule.Key() {
+				keptIndex++
+			} else {
+				switch {
+				case !builtinChains[rule.Chain]:
+					changes = append(changes, RuleChange{Rule: rule, Position: position + 1})
+				case rule.Insert:
+					changes = append(changes, RuleChange{Rule: rule, Position: 1})
+				default:
+					changes = append(changes, RuleChange{Rule: rule, After: after})
+				}
+			}
+			if !rule.Insert {
+				after = rule.Spec
+			}
+		}
+	}
+	return changes
+}
+
+// UpdateRuleset update the applied ruleset to the new one, only the changed rules are deleted or inserted
+func UpdateRuleset(old Ruleset, new Ruleset) (added int, deleted int, err error) {
+	for _, change := range DiffRuleset(old, new) {
+		currentIpt, err := getIptables(change.IPv6)
+		if err != nil {
+			return added, deleted, err
+		}
+		if change.Delete {
+			if err := currentIpt.Delete(change.Table, change.Chain, change.Spec...); err != nil {
+				return added, deleted, e.New("delete rule "+change.Key()+" failed, ", err).WithPrefix(tagTools)
+			}
+			log.HandleDebug("delete rule " + change.Key())
+			deleted++
+		} else {
+			position := change.Position
+			if position == 0 {
+				if position, err = livePosition(currentIpt, change.Table, change.Chain, change.After); err != nil {
+					return added, deleted, err
+				}
+			}
+			if position == 0 {
+				err = currentIpt.Append(change.Table, change.Chain, change.Spec...)
+			} else {
+				err = currentIpt.Insert(change.Table, change.Chain, position, change.Spec...)
+			}
+			if err != nil {
+				return added, deleted, e.New(change.Desc+" on "+change.Table+" chain "+change.Chain+" failed, ", err).WithPrefix(tagTools)
+			}
+			log.HandleDebug("insert rule " + change.Key())
+			added++
+		}
+	}
+	return added, deleted, nil
+}
+
+// livePosition get the position right after the rule in the live chain, return 0 if the rule is nil or not found
+func livePosition(currentIpt *iptables.IPTables, table string, chain string, after []string) (int, error) {
+	if after == nil {
+		return 0, nil
+	}
+	lines, err := currentIpt.List(table, chain)
+	if err != nil {
+		return 0, e.New("list chain "+chain+" failed, ", err).WithPrefix(tagTools)
+	}
+	canonical := canonicalSpec(after)
+	position := 0
+	for _, line := range lines {
+		spec := splitRule(line)
+		if len(spec) < 2 || spec[0] != "-A" {
+			continue
+		}
+		position++
+		if canonicalSpec(spec[2:]) == canonical {
+			return position + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// commonRules get the longest common subsequence of two rule lists
+func commonRules(a []Rule, b []Rule) []Rule {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i].Key() == b[j].Key() {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+	var result []Rule
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		if a[i].Key() == b[j].Key() {
+			result = append(result, a[i])
+			i++
+			j++
+		} else if lengths[i+1][j] >= lengths[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return result
+}
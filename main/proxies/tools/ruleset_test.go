@@ -0,0 +1,142 @@
+package tools_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/proxies/tools"
+	"strings"
+	"testing"
+)
+
+func newRuleset(specs ...string) tools.Ruleset {
+	var ruleset tools.Ruleset
+	for _, spec := range specs {
+		ruleset.Append(false, "mangle", "XT", spec, strings.Fields(spec)...)
+	}
+	return ruleset
+}
+
+func TestDiffRuleset(t *testing.T) {
+	old := newRuleset("-d 10.0.0.0/8 -j RETURN", "--uid-owner 10001 -j RETURN", "-o wlan+ -j RETURN", "-j MARK")
+	new := newRuleset("--uid-owner 10002 -j RETURN", "-d 10.0.0.0/8 -j RETURN", "-o wlan+ -j RETURN", "-o rndis+ -j RETURN", "-j MARK")
+	// apply changes to a simulated chain
+	chain := []string{}
+	for _, rule := range old {
+		chain = append(chain, strings.Join(rule.Spec, " "))
+	}
+	for _, change := range tools.DiffRuleset(old, new) {
+		spec := strings.Join(change.Spec, " ")
+		if change.Delete {
+			for i := range chain {
+				if chain[i] == spec {
+					chain = append(chain[:i], chain[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+		chain = append(chain[:change.Position-1], append([]string{spec}, chain[change.Position-1:]...)...)
+	}
+	if len(chain) != len(new) {
+		t.Fatalf("expect %d rules, got %v", len(new), chain)
+	}
+	for i, rule := range new {
+		if chain[i] != strings.Join(rule.Spec, " ") {
+			t.Fatalf("rule %d expect %s, got %s", i, strings.Join(rule.Spec, " "), chain[i])
+		}
+	}
+	if changes := tools.DiffRuleset(new, new); len(changes) != 0 {
+		t.Errorf("expect no changes, got %v", changes)
+	}
+}
+
+func TestDiffRulesetBuiltinChain(t *testing.T) {
+	var old, new tools.Ruleset
+	old.Append(false, "mangle", "OUTPUT", "", "-j", "XT")
+	new.Append(false, "mangle", "OUTPUT", "", "-j", "XT")
+	new.Append(false, "mangle", "OUTPUT", "", "-o", "wlan+", "-j", "RETURN")
+	new = append(new, tools.Rule{Table: "mangle", Chain: "OUTPUT", Spec: []string{"-p", "udp", "-j", "RETURN"}, Insert: true})
+	changes := tools.DiffRuleset(old, new)
+	if len(changes) != 2 {
+		t.Fatalf("expect 2 changes, got %v", changes)
+	}
+	// other programs also add rules to builtin chains, the position should be found in the live chain
+	if changes[0].Position != 0 || strings.Join(changes[0].After, " ") != "-j XT" {
+		t.Errorf("appended rule should follow -j XT, got position %d after %v", changes[0].Position, changes[0].After)
+	}
+	if changes[1].Position != 1 || changes[1].After != nil {
+		t.Errorf("inserted rule should be at position 1, got position %d after %v", changes[1].Position, changes[1].After)
+	}
+}
+
+func TestRestoreScript(t *testing.T) {
+	var ruleset tools.Ruleset
+	ruleset.Append(false, "mangle", "PREROUTING", "", "-j", "XRAY")
+	ruleset.Append(false, "mangle", "XRAY", "", "-d", "10.0.0.0/8", "-j", "RETURN")
+	ruleset.Append(false, "nat", "OUTPUT", "", "-j", "PROXY")
+	ruleset.Append(false, "nat", "PROXY", "", "-m", "owner", "--gid-owner", "3005", "-j", "RETURN")
+	ruleset = append(ruleset, tools.Rule{Table: "nat", Chain: "OUTPUT", Spec: []string{"-p", "udp", "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:65533"}, Insert: true})
+	expected := "*mangle\n:XRAY - [0:0]\n-A PREROUTING -j XRAY\n-A XRAY -d 10.0.0.0/8 -j RETURN\nCOMMIT\n" +
+		"*nat\n:PROXY - [0:0]\n-A OUTPUT -j PROXY\n-A PROXY -m owner --gid-owner 3005 -j RETURN\n-I OUTPUT 1 -p udp --dport 53 -j DNAT --to-destination 127.0.0.1:65533\nCOMMIT\n"
+	if script := tools.RestoreScript(ruleset); script != expected {
+		t.Errorf("unexpected restore script\n%s", script)
+	}
+}
+
+func TestTag(t *testing.T) {
+	ruleset := newRuleset("-p tcp -j MARK --set-mark 1111", "-d 10.0.0.0/8")
+	ruleset.Tag("tun")
+	if spec := strings.Join(ruleset[0].Spec, " "); spec != "-p tcp -m comment --comment xrayhelper:tun -j MARK --set-mark 1111" {
+		t.Errorf("comment should be put before target, got %s", spec)
+	}
+	if spec := strings.Join(ruleset[1].Spec, " "); spec != "-d 10.0.0.0/8 -m comment --comment xrayhelper:tun" {
+		t.Errorf("comment should be appended to rule without target, got %s", spec)
+	}
+	if spec := strings.Join(ruleset.Tag("tproxy")[0].Spec, " "); strings.Count(spec, "--comment") != 1 || !strings.Contains(spec, "xrayhelper:tun") {
+		t.Errorf("tagged rule should not be tagged again, got %s", spec)
+	}
+	script, err := tools.NftScript(ruleset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "meta l4proto tcp meta mark set 1111 comment \"xrayhelper:tun\"") {
+		t.Errorf("nftables rule should end with comment, got\n%s", script)
+	}
+}
+
+func TestUseBypassSets(t *testing.T) {
+	ruleset := newRuleset("-d 10.0.0.0/8 -j RETURN")
+	if tools.UseBypassSets(ruleset) {
+		t.Error("ruleset without bypass spec should not use bypass sets")
+	}
+	ruleset.Append(true, "mangle", "XT", "bypass lists", tools.BypassSpec(true)...)
+	if !tools.UseBypassSets(ruleset) {
+		t.Error("ruleset with bypass spec should use bypass sets")
+	}
+}
+
+func TestBlockQuicRuleset(t *testing.T) {
+	builds.Config.Proxy.BlockQuic, builds.Config.Proxy.BlockQuicList = true, nil
+	defer func() { builds.Config.Proxy.BlockQuic = false }()
+	var keys []string
+	for _, rule := range tools.BlockQuicRuleset(false, "FORWARD", "168") {
+		keys = append(keys, rule.Table+" "+rule.Chain+" "+strings.Join(rule.Spec, " "))
+	}
+	expected := []string{
+		"filter OUTPUT -m comment --comment xrayhelper:quic -j XRAYHELPER_QUIC",
+		"filter FORWARD -m comment --comment xrayhelper:quic -j XRAYHELPER_QUIC",
+		"filter XRAYHELPER_QUIC -p udp --dport 443 -m mark --mark 168 -m comment --comment xrayhelper:quic -j REJECT",
+	}
+	if strings.Join(keys, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected rules\n%s", strings.Join(keys, "\n"))
+	}
+	// ap clients are not packages, only local traffic is matched by owner
+	builds.PackageMap = map[string]string{"com.app": "10030"}
+	builds.UserList = []int{0}
+	builds.Config.Proxy.BlockQuicList = []string{"com.app"}
+	defer func() { builds.Config.Proxy.BlockQuicList = nil }()
+	for _, rule := range tools.BlockQuicRuleset(false, "INPUT", "1111") {
+		if rule.Chain == "INPUT" {
+			t.Errorf("owner match does not work in INPUT, got %s", rule.Key())
+		}
+	}
+}
@@ -2,7 +2,6 @@ package tools
 
 import (
 	"XrayHelper/main/builds"
-	"XrayHelper/main/common"
 	e "XrayHelper/main/errors"
 	"strconv"
 	"strings"
@@ -10,42 +9,125 @@ import (
 
 const tagTools = "tools"
 
-func GetUid(pkgInfo string) (string, error) {
-	var appId, userId int
-	info := strings.Split(pkgInfo, ":")
-	if pkgId, ok := builds.PackageMap[info[0]]; ok {
-		appId, _ = strconv.Atoi(pkgId)
-	} else {
-		return "", e.New("cannot get uid from " + pkgInfo).WithPrefix(tagTools)
+// android app id range, uid is user * perUserRange + app id
+const (
+	perUserRange = 100000
+	firstAppId   = 10000
+	lastAppId    = 19999
+)
+
+// GetUids get the uids selected by pkgList entry, a package pattern is expanded against PackageMap, all users(*) is
+// expanded against the users on the device, * selects the app id range of the user, a raw uid is returned as it is
+func GetUids(pkgInfo string) ([]string, error) {
+	entry, err := builds.ParsePackageEntry(pkgInfo)
+	if err != nil {
+		return nil, err
+	}
+	if len(entry.Uid) > 0 {
+		return []string{entry.Uid}, nil
 	}
-	if len(info) == 2 {
-		userId, _ = strconv.Atoi(info[1])
+	var appIds []string
+	switch {
+	case len(entry.AppId) > 0:
+		appIds = []string{entry.AppId}
+	case entry.Package == "*":
+		appIds = []string{strconv.Itoa(firstAppId) + "-" + strconv.Itoa(lastAppId)}
+	default:
+		seen := make(map[string]bool)
+		for _, pkg := range builds.MatchPackages(entry.Package) {
+			// packages with shared user id have the same app id
+			if appId := builds.PackageMap[pkg]; !seen[appId] {
+				seen[appId] = true
+				appIds = append(appIds, appId)
+			}
+		}
+		if len(appIds) == 0 {
+			return nil, e.New("cannot get uid from " + pkgInfo).WithPrefix(tagTools)
+		}
 	}
-	return strconv.Itoa(userId*100000 + appId), nil
+	users := []int{entry.User}
+	if entry.User == builds.AllUsers {
+		users = builds.UserList
+	}
+	var uids []string
+	for _, user := range users {
+		for _, appId := range appIds {
+			uids = append(uids, userUid(user, appId))
+		}
+	}
+	return uids, nil
 }
 
-func DisableIPV6DNS() error {
-	if err := common.Ipt6.Insert("filter", "OUTPUT", 1, "-p", "udp", "--dport", "53", "-j", "REJECT"); err != nil {
-		return e.New("disable dns request on ipv6 failed, ", err).WithPrefix(tagTools)
+// userUid get the uid of app id or app id range in the user
+func userUid(user int, appId string) string {
+	var ids []string
+	for _, id := range strings.Split(appId, "-") {
+		number, _ := strconv.Atoi(id)
+		ids = append(ids, strconv.Itoa(user*perUserRange+number))
 	}
-	return nil
+	return strings.Join(ids, "-")
+}
+
+// multiportLimit the max ports of one multiport match, a port range takes two
+const multiportLimit = 15
+
+// PackageMatch the protocol and port matches of a pkgList entry, a rule spec is Proto + owner match + Ports + target
+type PackageMatch struct {
+	Proto []string
+	Ports []string
 }
 
-func EnableIPV6DNS() {
-	_ = common.Ipt6.Delete("filter", "OUTPUT", "-p", "udp", "--dport", "53", "-j", "REJECT")
+// Spec build the rule spec of the package uid with target
+func (this PackageMatch) Spec(uid string, target ...string) []string {
+	spec := append([]string{}, this.Proto...)
+	spec = append(spec, "-m", "owner", "--uid-owner", uid)
+	spec = append(spec, this.Ports...)
+	return append(spec, target...)
 }
 
-func RedirectDNS(port string) error {
-	if err := common.Ipt.Insert("nat", "OUTPUT", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port); err != nil {
-		return e.New("redirect dns request failed, ", err).WithPrefix(tagTools)
+// GetPackageMatches get the matches of pkgList entry filter, if splitProto is false and the entry has no filter,
+// only one empty match is returned, otherwise there is one match per protocol and multiport group
+func GetPackageMatches(pkgInfo string, splitProto bool) ([]PackageMatch, error) {
+	entry, err := builds.ParsePackageEntry(pkgInfo)
+	if err != nil {
+		return nil, err
 	}
-	if err := DisableIPV6DNS(); err != nil {
-		return err
+	protos := []string{"tcp", "udp"}
+	if len(entry.Proto) > 0 {
+		protos = []string{entry.Proto}
+	} else if !splitProto && len(entry.Ports) == 0 {
+		return []PackageMatch{{}}, nil
 	}
-	return nil
-}
-
-func CleanRedirectDNS(port string) {
-	_ = common.Ipt.Delete("nat", "OUTPUT", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "DNAT", "--to-destination", "127.0.0.1:"+port)
-	EnableIPV6DNS()
+	// group ports by multiport limit
+	var portGroups [][]string
+	count := multiportLimit
+	for _, port := range entry.Ports {
+		weight := 1
+		if strings.Contains(port, "-") {
+			weight = 2
+		}
+		if count+weight > multiportLimit {
+			portGroups = append(portGroups, nil)
+			count = 0
+		}
+		portGroups[len(portGroups)-1] = append(portGroups[len(portGroups)-1], strings.Replace(port, "-", ":", 1))
+		count += weight
+	}
+	var matches []PackageMatch
+	for _, proto := range protos {
+		if len(portGroups) == 0 {
+			matches = append(matches, PackageMatch{Proto: []string{"-p", proto}})
+			continue
+		}
+		for _, ports := range portGroups {
+			match := PackageMatch{Proto: []string{"-p", proto}}
+			if len(ports) == 1 && !strings.Contains(ports[0], ":") {
+				match.Ports = []string{"--dport", ports[0]}
+			} else {
+				match.Ports = []string{"-m", "multiport", "--dports", strings.Join(ports, ",")}
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches, nil
 }
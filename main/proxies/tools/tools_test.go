@@ -0,0 +1,111 @@
+package tools_test
+
+import (
+	"XrayHelper/main/builds"
+	"XrayHelper/main/proxies/tools"
+	"strings"
+	"testing"
+)
+
+func TestGetPackageMatches(t *testing.T) {
+	cases := []struct {
+		pkg        string
+		splitProto bool
+		expected   []string
+	}{
+		{"com.app", false, []string{"-m owner --uid-owner 10001 -j RETURN"}},
+		{"com.app:10", true, []string{"-p tcp -m owner --uid-owner 10001 -j RETURN", "-p udp -m owner --uid-owner 10001 -j RETURN"}},
+		{"com.app?proto=tcp", false, []string{"-p tcp -m owner --uid-owner 10001 -j RETURN"}},
+		{"com.app?proto=udp&ports=443", false, []string{"-p udp -m owner --uid-owner 10001 --dport 443 -j RETURN"}},
+		{"com.app?ports=80,443,1000-2000", false, []string{
+			"-p tcp -m owner --uid-owner 10001 -m multiport --dports 80,443,1000:2000 -j RETURN",
+			"-p udp -m owner --uid-owner 10001 -m multiport --dports 80,443,1000:2000 -j RETURN",
+		}},
+		{"com.app?proto=tcp&ports=1,2,3,4,5,6,7,8,9,10,11,12,13,14,15-16", false, []string{
+			"-p tcp -m owner --uid-owner 10001 -m multiport --dports 1,2,3,4,5,6,7,8,9,10,11,12,13,14 -j RETURN",
+			"-p tcp -m owner --uid-owner 10001 -m multiport --dports 15:16 -j RETURN",
+		}},
+	}
+	for _, c := range cases {
+		matches, err := tools.GetPackageMatches(c.pkg, c.splitProto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var specs []string
+		for _, match := range matches {
+			specs = append(specs, strings.Join(match.Spec("10001", "-j", "RETURN"), " "))
+		}
+		if strings.Join(specs, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("%s: unexpected rules\n%s", c.pkg, strings.Join(specs, "\n"))
+		}
+	}
+	if _, err := tools.GetPackageMatches("com.app?proto=icmp", false); err == nil {
+		t.Error("invalid proto should be rejected")
+	}
+}
+
+func TestGetUids(t *testing.T) {
+	builds.PackageMap = map[string]string{"com.google.maps": "10010", "com.google.gms": "10020", "com.google.gsf": "10020", "com.app": "10030"}
+	builds.UserList = []int{0, 10}
+	cases := []struct {
+		pkg      string
+		expected []string
+	}{
+		{"com.app", []string{"10030"}},
+		{"com.app:10", []string{"1010030"}},
+		{"com.app:*", []string{"10030", "1010030"}},
+		{"com.google.*", []string{"10020", "10010"}},
+		{"*:10", []string{"1010000-1019999"}},
+		{"uid:10123", []string{"10123"}},
+		{"uid:10000-10999?proto=tcp", []string{"10000-10999"}},
+		{"appid:10100-10199:*", []string{"10100-10199", "1010100-1010199"}},
+	}
+	for _, c := range cases {
+		uids, err := tools.GetUids(c.pkg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(uids, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("%s: unexpected uids %v", c.pkg, uids)
+		}
+	}
+	for _, pkg := range []string{"com.none.*", "uid:abc", "uid:2-1", "appid:10000:x", "com.app:-1"} {
+		if _, err := tools.GetUids(pkg); err == nil {
+			t.Errorf("%s should be rejected", pkg)
+		}
+	}
+}
+
+func TestApSources(t *testing.T) {
+	builds.Config.Proxy.ApList = []string{"wlan2"}
+	builds.Config.Proxy.ApClients = []string{"aa:bb:cc:dd:ee:ff", "192.168.43.10", "fd00::/64"}
+	defer func() {
+		builds.Config.Proxy.ApList, builds.Config.Proxy.ApClients, builds.Config.Proxy.ApClientMode = nil, nil, ""
+	}()
+	specs := func(sources []tools.ApSource) string {
+		var specs []string
+		for _, source := range sources {
+			specs = append(specs, strings.Join(source.Spec("tcp", "-j", "RETURN"), " "))
+		}
+		return strings.Join(specs, ", ")
+	}
+	builds.Config.Proxy.ApClientMode = "deny"
+	if proxied := specs(tools.ProxiedApSources(false)); proxied != "-p tcp -i wlan2 -j RETURN" {
+		t.Errorf("deny mode should proxy the whole interface, got %s", proxied)
+	}
+	expected := "-p tcp -i wlan2 -m mac --mac-source AA:BB:CC:DD:EE:FF -j RETURN, -p tcp -i wlan2 -s 192.168.43.10 -j RETURN"
+	if bypassed := specs(tools.BypassedApSources(false)); bypassed != expected {
+		t.Errorf("deny mode should bypass the clients, got %s", bypassed)
+	}
+	builds.Config.Proxy.ApClientMode = "allow"
+	if len(tools.BypassedApSources(true)) != 0 {
+		t.Error("allow mode should not bypass clients")
+	}
+	expected = "-p tcp -i wlan2 -m mac --mac-source AA:BB:CC:DD:EE:FF -j RETURN, -p tcp -i wlan2 -s fd00::/64 -j RETURN"
+	if proxied := specs(tools.ProxiedApSources(true)); proxied != expected {
+		t.Errorf("allow mode should proxy the clients, got %s", proxied)
+	}
+	if builds.ApClientProxied("192.168.43.11", "11:22:33:44:55:66") || !builds.ApClientProxied("192.168.43.11", "AA:BB:CC:DD:EE:FF") {
+		t.Error("allow mode should only proxy the matched clients")
+	}
+}
@@ -6,11 +6,16 @@ import (
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
 	"XrayHelper/main/proxies/tools"
-	"bytes"
 )
 
 const tagTproxy = "tproxy"
 
+// the chains of tproxy, prerouting chain tproxy the traffic to core, output chain marks the local traffic which should be proxied
+const (
+	preroutingChain = tools.ChainPrefix + "TPROXY_PRE"
+	outputChain     = tools.ChainPrefix + "TPROXY_OUT"
+)
+
 var useDummy bool
 
 func init() {
@@ -28,42 +33,26 @@ func (this *Tproxy) Enable() error {
 		this.Disable()
 		return err
 	}
-	if err := createMangleChain(false); err != nil {
-		this.Disable()
-		return err
-	}
-	if err := createProxyChain(false); err != nil {
-		this.Disable()
-		return err
-	}
 	if builds.Config.Proxy.EnableIPv6 {
 		if err := addRoute(true); err != nil {
 			this.Disable()
 			return err
 		}
-		if err := createMangleChain(true); err != nil {
-			this.Disable()
-			return err
-		}
-		if err := createProxyChain(true); err != nil {
-			this.Disable()
-			return err
-		}
 	}
-	// handleDns, some core not support sniffing(eg: clash), need redirect dns request to local dns port
-	switch builds.Config.XrayHelper.CoreType {
-	case "clash.meta", "mihomo":
-		if err := tools.RedirectDNS(builds.Config.Clash.DNSPort); err != nil {
-			this.Disable()
-			return err
-		}
-	default:
-		if !builds.Config.Proxy.EnableIPv6 {
-			if err := tools.DisableIPV6DNS(); err != nil {
-				this.Disable()
-				return err
-			}
-		}
+	rules, err := fullRuleset()
+	if err != nil {
+		this.Disable()
+		return err
+	}
+	// all rules are committed at once, nothing is left if commit fails
+	if tools.UseNftables() {
+		err = tools.ApplyNftables(rules)
+	} else {
+		err = tools.RestoreRuleset(rules)
+	}
+	if err != nil {
+		this.Disable()
+		return err
 	}
 	return nil
 }
@@ -73,305 +62,327 @@ func (this *Tproxy) Disable() {
 	//always clean ipv6 rules
 	deleteRoute(true)
 	cleanIptablesChain(true)
+	//always clean rules of both firewalls, the firewall may be changed after rules are applied
+	tools.CleanNftables()
+	//always destroy bypass ipsets after the rules which match them are deleted
+	tools.CleanBypassSets()
 	//always clean dns rules
-	tools.EnableIPV6DNS()
-	tools.CleanRedirectDNS(builds.Config.Clash.DNSPort)
+	tools.CleanDNS()
+}
+
+// Enabled check whether the tproxy rules are applied
+func (this *Tproxy) Enabled() bool {
+	if tools.UseNftables() {
+		return tools.NftablesEnabled()
+	}
+	if common.Ipt == nil {
+		return false
+	}
+	if exist, err := common.Ipt.ChainExists("mangle", preroutingChain); err != nil || !exist {
+		return false
+	}
+	if exist, err := common.Ipt.ChainExists("nat", outputChain); err != nil || !exist {
+		return false
+	}
+	return true
+}
+
+// routes get the ip rules and routes of tproxy
+func routes(ipv6 bool) []tools.Route {
+	if ipv6 && useDummy {
+		return dummyRoutes()
+	}
+	routeList := []tools.Route{
+		common.IPRule{IPv6: ipv6, Table: common.TproxyTableId, Mark: common.TproxyMarkId},
+		common.IPRoute{IPv6: ipv6, Table: common.TproxyTableId, Local: true, Dev: "lo"},
+	}
+	// route the traffic marked by app groups to local
+	for _, group := range builds.GetAppGroups() {
+		routeList = append(routeList, common.IPRule{IPv6: ipv6, Table: common.TproxyTableId, Mark: group.Mark})
+	}
+	return routeList
+}
+
+// Routes get the ip rules and routes of tproxy, it is used to check whether the routes are in place
+func (this *Tproxy) Routes() []tools.Route {
+	routeList := routes(false)
+	if builds.Config.Proxy.EnableIPv6 {
+		routeList = append(routeList, routes(true)...)
+	}
+	return routeList
 }
 
 // addRoute Add ip route to proxy
 func addRoute(ipv6 bool) error {
-	var errMsg bytes.Buffer
-	if !ipv6 {
-		common.NewExternal(0, nil, &errMsg, "ip", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTproxy)
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTproxy)
+	if ipv6 && useDummy {
+		if err := common.AddDummyDevice(common.DummyDevice, common.DummyIp); err != nil {
+			return err
 		}
-	} else {
-		if !useDummy {
-			common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "add", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-			if errMsg.Len() > 0 {
-				return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTproxy)
-			}
-			errMsg.Reset()
-			common.NewExternal(0, nil, &errMsg, "ip", "-6", "route", "add", "local", "default", "dev", "lo", "table", common.TproxyTableId).Run()
-			if errMsg.Len() > 0 {
-				return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTproxy)
-			}
-		} else {
-			if err := enableDummy(); err != nil {
-				return err
-			}
+	}
+	for _, route := range routes(ipv6) {
+		if err := route.Add(); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// deleteRoute Delete ip route to proxy
+// deleteRoute Delete ip route to proxy, all rules which look up tproxy table are deleted, so the rules of old app groups are cleaned up as well
 func deleteRoute(ipv6 bool) {
-	var errMsg bytes.Buffer
-	if !ipv6 {
-		common.NewExternal(0, nil, &errMsg, "ip", "rule", "del", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip rule: " + errMsg.String())
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "route", "flush", "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip route: " + errMsg.String())
-		}
-	} else {
+	if ipv6 {
 		disableDummy()
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "del", "fwmark", common.TproxyMarkId, "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip rule: " + errMsg.String())
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "route", "flush", "table", common.TproxyTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip route: " + errMsg.String())
-		}
+	}
+	if err := common.DeleteIPRules(ipv6, common.TproxyTableId); err != nil {
+		log.HandleDebug(err)
+	}
+	if err := common.FlushIPRoutes(ipv6, common.TproxyTableId); err != nil {
+		log.HandleDebug(err)
 	}
 }
 
-// createProxyChain Create PROXY chain for local applications
-func createProxyChain(ipv6 bool) error {
-	var currentProto string
-	currentIpt := common.Ipt
-	currentProto = "ipv4"
-	if ipv6 {
-		currentIpt = common.Ipt6
-		currentProto = "ipv6"
+// proxyChainRules get the rules of output chain
+func proxyChainRules(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	proxy := func(desc string, spec ...string) {
+		rules.Append(ipv6, "nat", outputChain, desc, spec...)
 	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTproxy)
+	// mark all dns request if dns is hijacked by tproxy
+	if builds.GetDNSHijack() == "tproxy" {
+		proxy("mark all dns request", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-mark", common.TproxyMarkId)
+		proxy("mark all dns request", "-p", "tcp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-mark", common.TproxyMarkId)
 	}
-	if err := currentIpt.NewChain("nat", "PROXY"); err != nil {
-		return e.New("create "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+	// allow IntraList
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if ipv6 == common.IsIPv6(intra) {
+			proxy("allow intra "+intra, "-p", "udp", "-d", intra, "-j", "MARK", "--set-mark", common.TproxyMarkId)
+			proxy("allow intra "+intra, "-p", "tcp", "-d", intra, "-j", "MARK", "--set-mark", common.TproxyMarkId)
+		}
 	}
-	// bypass dummy
-	if currentProto == "ipv6" && useDummy {
-		if err := currentIpt.Append("nat", "PROXY", "-o", common.DummyDevice, "-j", "RETURN"); err != nil {
-			return e.New("ignore dummy interface "+common.DummyDevice+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+	// bypass PkgList
+	if len(builds.Config.Proxy.PkgList) > 0 && builds.Config.Proxy.Mode == "blacklist" {
+		for _, pkg := range builds.Config.Proxy.PkgList {
+			uids, err := tools.GetUids(pkg)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			matches, err := tools.GetPackageMatches(pkg, false)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				for _, match := range matches {
+					proxy("bypass package "+pkg, match.Spec(uid, "-j", "RETURN")...)
+				}
+			}
 		}
 	}
+	// bypass dummy
+	if ipv6 && useDummy {
+		proxy("ignore dummy interface "+common.DummyDevice, "-o", common.DummyDevice, "-j", "RETURN")
+	}
 	// bypass ignore list
 	for _, ignore := range builds.Config.Proxy.IgnoreList {
-		if err := currentIpt.Append("nat", "PROXY", "-o", ignore, "-j", "RETURN"); err != nil {
-			return e.New("apply ignore interface "+ignore+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
+		proxy("apply ignore interface "+ignore, "-o", ignore, "-j", "RETURN")
+	}
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		proxy("bypass lists", tools.BypassSpec(ipv6)...)
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
+	if !ipv6 {
 		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("nat", "PROXY", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
+			proxy("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
 		}
 	} else {
 		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("nat", "PROXY", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
+			proxy("bypass intraNet "+intraIp6, "-d", intraIp6, "-j", "RETURN")
 		}
 		if !useDummy {
 			for _, external := range common.ExternalIPv6 {
-				if err := currentIpt.Append("nat", "PROXY", "-d", external+"/32", "-j", "RETURN"); err != nil {
-					return e.New("bypass externalIPv6 "+external+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-				}
+				proxy("bypass externalIPv6 "+external, "-d", external+"/32", "-j", "RETURN")
 			}
 		}
 	}
 	// bypass Core itself
-	if err := currentIpt.Append("nat", "PROXY", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN"); err != nil {
-		return e.New("bypass core gid on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-	}
-	// start processing proxy rules
-	// if PkgList has no package, should proxy everything
-	if len(builds.Config.Proxy.PkgList) == 0 {
-		if err := currentIpt.Append("nat", "PROXY", "-p", "tcp", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
-		if err := currentIpt.Append("nat", "PROXY", "-p", "udp", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
-	} else if builds.Config.Proxy.Mode == "blacklist" {
-		// bypass PkgList
-		for _, pkg := range builds.Config.Proxy.PkgList {
-			uid, err := tools.GetUid(pkg)
+	proxy("bypass core gid", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN")
+	// mark app groups with their own mark, then stop processing them
+	for _, group := range builds.GetAppGroups() {
+		for _, pkg := range group.PkgList {
+			uids, err := tools.GetUids(pkg)
 			if err != nil {
 				log.HandleDebug(err)
 				continue
 			}
-			if err := currentIpt.Insert("nat", "PROXY", 1, "-m", "owner", "--uid-owner", uid, "-j", "RETURN"); err != nil {
-				return e.New("bypass package "+pkg+" on "+currentProto+" mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+			matches, err := tools.GetPackageMatches(pkg, true)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				for _, match := range matches {
+					proxy("create app group "+group.Name+" package "+pkg+" proxy", match.Spec(uid, "-j", "MARK", "--set-mark", group.Mark)...)
+				}
 			}
 		}
-		// allow others
-		if err := currentIpt.Append("nat", "PROXY", "-p", "tcp", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
-		if err := currentIpt.Append("nat", "PROXY", "-p", "udp", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
+		proxy("finish app group "+group.Name, "-m", "mark", "--mark", group.Mark, "-j", "RETURN")
+	}
+	// start processing proxy rules
+	// if PkgList has no package, should proxy everything
+	if len(builds.Config.Proxy.PkgList) == 0 || builds.Config.Proxy.Mode == "blacklist" {
+		proxy("create local applications proxy", "-p", "tcp", "-j", "MARK", "--set-mark", common.TproxyMarkId)
+		proxy("create local applications proxy", "-p", "udp", "-j", "MARK", "--set-mark", common.TproxyMarkId)
 	} else if builds.Config.Proxy.Mode == "whitelist" {
 		// allow PkgList
 		for _, pkg := range builds.Config.Proxy.PkgList {
-			uid, err := tools.GetUid(pkg)
+			uids, err := tools.GetUids(pkg)
 			if err != nil {
 				log.HandleDebug(err)
 				continue
 			}
-			if err := currentIpt.Append("nat", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", uid, "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-				return e.New("create package "+pkg+" proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+			matches, err := tools.GetPackageMatches(pkg, true)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
 			}
-			if err := currentIpt.Append("nat", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", uid, "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-				return e.New("create package "+pkg+" proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
+			for _, uid := range uids {
+				for _, match := range matches {
+					proxy("create package "+pkg+" proxy", match.Spec(uid, "-j", "MARK", "--set-mark", common.TproxyMarkId)...)
+				}
 			}
 		}
 		// allow root user(eg: magisk, ksud, netd...)
-		if err := currentIpt.Append("nat", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create root user proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
-		if err := currentIpt.Append("nat", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create root user proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
+		proxy("create root user proxy", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-mark", common.TproxyMarkId)
+		proxy("create root user proxy", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", "MARK", "--set-mark", common.TproxyMarkId)
 		// allow dns_tether user(eg: dnsmasq...)
-		if err := currentIpt.Append("nat", "PROXY", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create dns_tether user proxy on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
-		if err := currentIpt.Append("nat", "PROXY", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("create dns_tether user proxy on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
+		proxy("create dns_tether user proxy", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-mark", common.TproxyMarkId)
+		proxy("create dns_tether user proxy", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", "MARK", "--set-mark", common.TproxyMarkId)
 	} else {
-		return e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagTproxy)
+		return nil, e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagTproxy)
 	}
-	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("nat", "PROXY", 1, "-p", "tcp", "-d", intra, "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
-			if err := currentIpt.Insert("nat", "PROXY", 1, "-p", "udp", "-d", intra, "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-			}
-		}
+	return rules, nil
+}
+
+// mangleChainRules get the rules of prerouting chain
+func mangleChainRules(ipv6 bool) tools.Ruleset {
+	var rules tools.Ruleset
+	xray := func(desc string, spec ...string) {
+		rules.Append(ipv6, "mangle", preroutingChain, desc, spec...)
 	}
-	// mark all dns request (except mihomo)
-	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "clash.meta" {
-		if err := currentIpt.Insert("nat", "PROXY", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "MARK", "--set-mark", common.TproxyMarkId); err != nil {
-			return e.New("mark all dns request on "+currentProto+" udp mangle chain PROXY failed, ", err).WithPrefix(tagTproxy)
-		}
+	tproxy := []string{"-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId}
+	// mark all dns request if dns is hijacked by tproxy
+	if builds.GetDNSHijack() == "tproxy" {
+		xray("mark all dns request", append([]string{"-p", "udp", "--dport", "53"}, tproxy...)...)
+		xray("mark all dns request", append([]string{"-p", "tcp", "--dport", "53"}, tproxy...)...)
 	}
-	// apply rules to OUTPUT
-	if err := currentIpt.Append("nat", "OUTPUT", "-j", "PROXY"); err != nil {
-		return e.New("apply mangle chain PROXY to OUTPUT failed, ", err).WithPrefix(tagTproxy)
+	// bypass the denied ap clients
+	for _, source := range tools.BypassedApSources(ipv6) {
+		xray("bypass "+source.String(), source.Spec("", "-j", "RETURN")...)
 	}
-	return nil
-}
-
-// createMangleChain Create XRAY chain for AP interface
-func createMangleChain(ipv6 bool) error {
-	var currentProto string
-	currentIpt := common.Ipt
-	currentProto = "ipv4"
-	if ipv6 {
-		currentIpt = common.Ipt6
-		currentProto = "ipv6"
+	// allow ApList to IntraList
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		for _, intra := range builds.Config.Proxy.IntraList {
+			if ipv6 == common.IsIPv6(intra) {
+				xray("allow intra "+intra, source.Spec("udp", append([]string{"-d", intra}, tproxy...)...)...)
+				xray("allow intra "+intra, source.Spec("tcp", append([]string{"-d", intra}, tproxy...)...)...)
+			}
+		}
 	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTproxy)
+	// allow IntraList
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if ipv6 == common.IsIPv6(intra) {
+			xray("allow intra "+intra, append([]string{"-p", "udp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId}, tproxy...)...)
+			xray("allow intra "+intra, append([]string{"-p", "tcp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId}, tproxy...)...)
+		}
 	}
-	if err := currentIpt.NewChain("mangle", "XRAY"); err != nil {
-		return e.New("create "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		xray("bypass lists", tools.BypassSpec(ipv6)...)
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
+	if !ipv6 {
 		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("mangle", "XRAY", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
+			xray("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
 		}
 	} else {
 		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("mangle", "XRAY", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
+			xray("bypass intraNet "+intraIp6, "-d", intraIp6, "-j", "RETURN")
 		}
 		if !useDummy {
 			for _, external := range common.ExternalIPv6 {
-				if err := currentIpt.Append("mangle", "XRAY", "-d", external+"/32", "-j", "RETURN"); err != nil {
-					return e.New("bypass externalIPv6 "+external+" on "+currentProto+" mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-				}
+				xray("bypass externalIPv6 "+external, "-d", external+"/32", "-j", "RETURN")
 			}
 		}
 	}
-	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "tcp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
-			if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "-d", intra, "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-			}
-		}
+	// redirect app groups to their own tproxy port
+	for _, group := range builds.GetAppGroups() {
+		groupTproxy := []string{"-j", "TPROXY", "--on-port", group.TproxyPort, "--tproxy-mark", group.Mark}
+		xray("create app group "+group.Name+" proxy", append([]string{"-p", "tcp", "-m", "mark", "--mark", group.Mark}, groupTproxy...)...)
+		xray("create app group "+group.Name+" proxy", append([]string{"-p", "udp", "-m", "mark", "--mark", group.Mark}, groupTproxy...)...)
 	}
 	// mark all traffic
-	if err := currentIpt.Append("mangle", "XRAY", "-p", "tcp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-		return e.New("create all traffic proxy on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-	}
-	if err := currentIpt.Append("mangle", "XRAY", "-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-		return e.New("create all traffic proxy on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+	xray("create all traffic proxy", append([]string{"-p", "tcp", "-m", "mark", "--mark", common.TproxyMarkId}, tproxy...)...)
+	xray("create all traffic proxy", append([]string{"-p", "udp", "-m", "mark", "--mark", common.TproxyMarkId}, tproxy...)...)
+	// trans ApList to prerouting chain
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		xray("create "+source.String()+" proxy", source.Spec("tcp", tproxy...)...)
+		xray("create "+source.String()+" proxy", source.Spec("udp", tproxy...)...)
 	}
-	// trans ApList to chain XRAY
-	for _, ap := range builds.Config.Proxy.ApList {
-		// allow ApList to IntraList
-		for _, intra := range builds.Config.Proxy.IntraList {
-			if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-				if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "tcp", "-i", ap, "-d", intra, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-				}
-				if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "-i", ap, "-d", intra, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-				}
-			}
-		}
-		if err := currentIpt.Append("mangle", "XRAY", "-p", "tcp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-			return e.New("create ap interface "+ap+" proxy on "+currentProto+" tcp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-		}
-		if err := currentIpt.Append("mangle", "XRAY", "-p", "udp", "-i", ap, "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-			return e.New("create ap interface "+ap+" proxy on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
-		}
+	return rules
+}
+
+// Ruleset get all rules of tproxy, it is used to update rules incrementally and check whether the rules are in place
+func (this *Tproxy) Ruleset() (tools.Ruleset, error) {
+	return fullRuleset()
+}
+
+// cleanIptablesChain Clean all iptables rules tagged by tproxy and quic, whatever config creates them
+func cleanIptablesChain(ipv6 bool) {
+	tools.CleanIptables(ipv6, "tproxy")
+	tools.CleanBlockQuic(ipv6)
+}
+
+// fullRuleset get all tproxy rules, include the rules which apply chains and dns rules
+func fullRuleset() (tools.Ruleset, error) {
+	rules, err := familyRuleset(false)
+	if err != nil {
+		return nil, err
 	}
-	// mark all dns request(except mihomo)
-	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "clash.meta" {
-		if err := currentIpt.Insert("mangle", "XRAY", 1, "-p", "udp", "--dport", "53", "-j", "TPROXY", "--on-port", builds.Config.Proxy.TproxyPort, "--tproxy-mark", common.TproxyMarkId); err != nil {
-			return e.New("mark all dns request on "+currentProto+" udp mangle chain XRAY failed, ", err).WithPrefix(tagTproxy)
+	if builds.Config.Proxy.EnableIPv6 {
+		rules6, err := familyRuleset(true)
+		if err != nil {
+			return nil, err
 		}
+		rules = append(rules, rules6...)
 	}
-	// apply rules to PREROUTING
-	if err := currentIpt.Append("mangle", "PREROUTING", "-j", "XRAY"); err != nil {
-		return e.New("apply mangle chain XRAY to PREROUTING failed, ", err).WithPrefix(tagTproxy)
-	}
-	return nil
+	return append(rules, tools.DNSRuleset()...), nil
 }
 
-// cleanIptablesChain Clean all changed iptables rules by XrayHelper
-func cleanIptablesChain(ipv6 bool) {
-	currentIpt := common.Ipt
-	if ipv6 {
-		currentIpt = common.Ipt6
+// familyRuleset get tproxy rules of ipv4 or ipv6
+func familyRuleset(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	if ipv6 && useDummy {
+		rules = append(rules, dummyHookRules()...)
+		rules = append(rules, dummyChainRules()...)
+	}
+	rules.Append(ipv6, "mangle", "PREROUTING", "apply mangle chain "+preroutingChain+" to PREROUTING", "-j", preroutingChain)
+	// nftables can set mark on every packet in output route chain, so output chain is applied in mangle rather than nat
+	hookTable := "nat"
+	if tools.UseNftables() {
+		hookTable = "mangle"
+	}
+	rules.Append(ipv6, hookTable, "OUTPUT", "apply chain "+outputChain+" to OUTPUT", "-j", outputChain)
+	rules = append(rules, mangleChainRules(ipv6)...)
+	proxyRules, err := proxyChainRules(ipv6)
+	if err != nil {
+		return nil, err
 	}
-	if currentIpt == nil {
-		return
+	rules = append(rules, proxyRules...).Tag("tproxy")
+	// reject quic of the traffic marked by output chain, include app groups, ap traffic is delivered to core through INPUT
+	marks := []string{common.TproxyMarkId}
+	for _, group := range builds.GetAppGroups() {
+		marks = append(marks, group.Mark)
 	}
-	_ = currentIpt.Delete("mangle", "OUTPUT", "-j", "PROXY")
-	_ = currentIpt.Delete("mangle", "PREROUTING", "-j", "XRAY")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "PROXY")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "XRAY")
+	return append(rules, tools.BlockQuicRuleset(ipv6, "INPUT", marks...)...), nil
 }
@@ -6,7 +6,6 @@ import (
 	e "XrayHelper/main/errors"
 	"XrayHelper/main/log"
 	"XrayHelper/main/proxies/tools"
-	"bytes"
 	"gopkg.in/yaml.v3"
 	"os"
 	"path"
@@ -16,6 +15,12 @@ import (
 
 const tagTun = "tun"
 
+// the chains of tun2socks, prerouting chain marks the traffic to tun device, output chain sends the local traffic to prerouting chain
+const (
+	preroutingChain = tools.ChainPrefix + "TUN_PRE"
+	outputChain     = tools.ChainPrefix + "TUN_OUT"
+)
+
 type Tun struct{}
 
 func (this *Tun) Enable() error {
@@ -28,42 +33,26 @@ func (this *Tun) Enable() error {
 			this.Disable()
 			return err
 		}
-		if err := createMangleChain(false); err != nil {
-			this.Disable()
-			return err
-		}
-		if err := createProxyChain(false); err != nil {
-			this.Disable()
-			return err
-		}
 		if builds.Config.Proxy.EnableIPv6 {
 			if err := addRoute(true); err != nil {
 				this.Disable()
 				return err
 			}
-			if err := createMangleChain(true); err != nil {
-				this.Disable()
-				return err
-			}
-			if err := createProxyChain(true); err != nil {
-				this.Disable()
-				return err
-			}
 		}
-		// handleDns, some core not support sniffing(eg: clash), need redirect dns request to local dns port
-		switch builds.Config.XrayHelper.CoreType {
-		case "clash.meta", "mihomo":
-			if err := tools.RedirectDNS(builds.Config.Clash.DNSPort); err != nil {
-				this.Disable()
-				return err
-			}
-		default:
-			if !builds.Config.Proxy.EnableIPv6 {
-				if err := tools.DisableIPV6DNS(); err != nil {
-					this.Disable()
-					return err
-				}
-			}
+		rules, err := fullRuleset()
+		if err != nil {
+			this.Disable()
+			return err
+		}
+		// all rules are committed at once, nothing is left if commit fails
+		if tools.UseNftables() {
+			err = tools.ApplyNftables(rules)
+		} else {
+			err = tools.RestoreRuleset(rules)
+		}
+		if err != nil {
+			this.Disable()
+			return err
 		}
 	} else {
 		if !tunDeviceReady(builds.Config.Proxy.TunDevice) {
@@ -80,11 +69,97 @@ func (this *Tun) Disable() {
 		//always clean ipv6 rules
 		deleteRoute(true)
 		cleanIptablesChain(true)
+		//always clean rules of both firewalls, the firewall may be changed after rules are applied
+		tools.CleanNftables()
+		//always destroy bypass ipsets after the rules which match them are deleted
+		tools.CleanBypassSets()
 		stopTun2socks()
 		//always clean dns rules
-		tools.EnableIPV6DNS()
-		tools.CleanRedirectDNS(builds.Config.Clash.DNSPort)
+		tools.CleanDNS()
+	}
+}
+
+// EnableUDP start tun2socks and add its routes, it is used by the proxy methods which cannot proxy udp traffic, the rules of UDPRuleset are applied by the caller
+func EnableUDP() error {
+	if err := startTun2socks(); err != nil {
+		return err
+	}
+	if err := addRoute(false); err != nil {
+		return err
+	}
+	if builds.Config.Proxy.EnableIPv6 {
+		if err := addRoute(true); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// DisableUDP stop tun2socks, delete its routes and rules
+func DisableUDP() {
+	deleteRoute(false)
+	cleanIptablesChain(false)
+	deleteRoute(true)
+	cleanIptablesChain(true)
+	stopTun2socks()
+}
+
+// UDPRuleset get the tun2socks rules without tcp rules, so that only udp traffic is marked to tun2socks
+func UDPRuleset() (tools.Ruleset, error) {
+	rules, err := familyRuleset(false)
+	if err != nil {
+		return nil, err
+	}
+	if builds.Config.Proxy.EnableIPv6 {
+		rules6, err := familyRuleset(true)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rules6...)
+	}
+	var udpRules tools.Ruleset
+	for _, rule := range rules {
+		isTcp := false
+		for i := 0; i+1 < len(rule.Spec); i++ {
+			if rule.Spec[i] == "-p" && rule.Spec[i+1] == "tcp" {
+				isTcp = true
+				break
+			}
+		}
+		if !isTcp {
+			udpRules = append(udpRules, rule)
+		}
+	}
+	return udpRules, nil
+}
+
+// UDPRoutes get the ip rules and routes of tun2socks which UDPRuleset needs
+func UDPRoutes() []tools.Route {
+	routeList := routes(false)
+	if builds.Config.Proxy.EnableIPv6 {
+		routeList = append(routeList, routes(true)...)
+	}
+	return routeList
+}
+
+// Enabled check whether the tun rules are applied, core tun mode only check the tun device
+func (this *Tun) Enabled() bool {
+	if builds.Config.Proxy.Method == "tun2socks" {
+		if tools.UseNftables() {
+			return tools.NftablesEnabled()
+		}
+		if common.Ipt == nil {
+			return false
+		}
+		if exist, err := common.Ipt.ChainExists("mangle", outputChain); err != nil || !exist {
+			return false
+		}
+		if exist, err := common.Ipt.ChainExists("mangle", preroutingChain); err != nil || !exist {
+			return false
+		}
+		return true
+	}
+	return common.CheckLocalDevice(builds.Config.Proxy.TunDevice)
 }
 
 func tunDeviceReady(checkDev string) bool {
@@ -129,7 +204,11 @@ func startTun2socks() error {
 	if err := os.WriteFile(tun2socksConfigPath, configByte, 0644); err != nil {
 		return e.New("write tun2socks config failed, ", err).WithPrefix(tagTun)
 	}
-	tun2socksLogFile, err := os.OpenFile(path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.log"), os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0644)
+	tun2socksLogPath := path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.log")
+	if err := log.Rotate(tun2socksLogPath, builds.Config.Log.Keep); err != nil {
+		return err
+	}
+	tun2socksLogFile, err := os.OpenFile(tun2socksLogPath, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_APPEND, 0644)
 	if err != nil {
 		return e.New("open tun2socks log file failed, ", err).WithPrefix(tagTun)
 	}
@@ -150,19 +229,31 @@ func startTun2socks() error {
 	return nil
 }
 
+// GetTun2socksPid get tun2socks pid from pid file, return 0 if tun2socks is not running
+func GetTun2socksPid() int {
+	pid, err := common.ReadPidFile(path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.pid"))
+	if err != nil {
+		log.HandleDebug(err)
+		return 0
+	}
+	if !common.CheckProcess(pid, path.Join(path.Dir(builds.Config.XrayHelper.CorePath), "tun2socks")) {
+		return 0
+	}
+	return pid
+}
+
 func stopTun2socks() {
-	if _, err := os.Stat(path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.pid")); err == nil {
-		pidFile, err := os.ReadFile(path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.pid"))
-		if err != nil {
-			log.HandleDebug(err)
-		}
-		pid, _ := strconv.Atoi(string(pidFile))
-		if serviceProcess, err := os.FindProcess(pid); err == nil {
-			_ = serviceProcess.Kill()
-			_ = os.Remove(path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.pid"))
+	tun2socksPath := path.Join(path.Dir(builds.Config.XrayHelper.CorePath), "tun2socks")
+	pidPath := path.Join(builds.Config.XrayHelper.RunDir, "tun2socks.pid")
+	if pid, err := common.ReadPidFile(pidPath); err == nil {
+		if common.CheckProcess(pid, tun2socksPath) {
+			if err := common.StopProcess(pid, time.Duration(*builds.StopTimeout)*time.Second); err != nil {
+				log.HandleError(err)
+			}
 		} else {
-			log.HandleDebug(err)
+			log.HandleInfo("proxy: tun2socks.pid is stale, pid " + strconv.Itoa(pid) + " does not belong to tun2socks, remove it")
 		}
+		_ = os.Remove(pidPath)
 	} else {
 		log.HandleDebug(err)
 	}
@@ -172,288 +263,248 @@ func stopTun2socks() {
 	}
 }
 
+// routes get the ip rules and routes of tun2socks
+func routes(ipv6 bool) []tools.Route {
+	routeList := []tools.Route{common.IPRule{IPv6: ipv6, Table: common.TunTableId, Mark: common.TunMarkId}}
+	if ipv6 {
+		// when device do not have ipv6 address, route all ipv6 traffic to tun
+		routeList = append(routeList, common.IPRule{IPv6: true, Table: common.TunTableId, Priority: "31999"})
+	}
+	return append(routeList, common.IPRoute{IPv6: ipv6, Table: common.TunTableId, Dev: builds.Config.Proxy.TunDevice})
+}
+
+// Routes get the ip rules and routes of tun2socks, it is used to check whether the routes are in place, core tun mode has no routes
+func (this *Tun) Routes() []tools.Route {
+	if builds.Config.Proxy.Method != "tun2socks" {
+		return nil
+	}
+	routeList := routes(false)
+	if builds.Config.Proxy.EnableIPv6 {
+		routeList = append(routeList, routes(true)...)
+	}
+	return routeList
+}
+
 // addRoute Add ip route to proxy
 func addRoute(ipv6 bool) error {
-	var errMsg bytes.Buffer
-	if !ipv6 {
-		common.NewExternal(0, nil, &errMsg, "ip", "rule", "add", "fwmark", common.TunMarkId, "lookup", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTun)
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "route", "add", "default", "dev", builds.Config.Proxy.TunDevice, "table", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTun)
-		}
-	} else {
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "add", "fwmark", common.TunMarkId, "lookup", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTun)
-		}
-		errMsg.Reset()
-		// when device do not have ipv6 address, route all ipv6 traffic to tun
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "add", "from", "all", "lookup", common.TunTableId, "prio", "31999").Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip rule failed, ", errMsg.String()).WithPrefix(tagTun)
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "route", "add", "default", "dev", builds.Config.Proxy.TunDevice, "table", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			return e.New("add ip route failed, ", errMsg.String()).WithPrefix(tagTun)
+	for _, route := range routes(ipv6) {
+		if err := route.Add(); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-// deleteRoute Delete ip route to proxy
+// deleteRoute Delete ip route to proxy, all rules which look up tun2socks table are deleted
 func deleteRoute(ipv6 bool) {
-	var errMsg bytes.Buffer
-	if !ipv6 {
-		common.NewExternal(0, nil, &errMsg, "ip", "rule", "del", "fwmark", common.TunMarkId, "lookup", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip rule: " + errMsg.String())
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "route", "flush", "table", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip route: " + errMsg.String())
-		}
-	} else {
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "del", "fwmark", common.TunMarkId, "lookup", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip rule: " + errMsg.String())
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "rule", "del", "from", "all", "lookup", common.TunTableId, "prio", "31999").Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip rule: " + errMsg.String())
-		}
-		errMsg.Reset()
-		common.NewExternal(0, nil, &errMsg, "ip", "-6", "route", "flush", "table", common.TunTableId).Run()
-		if errMsg.Len() > 0 {
-			log.HandleDebug("delete ip route: " + errMsg.String())
-		}
+	if err := common.DeleteIPRules(ipv6, common.TunTableId); err != nil {
+		log.HandleDebug(err)
+	}
+	if err := common.FlushIPRoutes(ipv6, common.TunTableId); err != nil {
+		log.HandleDebug(err)
 	}
 }
 
-// createProxyChain Create XT chain for local applications
-func createProxyChain(ipv6 bool) error {
-	var currentProto string
-	currentIpt := common.Ipt
-	currentProto = "ipv4"
-	if ipv6 {
-		currentIpt = common.Ipt6
-		currentProto = "ipv6"
+// proxyChainRules get the rules of output chain
+func proxyChainRules(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	xt := func(desc string, spec ...string) {
+		rules.Append(ipv6, "mangle", outputChain, desc, spec...)
 	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTun)
+	// mark all dns request if dns is hijacked by tproxy
+	if builds.GetDNSHijack() == "tproxy" {
+		xt("mark all dns request", "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", preroutingChain)
+		xt("mark all dns request", "-p", "tcp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", preroutingChain)
 	}
-	if err := currentIpt.NewChain("mangle", "XT"); err != nil {
-		return e.New("create "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
+	// allow IntraList
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if ipv6 == common.IsIPv6(intra) {
+			xt("allow intra "+intra, "-p", "udp", "-d", intra, "-j", preroutingChain)
+			xt("allow intra "+intra, "-p", "tcp", "-d", intra, "-j", preroutingChain)
+		}
 	}
-	// bypass tun2socks
-	if err := currentIpt.Append("mangle", "XT", "-o", builds.Config.Proxy.TunDevice, "-j", "RETURN"); err != nil {
-		return e.New("ignore tun2socks interface "+builds.Config.Proxy.TunDevice+" on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
+	// bypass PkgList
+	if len(builds.Config.Proxy.PkgList) > 0 && builds.Config.Proxy.Mode == "blacklist" {
+		for _, pkg := range builds.Config.Proxy.PkgList {
+			uids, err := tools.GetUids(pkg)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			matches, err := tools.GetPackageMatches(pkg, false)
+			if err != nil {
+				log.HandleDebug(err)
+				continue
+			}
+			for _, uid := range uids {
+				for _, match := range matches {
+					xt("bypass package "+pkg, match.Spec(uid, "-j", "RETURN")...)
+				}
+			}
+		}
 	}
+	// bypass tun2socks
+	xt("ignore tun2socks interface "+builds.Config.Proxy.TunDevice, "-o", builds.Config.Proxy.TunDevice, "-j", "RETURN")
 	// bypass ignore list
 	for _, ignore := range builds.Config.Proxy.IgnoreList {
-		if err := currentIpt.Append("mangle", "XT", "-o", ignore, "-j", "RETURN"); err != nil {
-			return e.New("apply ignore interface "+ignore+" on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
+		xt("apply ignore interface "+ignore, "-o", ignore, "-j", "RETURN")
+	}
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		xt("bypass lists", tools.BypassSpec(ipv6)...)
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
+	if !ipv6 {
 		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("mangle", "XT", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
-			}
+			xt("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
 		}
 	} else {
 		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("mangle", "XT", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
-			}
+			xt("bypass intraNet "+intraIp6, "-d", intraIp6, "-j", "RETURN")
 		}
 	}
 	// bypass Core itself
-	if err := currentIpt.Append("mangle", "XT", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN"); err != nil {
-		return e.New("bypass core gid on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
-	}
+	xt("bypass core gid", "-m", "owner", "--gid-owner", common.CoreGid, "-j", "RETURN")
 	// start processing proxy rules
 	// if PkgList has no package, should proxy everything
-	if len(builds.Config.Proxy.PkgList) == 0 {
-		if err := currentIpt.Append("mangle", "XT", "-p", "tcp", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-		if err := currentIpt.Append("mangle", "XT", "-p", "udp", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-	} else if builds.Config.Proxy.Mode == "blacklist" {
-		// bypass PkgList
+	if len(builds.Config.Proxy.PkgList) == 0 || builds.Config.Proxy.Mode == "blacklist" {
+		xt("create local applications proxy", "-p", "tcp", "-j", preroutingChain)
+		xt("create local applications proxy", "-p", "udp", "-j", preroutingChain)
+	} else if builds.Config.Proxy.Mode == "whitelist" {
+		// allow PkgList
 		for _, pkg := range builds.Config.Proxy.PkgList {
-			uid, err := tools.GetUid(pkg)
+			uids, err := tools.GetUids(pkg)
 			if err != nil {
 				log.HandleDebug(err)
 				continue
 			}
-			if err := currentIpt.Insert("mangle", "XT", 1, "-m", "owner", "--uid-owner", uid, "-j", "RETURN"); err != nil {
-				return e.New("bypass package "+pkg+" on "+currentProto+" mangle chain XT failed, ", err).WithPrefix(tagTun)
-			}
-		}
-		// allow others
-		if err := currentIpt.Append("mangle", "XT", "-p", "tcp", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-		if err := currentIpt.Append("mangle", "XT", "-p", "udp", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create local applications proxy on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-	} else if builds.Config.Proxy.Mode == "whitelist" {
-		// allow PkgList
-		for _, pkg := range builds.Config.Proxy.PkgList {
-			uid, err := tools.GetUid(pkg)
+			matches, err := tools.GetPackageMatches(pkg, true)
 			if err != nil {
 				log.HandleDebug(err)
 				continue
 			}
-			if err := currentIpt.Append("mangle", "XT", "-p", "tcp", "-m", "owner", "--uid-owner", uid, "-j", "TUN2SOCKS"); err != nil {
-				return e.New("create package "+pkg+" proxy on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-			}
-			if err := currentIpt.Append("mangle", "XT", "-p", "udp", "-m", "owner", "--uid-owner", uid, "-j", "TUN2SOCKS"); err != nil {
-				return e.New("create package "+pkg+" proxy on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
+			for _, uid := range uids {
+				for _, match := range matches {
+					xt("create package "+pkg+" proxy", match.Spec(uid, "-j", preroutingChain)...)
+				}
 			}
 		}
 		// allow root user(eg: magisk, ksud, netd...)
-		if err := currentIpt.Append("mangle", "XT", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create root user proxy on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-		if err := currentIpt.Append("mangle", "XT", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create root user proxy on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
+		xt("create root user proxy", "-p", "tcp", "-m", "owner", "--uid-owner", "0", "-j", preroutingChain)
+		xt("create root user proxy", "-p", "udp", "-m", "owner", "--uid-owner", "0", "-j", preroutingChain)
 		// allow dns_tether user(eg: dnsmasq...)
-		if err := currentIpt.Append("mangle", "XT", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create dns_tether user proxy on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
-		if err := currentIpt.Append("mangle", "XT", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("create dns_tether user proxy on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
-		}
+		xt("create dns_tether user proxy", "-p", "tcp", "-m", "owner", "--uid-owner", "1052", "-j", preroutingChain)
+		xt("create dns_tether user proxy", "-p", "udp", "-m", "owner", "--uid-owner", "1052", "-j", preroutingChain)
 	} else {
-		return e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagTun)
+		return nil, e.New("invalid proxy mode " + builds.Config.Proxy.Mode).WithPrefix(tagTun)
 	}
-	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("mangle", "XT", 1, "-p", "tcp", "-d", intra, "-j", "TUN2SOCKS"); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain XT failed, ", err).WithPrefix(tagTun)
-			}
-			if err := currentIpt.Insert("mangle", "XT", 1, "-p", "udp", "-d", intra, "-j", "TUN2SOCKS"); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
+	return rules, nil
+}
+
+// mangleChainRules get the rules of prerouting chain
+func mangleChainRules(ipv6 bool) tools.Ruleset {
+	var rules tools.Ruleset
+	tun2socks := func(desc string, spec ...string) {
+		rules.Append(ipv6, "mangle", preroutingChain, desc, spec...)
+	}
+	mark := []string{"-j", "MARK", "--set-xmark", common.TunMarkId}
+	// mark all dns request if dns is hijacked by tproxy
+	if builds.GetDNSHijack() == "tproxy" {
+		tun2socks("mark all dns request", append([]string{"-p", "udp", "--dport", "53"}, mark...)...)
+		tun2socks("mark all dns request", append([]string{"-p", "tcp", "--dport", "53"}, mark...)...)
+	}
+	// bypass the denied ap clients
+	for _, source := range tools.BypassedApSources(ipv6) {
+		tun2socks("bypass "+source.String(), source.Spec("", "-j", "RETURN")...)
+	}
+	// allow ApList to IntraList
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		for _, intra := range builds.Config.Proxy.IntraList {
+			if ipv6 == common.IsIPv6(intra) {
+				tun2socks("allow intra "+intra, source.Spec("udp", append([]string{"-d", intra}, mark...)...)...)
+				tun2socks("allow intra "+intra, source.Spec("tcp", append([]string{"-d", intra}, mark...)...)...)
 			}
 		}
 	}
-	// mark all dns request(except mihomo)
-	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "clash.meta" {
-		if err := currentIpt.Insert("mangle", "XT", 1, "-p", "udp", "-m", "owner", "!", "--gid-owner", common.CoreGid, "--dport", "53", "-j", "TUN2SOCKS"); err != nil {
-			return e.New("mark all dns request on "+currentProto+" udp mangle chain XT failed, ", err).WithPrefix(tagTun)
+	// allow IntraList
+	for _, intra := range builds.Config.Proxy.IntraList {
+		if ipv6 == common.IsIPv6(intra) {
+			tun2socks("allow intra "+intra, append([]string{"-p", "udp", "-d", intra}, mark...)...)
+			tun2socks("allow intra "+intra, append([]string{"-p", "tcp", "-d", intra}, mark...)...)
 		}
 	}
-	// apply rules to OUTPUT
-	if err := currentIpt.Append("mangle", "OUTPUT", "-j", "XT"); err != nil {
-		return e.New("apply mangle chain XT to OUTPUT failed, ", err).WithPrefix(tagTun)
-	}
-	return nil
-}
-
-// createMangleChain Create TUN2SOCKS chain for AP interface, there will be problem on some device
-func createMangleChain(ipv6 bool) error {
-	var currentProto string
-	currentIpt := common.Ipt
-	currentProto = "ipv4"
-	if ipv6 {
-		currentIpt = common.Ipt6
-		currentProto = "ipv6"
-	}
-	if currentIpt == nil {
-		return e.New("get iptables failed").WithPrefix(tagTun)
-	}
-	if err := currentIpt.NewChain("mangle", "TUN2SOCKS"); err != nil {
-		return e.New("create "+currentProto+" mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
+	// bypass the destination in bypass lists
+	if tools.BypassEnabled() {
+		tun2socks("bypass lists", tools.BypassSpec(ipv6)...)
 	}
 	// bypass intraNet list
-	if currentProto == "ipv4" {
+	if !ipv6 {
 		for _, intraIp := range common.IntraNet {
-			if err := currentIpt.Append("mangle", "TUN2SOCKS", "-d", intraIp, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp+" on "+currentProto+" mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-			}
+			tun2socks("bypass intraNet "+intraIp, "-d", intraIp, "-j", "RETURN")
 		}
 	} else {
 		for _, intraIp6 := range common.IntraNet6 {
-			if err := currentIpt.Append("mangle", "TUN2SOCKS", "-d", intraIp6, "-j", "RETURN"); err != nil {
-				return e.New("bypass intraNet "+intraIp6+" on "+currentProto+" mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-			}
+			tun2socks("bypass intraNet "+intraIp6, "-d", intraIp6, "-j", "RETURN")
 		}
 	}
-	// allow IntraList
-	for _, intra := range builds.Config.Proxy.IntraList {
-		if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-			if err := currentIpt.Insert("mangle", "TUN2SOCKS", 1, "-p", "tcp", "-d", intra, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-			}
-			if err := currentIpt.Insert("mangle", "TUN2SOCKS", 1, "-p", "udp", "-d", intra, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-				return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-			}
+	// trans ApList to prerouting chain, MARK does not stop the chain, so in allow mode the other ap clients
+	// are returned after the allowed clients are marked, before all traffic is marked
+	for _, source := range tools.ProxiedApSources(ipv6) {
+		tun2socks("create "+source.String()+" proxy", source.Spec("tcp", mark...)...)
+		tun2socks("create "+source.String()+" proxy", source.Spec("udp", mark...)...)
+	}
+	if builds.ApClientAllowMode() {
+		for _, ap := range builds.Config.Proxy.ApList {
+			tun2socks("bypass other ap clients on "+ap, "-i", ap, "-j", "RETURN")
 		}
 	}
 	// mark all traffic
-	if err := currentIpt.Append("mangle", "TUN2SOCKS", "-p", "tcp", "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-		return e.New("create all traffic proxy on "+currentProto+" tcp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-	}
-	if err := currentIpt.Append("mangle", "TUN2SOCKS", "-p", "udp", "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-		return e.New("create all traffic proxy on "+currentProto+" udp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
+	tun2socks("create all traffic proxy", append([]string{"-p", "tcp"}, mark...)...)
+	tun2socks("create all traffic proxy", append([]string{"-p", "udp"}, mark...)...)
+	return rules
+}
+
+// Ruleset get all rules of tun2socks, it is used to update rules incrementally and check whether the rules are in place, core tun mode has no rules
+func (this *Tun) Ruleset() (tools.Ruleset, error) {
+	if builds.Config.Proxy.Method != "tun2socks" {
+		return nil, nil
 	}
-	// trans ApList to chain XRAY
-	for _, ap := range builds.Config.Proxy.ApList {
-		// allow ApList to IntraList
-		for _, intra := range builds.Config.Proxy.IntraList {
-			if (currentProto == "ipv4" && !common.IsIPv6(intra)) || (currentProto == "ipv6" && common.IsIPv6(intra)) {
-				if err := currentIpt.Insert("mangle", "TUN2SOCKS", 1, "-p", "tcp", "-i", ap, "-d", intra, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" tcp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-				}
-				if err := currentIpt.Insert("mangle", "TUN2SOCKS", 1, "-p", "udp", "-i", ap, "-d", intra, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-					return e.New("allow intra "+intra+" on "+currentProto+" udp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-				}
-			}
-		}
-		if err := currentIpt.Append("mangle", "TUN2SOCKS", "-p", "tcp", "-i", ap, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-			return e.New("create ap interface "+ap+" proxy on "+currentProto+" tcp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-		}
-		if err := currentIpt.Append("mangle", "TUN2SOCKS", "-p", "udp", "-i", ap, "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-			return e.New("create ap interface "+ap+" proxy on "+currentProto+" udp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
-		}
+	return fullRuleset()
+}
+
+// cleanIptablesChain Clean all iptables rules tagged by tun2socks and quic, whatever config creates them
+func cleanIptablesChain(ipv6 bool) {
+	tools.CleanIptables(ipv6, "tun")
+	tools.CleanBlockQuic(ipv6)
+}
+
+// fullRuleset get all tun2socks rules, include the rules which apply chains and dns rules
+func fullRuleset() (tools.Ruleset, error) {
+	rules, err := familyRuleset(false)
+	if err != nil {
+		return nil, err
 	}
-	// mark all dns request(except mihomo)
-	if builds.Config.XrayHelper.CoreType != "mihomo" && builds.Config.XrayHelper.CoreType != "clash.meta" {
-		if err := currentIpt.Insert("mangle", "TUN2SOCKS", 1, "-p", "udp", "--dport", "53", "-j", "MARK", "--set-xmark", common.TunMarkId); err != nil {
-			return e.New("mark all dns request on "+currentProto+" udp mangle chain TUN2SOCKS failed, ", err).WithPrefix(tagTun)
+	if builds.Config.Proxy.EnableIPv6 {
+		rules6, err := familyRuleset(true)
+		if err != nil {
+			return nil, err
 		}
+		rules = append(rules, rules6...)
 	}
-	// apply rules to PREROUTING
-	if err := currentIpt.Append("mangle", "PREROUTING", "-j", "TUN2SOCKS"); err != nil {
-		return e.New("apply mangle chain TUN2SOCKS to PREROUTING failed, ", err).WithPrefix(tagTun)
-	}
-	return nil
+	return append(rules, tools.DNSRuleset()...), nil
 }
 
-// cleanIptablesChain Clean all changed iptables rules by XrayHelper
-func cleanIptablesChain(ipv6 bool) {
-	currentIpt := common.Ipt
-	if ipv6 {
-		currentIpt = common.Ipt6
-	}
-	if currentIpt == nil {
-		return
+// familyRuleset get tun2socks rules of ipv4 or ipv6
+func familyRuleset(ipv6 bool) (tools.Ruleset, error) {
+	var rules tools.Ruleset
+	rules.Append(ipv6, "mangle", "PREROUTING", "apply mangle chain "+preroutingChain+" to PREROUTING", "-j", preroutingChain)
+	rules.Append(ipv6, "mangle", "OUTPUT", "apply mangle chain "+outputChain+" to OUTPUT", "-j", outputChain)
+	rules = append(rules, mangleChainRules(ipv6)...)
+	proxyRules, err := proxyChainRules(ipv6)
+	if err != nil {
+		return nil, err
 	}
-	_ = currentIpt.Delete("mangle", "OUTPUT", "-j", "XT")
-	_ = currentIpt.Delete("mangle", "PREROUTING", "-j", "TUN2SOCKS")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "XT")
-	_ = currentIpt.ClearAndDeleteChain("mangle", "TUN2SOCKS")
+	rules = append(rules, proxyRules...).Tag("tun")
+	// reject quic of the traffic marked by output and prerouting chain, ap traffic is forwarded to tun device
+	return append(rules, tools.BlockQuicRuleset(ipv6, "FORWARD", common.TunMarkId)...), nil
 }
@@ -5,6 +5,7 @@ import (
 	"XrayHelper/main/serial"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 const tagShadowsocks = "shadowsocks"
@@ -33,6 +34,18 @@ func (this *Shadowsocks) ToOutboundWithTag(coreType string, tag string) (*serial
 		outboundObject.Set("streamSettings", getStreamSettingsObjectXray("tcp"))
 		outboundObject.Set("tag", tag)
 		return &outboundObject, nil
+	case "v2ray":
+		if len(this.Plugin) > 0 {
+			return nil, e.New("v2ray does not support shadowsocks plugin " + this.Plugin).WithPrefix(tagShadowsocks).WithPathObj(*this)
+		}
+		if strings.HasPrefix(this.Method, "2022-") {
+			return nil, e.New("v2ray does not support shadowsocks method " + this.Method).WithPrefix(tagShadowsocks).WithPathObj(*this)
+		}
+		var outboundObject serial.OrderedMap
+		outboundObject.Set("protocol", "shadowsocks")
+		outboundObject.Set("settings", getShadowsocksSettingsObjectV2ray(this))
+		outboundObject.Set("tag", tag)
+		return &outboundObject, nil
 	case "sing-box":
 		var outboundObject serial.OrderedMap
 		outboundObject.Set("type", "shadowsocks")
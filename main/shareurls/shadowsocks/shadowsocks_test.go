@@ -18,3 +18,21 @@ func TestShadowsocks(t *testing.T) {
 	out, err := json.MarshalIndent(tag, "", "    ")
 	fmt.Println(string(out))
 }
+
+func TestShadowsocksV2ray(t *testing.T) {
+	shareUrl, err := shareurls.Parse(testSS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := shareUrl.ToOutboundWithTag("v2ray", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"protocol":"shadowsocks","settings":{"address":"0.0.0.0","port":65535,"method":"aes-256-gcm","password":"testshadowsocks"},"tag":"proxy"}`; string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
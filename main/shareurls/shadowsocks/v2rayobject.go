@@ -0,0 +1,17 @@
+package shadowsocks
+
+import (
+	"XrayHelper/main/serial"
+	"strconv"
+)
+
+// getShadowsocksSettingsObjectV2ray get v2ray v5 Shadowsocks SettingsObject
+func getShadowsocksSettingsObjectV2ray(shadowsocks *Shadowsocks) serial.OrderedMap {
+	var settingsObject serial.OrderedMap
+	settingsObject.Set("address", shadowsocks.Server)
+	port, _ := strconv.Atoi(shadowsocks.Port)
+	settingsObject.Set("port", port)
+	settingsObject.Set("method", shadowsocks.Method)
+	settingsObject.Set("password", shadowsocks.Password)
+	return settingsObject
+}
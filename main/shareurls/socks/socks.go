@@ -31,6 +31,16 @@ func (this *Socks) ToOutboundWithTag(coreType string, tag string) (*serial.Order
 		outboundObject.Set("streamSettings", getStreamSettingsObjectXray("tcp"))
 		outboundObject.Set("tag", tag)
 		return &outboundObject, nil
+	case "v2ray":
+		// v2ray v5 socks outbound does not support authentication, v2rayNg share "null" user for no auth socks server
+		if len(this.User) > 0 && this.User != "null" {
+			return nil, e.New("v2ray does not support socks authentication").WithPrefix(tagSocks).WithPathObj(*this)
+		}
+		var outboundObject serial.OrderedMap
+		outboundObject.Set("protocol", "socks")
+		outboundObject.Set("settings", getSocksSettingsObjectV2ray(this))
+		outboundObject.Set("tag", tag)
+		return &outboundObject, nil
 	case "sing-box":
 		var outboundObject serial.OrderedMap
 		outboundObject.Set("type", "socks")
@@ -19,3 +19,29 @@ func TestSocks(t *testing.T) {
 	indent, err := json.MarshalIndent(tag, "", "    ")
 	fmt.Println(string(indent))
 }
+
+func TestSocksV2ray(t *testing.T) {
+	const v2raySocks = "socks://bnVsbDpudWxs@socks5.com:1080#socks"
+	shareUrl, err := shareurls.Parse(v2raySocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := shareUrl.ToOutboundWithTag("v2ray", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"protocol":"socks","settings":{"address":"socks5.com","port":1080},"tag":"proxy"}`; string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+	unsupported, err := shareurls.Parse(testSocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsupported.ToOutboundWithTag("v2ray", "proxy"); err == nil {
+		t.Error("v2ray should not support socks authentication")
+	}
+}
@@ -0,0 +1,15 @@
+package socks
+
+import (
+	"XrayHelper/main/serial"
+	"strconv"
+)
+
+// getSocksSettingsObjectV2ray get v2ray v5 Socks SettingsObject
+func getSocksSettingsObjectV2ray(socks *Socks) serial.OrderedMap {
+	var settingsObject serial.OrderedMap
+	settingsObject.Set("address", socks.Server)
+	port, _ := strconv.Atoi(socks.Port)
+	settingsObject.Set("port", port)
+	return settingsObject
+}
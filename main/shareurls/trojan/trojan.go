@@ -50,6 +50,16 @@ func (this *Trojan) ToOutboundWithTag(coreType string, tag string) (*serial.Orde
 		outboundObject.Set("streamSettings", getStreamSettingsObjectXray(this))
 		outboundObject.Set("tag", tag)
 		return &outboundObject, nil
+	case "v2ray":
+		if this.Security == "reality" {
+			return nil, e.New("v2ray does not support reality").WithPrefix(tagTrojan).WithPathObj(*this)
+		}
+		var outboundObject serial.OrderedMap
+		outboundObject.Set("protocol", "trojan")
+		outboundObject.Set("settings", getTrojanSettingsObjectV2ray(this))
+		outboundObject.Set("streamSettings", getStreamSettingsObjectV2ray(this))
+		outboundObject.Set("tag", tag)
+		return &outboundObject, nil
 	case "sing-box":
 		var outboundObject serial.OrderedMap
 		outboundObject.Set("type", "trojan")
@@ -19,3 +19,29 @@ func TestTrojan(t *testing.T) {
 	indent, err := json.MarshalIndent(tag, "", "    ")
 	fmt.Println(string(indent))
 }
+
+func TestTrojanV2ray(t *testing.T) {
+	const v2rayTrojan = "trojan://asd-asfasf-asfasf@tj.com:443?security=tls&type=grpc&serviceName=wwwssss&sni=baidu.com#tj"
+	shareUrl, err := shareurls.Parse(v2rayTrojan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := shareUrl.ToOutboundWithTag("v2ray", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"protocol":"trojan","settings":{"address":"tj.com","port":443,"password":"asd-asfasf-asfasf"},"streamSettings":{"transport":"grpc","transportSettings":{"serviceName":"wwwssss"},"security":"tls","securitySettings":{"serverName":"baidu.com"}},"tag":"proxy"}`; string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+	unsupported, err := shareurls.Parse(testTrojan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsupported.ToOutboundWithTag("v2ray", "proxy"); err == nil {
+		t.Error("v2ray should not support reality")
+	}
+}
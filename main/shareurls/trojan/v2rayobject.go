@@ -0,0 +1,30 @@
+package trojan
+
+import (
+	"XrayHelper/main/serial"
+	"XrayHelper/main/shareurls/v2ray"
+	"strconv"
+)
+
+// getTrojanSettingsObjectV2ray get v2ray v5 Trojan SettingsObject
+func getTrojanSettingsObjectV2ray(trojan *Trojan) serial.OrderedMap {
+	var settingsObject serial.OrderedMap
+	settingsObject.Set("address", trojan.Server)
+	port, _ := strconv.Atoi(trojan.Port)
+	settingsObject.Set("port", port)
+	settingsObject.Set("password", trojan.Password)
+	return settingsObject
+}
+
+// getStreamSettingsObjectV2ray get v2ray v5 StreamSettingsObject
+func getStreamSettingsObjectV2ray(trojan *Trojan) serial.OrderedMap {
+	return v2ray.GetStreamSettingsObject(v2ray.Stream{
+		Network: trojan.Network,
+		Type:    trojan.Type,
+		Host:    trojan.Host,
+		Path:    trojan.Path,
+		Tls:     trojan.Security == "tls",
+		Sni:     trojan.Sni,
+		Alpn:    trojan.Alpn,
+	})
+}
@@ -0,0 +1,114 @@
+package v2ray
+
+import (
+	"XrayHelper/main/serial"
+	"strings"
+)
+
+// Stream the stream fields shared by vmess, vless and trojan share links
+type Stream struct {
+	Network string
+	// Type tcp->header type
+	Type string
+	Host string
+	// Path ws/httpupgrade/h2->path kcp->seed grpc->serviceName
+	Path string
+	Tls  bool
+	Sni  string
+	// Alpn comma separated alpn list
+	Alpn string
+}
+
+// GetStreamSettingsObject get v2ray v5 StreamSettingsObject
+func GetStreamSettingsObject(stream Stream) serial.OrderedMap {
+	var streamSettingsObject serial.OrderedMap
+	var transportSettingsObject serial.OrderedMap
+	switch stream.Network {
+	case "tcp":
+		streamSettingsObject.Set("transport", "tcp")
+		if stream.Type == "http" {
+			var requestObject serial.OrderedMap
+			var uri serial.OrderedArray
+			uri = append(uri, "/")
+			requestObject.Set("uri", uri)
+			if len(stream.Host) > 0 {
+				var headerArray serial.OrderedArray
+				var header serial.OrderedMap
+				var host serial.OrderedArray
+				host = append(host, stream.Host)
+				header.Set("name", "Host")
+				header.Set("value", host)
+				headerArray = append(headerArray, header)
+				requestObject.Set("header", headerArray)
+			}
+			var headerSettingsObject serial.OrderedMap
+			headerSettingsObject.Set("@type", "v2ray.core.transport.internet.headers.http.Config")
+			headerSettingsObject.Set("request", requestObject)
+			transportSettingsObject.Set("headerSettings", headerSettingsObject)
+		}
+	case "kcp":
+		streamSettingsObject.Set("transport", "kcp")
+		if len(stream.Path) > 0 {
+			var seedObject serial.OrderedMap
+			seedObject.Set("seed", stream.Path)
+			transportSettingsObject.Set("seed", seedObject)
+		}
+	case "ws":
+		streamSettingsObject.Set("transport", "ws")
+		if len(stream.Path) > 0 {
+			transportSettingsObject.Set("path", stream.Path)
+		}
+		if len(stream.Host) > 0 {
+			var headerArray serial.OrderedArray
+			var header serial.OrderedMap
+			header.Set("key", "Host")
+			header.Set("value", stream.Host)
+			headerArray = append(headerArray, header)
+			transportSettingsObject.Set("header", headerArray)
+		}
+	case "http", "h2":
+		streamSettingsObject.Set("transport", "h2")
+		if len(stream.Host) > 0 {
+			var host serial.OrderedArray
+			host = append(host, stream.Host)
+			transportSettingsObject.Set("host", host)
+		}
+		if len(stream.Path) > 0 {
+			transportSettingsObject.Set("path", stream.Path)
+		}
+	case "httpupgrade":
+		streamSettingsObject.Set("transport", "httpupgrade")
+		if len(stream.Host) > 0 {
+			transportSettingsObject.Set("host", stream.Host)
+		}
+		if len(stream.Path) > 0 {
+			transportSettingsObject.Set("path", stream.Path)
+		}
+	case "quic":
+		streamSettingsObject.Set("transport", "quic")
+	case "grpc":
+		streamSettingsObject.Set("transport", "grpc")
+		if len(stream.Path) > 0 {
+			transportSettingsObject.Set("serviceName", stream.Path)
+		}
+	}
+	streamSettingsObject.Set("transportSettings", transportSettingsObject)
+	if stream.Tls {
+		streamSettingsObject.Set("security", "tls")
+		var securitySettingsObject serial.OrderedMap
+		if len(stream.Sni) > 0 {
+			securitySettingsObject.Set("serverName", stream.Sni)
+		}
+		var alpn serial.OrderedArray
+		for _, v := range strings.Split(stream.Alpn, ",") {
+			if len(v) > 0 {
+				alpn = append(alpn, v)
+			}
+		}
+		if len(alpn) > 0 {
+			securitySettingsObject.Set("nextProtocol", alpn)
+		}
+		streamSettingsObject.Set("securitySettings", securitySettingsObject)
+	}
+	return streamSettingsObject
+}
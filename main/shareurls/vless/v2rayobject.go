@@ -0,0 +1,30 @@
+package vless
+
+import (
+	"XrayHelper/main/serial"
+	"XrayHelper/main/shareurls/v2ray"
+	"strconv"
+)
+
+// getVLESSSettingsObjectV2ray get v2ray v5 VLESS SettingsObject
+func getVLESSSettingsObjectV2ray(vless *VLESS) serial.OrderedMap {
+	var settingsObject serial.OrderedMap
+	settingsObject.Set("address", vless.Server)
+	port, _ := strconv.Atoi(vless.Port)
+	settingsObject.Set("port", port)
+	settingsObject.Set("uuid", vless.Id)
+	return settingsObject
+}
+
+// getStreamSettingsObjectV2ray get v2ray v5 StreamSettingsObject
+func getStreamSettingsObjectV2ray(vless *VLESS) serial.OrderedMap {
+	return v2ray.GetStreamSettingsObject(v2ray.Stream{
+		Network: vless.Network,
+		Type:    vless.Type,
+		Host:    vless.Host,
+		Path:    vless.Path,
+		Tls:     vless.Security == "tls",
+		Sni:     vless.Sni,
+		Alpn:    vless.Alpn,
+	})
+}
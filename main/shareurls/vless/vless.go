@@ -52,6 +52,20 @@ func (this *VLESS) ToOutboundWithTag(coreType string, tag string) (*serial.Order
 		outboundObject.Set("streamSettings", getStreamSettingsObjectXray(this))
 		outboundObject.Set("tag", tag)
 		return &outboundObject, nil
+	case "v2ray":
+		// v2ray does not support xtls flow and reality
+		if len(this.Flow) > 0 {
+			return nil, e.New("v2ray does not support flow " + this.Flow).WithPrefix(tagVless).WithPathObj(*this)
+		}
+		if this.Security == "reality" {
+			return nil, e.New("v2ray does not support reality").WithPrefix(tagVless).WithPathObj(*this)
+		}
+		var outboundObject serial.OrderedMap
+		outboundObject.Set("protocol", "vless")
+		outboundObject.Set("settings", getVLESSSettingsObjectV2ray(this))
+		outboundObject.Set("streamSettings", getStreamSettingsObjectV2ray(this))
+		outboundObject.Set("tag", tag)
+		return &outboundObject, nil
 	case "sing-box":
 		var outboundObject serial.OrderedMap
 		outboundObject.Set("type", "vless")
@@ -19,3 +19,29 @@ func TestVLESS(t *testing.T) {
 	indent, err := json.MarshalIndent(tag, "", "    ")
 	fmt.Println(string(indent))
 }
+
+func TestVLESSV2ray(t *testing.T) {
+	const v2rayVless = "vless://6666-66666666-666666@1.com:443?path=%2Fcccc&security=tls&encryption=none&alpn=h2,http/1.1&host=2.com&type=ws&sni=3.com#v2ray"
+	shareUrl, err := shareurls.Parse(v2rayVless)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := shareUrl.ToOutboundWithTag("v2ray", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"protocol":"vless","settings":{"address":"1.com","port":443,"uuid":"6666-66666666-666666"},"streamSettings":{"transport":"ws","transportSettings":{"path":"/cccc","header":[{"key":"Host","value":"2.com"}]},"security":"tls","securitySettings":{"serverName":"3.com","nextProtocol":["h2","http/1.1"]}},"tag":"proxy"}`; string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+	unsupported, err := shareurls.Parse(testVLESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unsupported.ToOutboundWithTag("v2ray", "proxy"); err == nil {
+		t.Error("v2ray should not support xtls flow")
+	}
+}
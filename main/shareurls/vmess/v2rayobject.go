@@ -0,0 +1,30 @@
+package vmess
+
+import (
+	"XrayHelper/main/serial"
+	"XrayHelper/main/shareurls/v2ray"
+	"strconv"
+)
+
+// getVmessSettingsObjectV2ray get v2ray v5 Vmess SettingsObject
+func getVmessSettingsObjectV2ray(vmess *Vmess) serial.OrderedMap {
+	var settingsObject serial.OrderedMap
+	settingsObject.Set("address", vmess.Server)
+	port, _ := strconv.Atoi(string(vmess.Port))
+	settingsObject.Set("port", port)
+	settingsObject.Set("uuid", vmess.Id)
+	return settingsObject
+}
+
+// getStreamSettingsObjectV2ray get v2ray v5 StreamSettingsObject
+func getStreamSettingsObjectV2ray(vmess *Vmess) serial.OrderedMap {
+	return v2ray.GetStreamSettingsObject(v2ray.Stream{
+		Network: string(vmess.Network),
+		Type:    string(vmess.Type),
+		Host:    string(vmess.Host),
+		Path:    string(vmess.Path),
+		Tls:     len(vmess.Tls) > 0,
+		Sni:     string(vmess.Sni),
+		Alpn:    string(vmess.Alpn),
+	})
+}
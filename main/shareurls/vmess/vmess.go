@@ -52,6 +52,13 @@ func (this *Vmess) ToOutboundWithTag(coreType string, tag string) (*serial.Order
 		outboundObject.Set("streamSettings", getStreamSettingsObjectXray(this))
 		outboundObject.Set("tag", tag)
 		return &outboundObject, nil
+	case "v2ray":
+		var outboundObject serial.OrderedMap
+		outboundObject.Set("protocol", "vmess")
+		outboundObject.Set("settings", getVmessSettingsObjectV2ray(this))
+		outboundObject.Set("streamSettings", getStreamSettingsObjectV2ray(this))
+		outboundObject.Set("tag", tag)
+		return &outboundObject, nil
 	case "sing-box":
 		var outboundObject serial.OrderedMap
 		outboundObject.Set("type", "vmess")
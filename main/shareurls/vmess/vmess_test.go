@@ -19,3 +19,21 @@ func TestVmess(t *testing.T) {
 	indent, err := json.MarshalIndent(tag, "", "    ")
 	fmt.Println(string(indent))
 }
+
+func TestVmessV2ray(t *testing.T) {
+	shareUrl, err := shareurls.Parse(testVmess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := shareUrl.ToOutboundWithTag("v2ray", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := json.Marshal(outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"protocol":"vmess","settings":{"address":"321.com","port":443,"uuid":"6666-6666-6666"},"streamSettings":{"transport":"tcp","transportSettings":{},"security":"tls","securitySettings":{"nextProtocol":["h2"]}},"tag":"proxy"}`; string(actual) != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+}
@@ -15,7 +15,7 @@ type Switch interface {
 
 func NewSwitch(coreType string) (Switch, error) {
 	switch coreType {
-	case "xray", "sing-box":
+	case "xray", "v2ray", "sing-box":
 		return new(ray.RaySwitch), nil
 	case "clash.meta", "mihomo":
 		return new(clash.ClashSwitch), nil